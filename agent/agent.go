@@ -46,6 +46,9 @@ func NewAgent(cfg *config.Config) *Agent {
 type inputUnit struct {
 	dst    chan<- telegraf.Metric
 	inputs []*models.RunningInput
+
+	// provisioner adds the inputs defined by the monitoring backend
+	provisioner *provisioner
 }
 
 //  ______     ┌───────────┐     ______
@@ -124,6 +127,14 @@ func (a *Agent) Run(ctx context.Context) error {
 		return err
 	}
 
+	var prov *provisioner
+	if a.Config.Agent.ProvisioningURL != "" {
+		var err error
+		if prov, err = newProvisioner(a); err != nil {
+			return err
+		}
+	}
+
 	startTime := time.Now()
 
 	log.Printf("D! [agent] Connecting outputs")
@@ -158,6 +169,7 @@ func (a *Agent) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	iu.provisioner = prov
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -382,50 +394,23 @@ func (a *Agent) runInputs(
 	unit *inputUnit,
 ) {
 	var wg sync.WaitGroup
-	tickers := make([]Ticker, 0, len(unit.inputs))
 	for _, input := range unit.inputs {
-		// Overwrite agent interval if this plugin has its own.
-		interval := time.Duration(a.Config.Agent.Interval)
-		if input.Config.Interval != 0 {
-			interval = input.Config.Interval
-		}
-
-		// Overwrite agent precision if this plugin has its own.
-		precision := time.Duration(a.Config.Agent.Precision)
-		if input.Config.Precision != 0 {
-			precision = input.Config.Precision
-		}
-
-		// Overwrite agent collection_jitter if this plugin has its own.
-		jitter := time.Duration(a.Config.Agent.CollectionJitter)
-		if input.Config.CollectionJitter != 0 {
-			jitter = input.Config.CollectionJitter
-		}
-
-		// Overwrite agent collection_offset if this plugin has its own.
-		offset := time.Duration(a.Config.Agent.CollectionOffset)
-		if input.Config.CollectionOffset != 0 {
-			offset = input.Config.CollectionOffset
-		}
-
-		var ticker Ticker
-		if a.Config.Agent.RoundInterval {
-			ticker = NewAlignedTicker(startTime, interval, jitter, offset)
-		} else {
-			ticker = NewUnalignedTicker(interval, jitter, offset)
-		}
-		tickers = append(tickers, ticker)
-
-		acc := NewAccumulator(input, unit.dst)
-		acc.SetPrecision(getPrecision(precision, interval))
-
 		wg.Add(1)
 		go func(input *models.RunningInput) {
 			defer wg.Done()
-			a.gatherLoop(ctx, acc, input, ticker, interval)
+			a.runInput(ctx, startTime, input, unit.dst)
 		}(input)
 	}
-	defer stopTickers(tickers)
+
+	// Inputs provisioned by the monitoring backend are stopped before the
+	// channel is closed
+	if unit.provisioner != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unit.provisioner.run(ctx, startTime, unit.dst)
+		}()
+	}
 	wg.Wait()
 
 	log.Printf("D! [agent] Stopping service inputs")
@@ -435,6 +420,52 @@ func (a *Agent) runInputs(
 	log.Printf("D! [agent] Input channel closed")
 }
 
+// runInput triggers the periodic gather of a single input until the context
+// is done.
+func (a *Agent) runInput(
+	ctx context.Context,
+	startTime time.Time,
+	input *models.RunningInput,
+	dst chan<- telegraf.Metric,
+) {
+	// Overwrite agent interval if this plugin has its own.
+	interval := time.Duration(a.Config.Agent.Interval)
+	if input.Config.Interval != 0 {
+		interval = input.Config.Interval
+	}
+
+	// Overwrite agent precision if this plugin has its own.
+	precision := time.Duration(a.Config.Agent.Precision)
+	if input.Config.Precision != 0 {
+		precision = input.Config.Precision
+	}
+
+	// Overwrite agent collection_jitter if this plugin has its own.
+	jitter := time.Duration(a.Config.Agent.CollectionJitter)
+	if input.Config.CollectionJitter != 0 {
+		jitter = input.Config.CollectionJitter
+	}
+
+	// Overwrite agent collection_offset if this plugin has its own.
+	offset := time.Duration(a.Config.Agent.CollectionOffset)
+	if input.Config.CollectionOffset != 0 {
+		offset = input.Config.CollectionOffset
+	}
+
+	var ticker Ticker
+	if a.Config.Agent.RoundInterval {
+		ticker = NewAlignedTicker(startTime, interval, jitter, offset)
+	} else {
+		ticker = NewUnalignedTicker(interval, jitter, offset)
+	}
+	defer ticker.Stop()
+
+	acc := NewAccumulator(input, dst)
+	acc.SetPrecision(getPrecision(precision, interval))
+
+	a.gatherLoop(ctx, acc, input, ticker, interval)
+}
+
 // testStartInputs is a variation of startInputs for use in --test and --once
 // mode. It differs by logging Start errors and returning only plugins
 // successfully started.
@@ -1208,9 +1239,3 @@ func panicRecover(input *models.RunningInput) {
 			"https://github.com/influxdata/telegraf/issues/new/choose")
 	}
 }
-
-func stopTickers(tickers []Ticker) {
-	for _, ticker := range tickers {
-		ticker.Stop()
-	}
-}
@@ -0,0 +1,418 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/models"
+	"github.com/influxdata/telegraf/persister"
+)
+
+const (
+	provisioningPoll   = "poll"
+	provisioningStream = "stream"
+)
+
+// provisionablePrefix limits the inputs the monitoring backend may define,
+// all other plugins are left to the configuration.
+const provisionablePrefix = "deepmon_"
+
+// maxDefinitionsSize limits the size of a definitions document.
+const maxDefinitionsSize = 16 << 20
+
+// monitorDefinitions is the document served by the monitoring backend. It
+// always lists all monitors of the agent, monitors missing in the document
+// are removed.
+type monitorDefinitions struct {
+	Monitors []monitorDefinition `json:"monitors"`
+}
+
+// monitorDefinition describes a single input. The config holds the plugin
+// options, including the common input options like interval and tags, as
+// they would be written in the plugin's TOML table.
+type monitorDefinition struct {
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Config map[string]interface{} `json:"config"`
+}
+
+// provisionedInput is the running input of a monitor definition. The input
+// is nil if the definition is invalid.
+type provisionedInput struct {
+	definition string
+	input      *models.RunningInput
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	// stateID registers the input with the persister, derived from the
+	// monitor so the state is restored after restarting the agent
+	stateID string
+	// state of the replaced input, kept while the definition is invalid
+	state interface{}
+}
+
+// provisioner runs the inputs defined by the monitoring backend next to the
+// ones of the configuration. Only the inputs whose definition changed are
+// replaced, all other plugins keep running.
+type provisioner struct {
+	agent    *Agent
+	client   *http.Client
+	url      string
+	mode     string
+	interval time.Duration
+	etag     string
+
+	startTime time.Time
+	dst       chan<- telegraf.Metric
+	inputs    map[string]*provisionedInput
+}
+
+func newProvisioner(a *Agent) (*provisioner, error) {
+	cfg := a.Config.Agent
+	u, err := url.Parse(cfg.ProvisioningURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provisioning_url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("provisioning_url scheme %q not supported", u.Scheme)
+	}
+
+	p := &provisioner{
+		agent:    a,
+		client:   &http.Client{},
+		url:      cfg.ProvisioningURL,
+		mode:     cfg.ProvisioningMode,
+		interval: time.Duration(cfg.ProvisioningInterval),
+		inputs:   make(map[string]*provisionedInput),
+	}
+	switch p.mode {
+	case "":
+		p.mode = provisioningPoll
+	case provisioningPoll, provisioningStream:
+	default:
+		return nil, fmt.Errorf("invalid provisioning_mode %q", p.mode)
+	}
+	if p.interval <= 0 {
+		p.interval = 30 * time.Second
+	}
+	return p, nil
+}
+
+// run keeps the provisioned inputs in sync with the definitions until the
+// context is done and stops all of them afterwards.
+func (p *provisioner) run(ctx context.Context, startTime time.Time, dst chan<- telegraf.Metric) {
+	p.startTime = startTime
+	p.dst = dst
+	defer p.stopAll()
+
+	log.Printf("I! [agent] Provisioning inputs from %s", p.url)
+	for {
+		var err error
+		if p.mode == provisioningStream {
+			err = p.stream(ctx)
+		} else {
+			err = p.poll(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("E! [agent] Provisioning inputs failed: %v", err)
+		}
+		if err := internal.SleepContext(ctx, p.interval); err != nil {
+			return
+		}
+	}
+}
+
+// poll requests the definitions once, the backend may answer with "304 Not
+// Modified" if the definitions did not change since the last request.
+func (p *provisioner) poll(ctx context.Context) error {
+	// The inputs outlive the request
+	reqCtx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	resp, err := p.request(reqCtx, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("received status %s", resp.Status)
+	}
+
+	monitors, err := decodeDefinitions(io.LimitReader(resp.Body, maxDefinitionsSize))
+	if err != nil {
+		return err
+	}
+	p.apply(ctx, monitors)
+	p.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+// stream keeps the connection open while the backend sends the complete
+// definitions as one JSON document per line whenever they change. Empty
+// lines may be sent to keep the connection alive.
+func (p *provisioner) stream(ctx context.Context) error {
+	resp, err := p.request(ctx, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxDefinitionsSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		monitors, err := decodeDefinitions(bytes.NewReader(line))
+		if err != nil {
+			return err
+		}
+		p.apply(ctx, monitors)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Printf("D! [agent] Provisioning stream closed by the server")
+	return nil
+}
+
+func (p *provisioner) request(ctx context.Context, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", internal.ProductToken())
+	if p.etag != "" && accept == "application/json" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+
+	token := p.agent.Config.Agent.ProvisioningToken
+	if !token.Empty() {
+		secret, err := token.Get()
+		if err != nil {
+			return nil, fmt.Errorf("getting token failed: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret.String())
+		secret.Destroy()
+	}
+
+	return p.client.Do(req)
+}
+
+func decodeDefinitions(r io.Reader) ([]monitorDefinition, error) {
+	// Keep integers intact when the options are converted to TOML
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	var definitions monitorDefinitions
+	if err := decoder.Decode(&definitions); err != nil {
+		return nil, fmt.Errorf("decoding definitions failed: %w", err)
+	}
+	return definitions.Monitors, nil
+}
+
+// apply starts the inputs of new monitors, replaces the ones of changed
+// monitors and stops the ones of removed monitors. The latest definition
+// wins, so an invalid definition stops the monitor until it is fixed.
+func (p *provisioner) apply(ctx context.Context, monitors []monitorDefinition) {
+	seen := make(map[string]bool, len(monitors))
+	for _, m := range monitors {
+		if m.ID == "" {
+			log.Printf("E! [agent] Ignoring provisioned %q monitor without ID", m.Type)
+			continue
+		}
+		if seen[m.ID] {
+			log.Printf("E! [agent] Ignoring duplicate provisioned monitor %q", m.ID)
+			continue
+		}
+		seen[m.ID] = true
+
+		serialized, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("E! [agent] Provisioning monitor %q failed: %v", m.ID, err)
+			continue
+		}
+		definition := string(serialized)
+		current, found := p.inputs[m.ID]
+		if found && current.definition == definition {
+			continue
+		}
+
+		var state interface{}
+		if found {
+			if current.input != nil {
+				p.stop(current)
+				if plugin, ok := current.input.Input.(telegraf.StatefulPlugin); ok && current.input.Config.Name == m.Type {
+					state = plugin.GetState()
+				}
+			} else if current.stateID == stateID(m) {
+				state = current.state
+			}
+			// The persisted state of a monitor whose definition was invalid
+			// since the start is kept
+			if current.input != nil || current.stateID != stateID(m) {
+				p.unregister(current)
+			}
+		}
+
+		provisioned, err := p.start(ctx, m, state)
+		if err != nil {
+			log.Printf("E! [agent] Provisioning monitor %q failed: %v", m.ID, err)
+			provisioned = &provisionedInput{stateID: stateID(m), state: state}
+		} else if found {
+			log.Printf("I! [agent] Updated provisioned input %s", provisioned.input.LogName())
+		} else {
+			log.Printf("I! [agent] Added provisioned input %s", provisioned.input.LogName())
+		}
+		provisioned.definition = definition
+		p.inputs[m.ID] = provisioned
+	}
+
+	for id, current := range p.inputs {
+		if seen[id] {
+			continue
+		}
+		p.stop(current)
+		p.unregister(current)
+		delete(p.inputs, id)
+		log.Printf("I! [agent] Removed provisioned monitor %q", id)
+	}
+
+	// Drop the persisted states of monitors removed while the agent was down
+	if states := p.agent.Config.Persister; states != nil {
+		kept := make(map[string]bool, len(p.inputs))
+		for _, current := range p.inputs {
+			kept[current.stateID] = true
+		}
+		states.DropPending(func(id string) bool {
+			return !kept[id]
+		})
+	}
+}
+
+// start creates the input of the definition and runs it until it is stopped.
+// The state of a replaced input of the same plugin is carried over, new
+// inputs get the state persisted by the last run of the agent.
+func (p *provisioner) start(ctx context.Context, m monitorDefinition, state interface{}) (*provisionedInput, error) {
+	if !strings.HasPrefix(m.Type, provisionablePrefix) {
+		return nil, fmt.Errorf("input %q cannot be provisioned", m.Type)
+	}
+
+	options := make(map[string]interface{}, len(m.Config)+1)
+	for k, v := range m.Config {
+		options[k] = v
+	}
+	// Tell the inputs apart in the logs
+	if _, found := options["alias"]; !found {
+		options["alias"] = m.ID
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(options); err != nil {
+		return nil, fmt.Errorf("encoding config failed: %w", err)
+	}
+
+	input, err := p.agent.Config.NewInput(m.Type, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// States are restored before initializing like done by the persister
+	id := stateID(m)
+	plugin, stateful := input.Input.(telegraf.StatefulPlugin)
+	if stateful {
+		var err error
+		if state != nil {
+			err = plugin.SetState(state)
+		} else if states := p.agent.Config.Persister; states != nil {
+			err = states.Restore(id, plugin)
+		}
+		if err != nil {
+			log.Printf("W! [agent] Restoring state of %s failed: %v", input.LogName(), err)
+		}
+	}
+	if err := input.Init(); err != nil {
+		return nil, fmt.Errorf("could not initialize input %s: %w", input.LogName(), err)
+	}
+
+	// Service inputs are not subject to timestamp rounding, see startInputs
+	acc := NewAccumulator(input, p.dst)
+	acc.SetPrecision(getPrecision(input.Config.Precision, 0))
+	if err := input.Start(acc); err != nil {
+		return nil, fmt.Errorf("starting input %s: %w", input.LogName(), err)
+	}
+
+	if states := p.agent.Config.Persister; states != nil && stateful {
+		if err := states.Register(id, plugin); err != nil {
+			input.Stop()
+			return nil, fmt.Errorf("could not register input %s: %w", input.LogName(), err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	provisioned := &provisionedInput{
+		input:   input,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		stateID: id,
+	}
+	go func() {
+		defer close(provisioned.done)
+		p.agent.runInput(ctx, p.startTime, input, p.dst)
+	}()
+	return provisioned, nil
+}
+
+// stop waits for an ongoing gather of the input to complete before stopping
+// it.
+func (p *provisioner) stop(provisioned *provisionedInput) {
+	if provisioned.input == nil {
+		return
+	}
+	provisioned.cancel()
+	<-provisioned.done
+	provisioned.input.Stop()
+}
+
+// unregister drops the state of the input from the persister. Inputs stopped
+// on shutdown stay registered to persist their states.
+func (p *provisioner) unregister(provisioned *provisionedInput) {
+	if states := p.agent.Config.Persister; states != nil && provisioned.stateID != "" {
+		states.Unregister(provisioned.stateID)
+	}
+}
+
+// stateID identifies the state of the monitor's input, states of another
+// plugin are not restored.
+func stateID(m monitorDefinition) string {
+	return persister.ProvisionedPrefix + m.Type + "/" + m.ID
+}
+
+func (p *provisioner) stopAll() {
+	for id, provisioned := range p.inputs {
+		p.stop(provisioned)
+		delete(p.inputs, id)
+	}
+}
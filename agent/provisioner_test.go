@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/persister"
+	"github.com/influxdata/telegraf/plugins/inputs"
+)
+
+type provisionedMock struct {
+	Target string `toml:"target"`
+
+	stopped  atomic.Bool
+	restored string
+}
+
+func (*provisionedMock) SampleConfig() string {
+	return ""
+}
+
+func (m *provisionedMock) Gather(acc telegraf.Accumulator) error {
+	acc.AddFields("provisioned", map[string]interface{}{"value": 1}, map[string]string{"target": m.Target})
+	return nil
+}
+
+func (*provisionedMock) Start(telegraf.Accumulator) error {
+	return nil
+}
+
+func (m *provisionedMock) Stop() {
+	m.stopped.Store(true)
+}
+
+// GetState returns the target to tell the restored instance apart
+func (m *provisionedMock) GetState() interface{} {
+	return m.Target
+}
+
+func (m *provisionedMock) SetState(state interface{}) error {
+	m.restored = state.(string)
+	return nil
+}
+
+func init() {
+	inputs.Add("deepmon_provisioned_mock", func() telegraf.Input { return &provisionedMock{} })
+}
+
+// definitionsServer serves the definitions and counts the requests
+type definitionsServer struct {
+	sync.Mutex
+	body     string
+	etag     string
+	requests int
+}
+
+func (s *definitionsServer) set(body string) {
+	s.Lock()
+	defer s.Unlock()
+	s.body = body
+	s.etag = fmt.Sprintf(`"%d"`, len(body))
+}
+
+func (s *definitionsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	_, _ = w.Write([]byte(s.body))
+}
+
+func newTestProvisioner(t *testing.T, url, mode string) (*provisioner, chan telegraf.Metric) {
+	c := config.NewConfig()
+	c.Agent.Interval = config.Duration(10 * time.Millisecond)
+	c.Agent.ProvisioningURL = url
+	c.Agent.ProvisioningMode = mode
+	c.Agent.ProvisioningInterval = config.Duration(10 * time.Millisecond)
+	c.Agent.ProvisioningToken = config.NewSecret([]byte("secret"))
+
+	p, err := newProvisioner(NewAgent(c))
+	require.NoError(t, err)
+
+	dst := make(chan telegraf.Metric, 100)
+	p.startTime = time.Now()
+	p.dst = dst
+	return p, dst
+}
+
+func TestProvisionerInvalidSettings(t *testing.T) {
+	c := config.NewConfig()
+	c.Agent.ProvisioningURL = "grpc://localhost"
+	_, err := newProvisioner(NewAgent(c))
+	require.ErrorContains(t, err, "not supported")
+
+	c = config.NewConfig()
+	c.Agent.ProvisioningURL = "http://localhost"
+	c.Agent.ProvisioningMode = "push"
+	_, err = newProvisioner(NewAgent(c))
+	require.ErrorContains(t, err, "invalid provisioning_mode")
+}
+
+func TestProvisionerPoll(t *testing.T) {
+	server := &definitionsServer{}
+	server.set(`{"monitors": [
+		{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.com"}},
+		{"id": "b", "type": "deepmon_provisioned_mock", "config": {"target": "b.example.com"}},
+		{"id": "c", "type": "cpu", "config": {}}
+	]}`)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	p, dst := newTestProvisioner(t, ts.URL, "")
+	defer p.stopAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, p.poll(ctx))
+	require.Len(t, p.inputs, 3)
+	require.NotNil(t, p.inputs["a"].input)
+	require.NotNil(t, p.inputs["b"].input)
+	require.Nil(t, p.inputs["c"].input, "non-deepmon inputs must not be provisioned")
+	require.Equal(t, "a", p.inputs["a"].input.Config.Alias)
+
+	// The inputs are gathered
+	m := <-dst
+	require.Equal(t, "provisioned", m.Name())
+
+	// Unchanged definitions are not requested again
+	a, b := p.inputs["a"], p.inputs["b"]
+	require.NoError(t, p.poll(ctx))
+	require.Same(t, a, p.inputs["a"])
+	require.Same(t, b, p.inputs["b"])
+
+	// Only the changed monitor is replaced and removed monitors are stopped
+	server.set(`{"monitors": [
+		{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.com"}},
+		{"id": "b", "type": "deepmon_provisioned_mock", "config": {"target": "b.example.org"}}
+	]}`)
+	require.NoError(t, p.poll(ctx))
+	require.Len(t, p.inputs, 2)
+	require.Same(t, a, p.inputs["a"])
+	require.NotSame(t, b, p.inputs["b"])
+	require.True(t, b.input.Input.(*provisionedMock).stopped.Load())
+	require.False(t, a.input.Input.(*provisionedMock).stopped.Load())
+	require.Equal(t, "b.example.org", p.inputs["b"].input.Input.(*provisionedMock).Target)
+
+	server.Lock()
+	require.Equal(t, 3, server.requests)
+	server.Unlock()
+}
+
+func TestProvisionerPollInvalidOption(t *testing.T) {
+	server := &definitionsServer{}
+	server.set(`{"monitors": [
+		{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.com", "unknown": 1}},
+		{"id": "b", "type": "deepmon_provisioned_mock", "config": {"target": "b.example.com"}}
+	]}`)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	p, _ := newTestProvisioner(t, ts.URL, "poll")
+	defer p.stopAll()
+
+	require.NoError(t, p.poll(context.Background()))
+	require.Nil(t, p.inputs["a"].input)
+	require.NotNil(t, p.inputs["b"].input)
+}
+
+func TestProvisionerPersistState(t *testing.T) {
+	server := &definitionsServer{}
+	server.set(`{"monitors": [
+		{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.com"}},
+		{"id": "b", "type": "deepmon_provisioned_mock", "config": {"target": "b.example.com"}}
+	]}`)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	statefile := filepath.Join(t.TempDir(), "states.json")
+
+	run := func() *provisioner {
+		p, _ := newTestProvisioner(t, ts.URL, "poll")
+		p.agent.Config.Persister = &persister.Persister{Filename: statefile}
+		require.NoError(t, p.agent.Config.Persister.Init())
+		if err := p.agent.Config.Persister.Load(); err != nil {
+			require.ErrorIs(t, err, os.ErrNotExist)
+		}
+		require.NoError(t, p.poll(context.Background()))
+		return p
+	}
+
+	p := run()
+	require.Empty(t, p.inputs["a"].input.Input.(*provisionedMock).restored)
+	p.stopAll()
+	require.NoError(t, p.agent.Config.Persister.Store())
+
+	// The states are restored after a restart, removed monitors are dropped
+	server.set(`{"monitors": [
+		{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.org"}}
+	]}`)
+	p = run()
+	require.Equal(t, "a.example.com", p.inputs["a"].input.Input.(*provisionedMock).restored)
+	p.stopAll()
+	require.NoError(t, p.agent.Config.Persister.Store())
+
+	var states map[string][]byte
+	buf, err := os.ReadFile(statefile)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(buf, &states))
+	require.Equal(t, map[string][]byte{"provisioned/deepmon_provisioned_mock/a": []byte(`"a.example.org"`)}, states)
+}
+
+func TestProvisionerStream(t *testing.T) {
+	updates := make(chan string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/x-ndjson", r.Header.Get("Accept"))
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				_, _ = w.Write([]byte(update + "\n"))
+				flusher.Flush()
+			}
+		}
+	}))
+	defer ts.Close()
+
+	p, _ := newTestProvisioner(t, ts.URL, "stream")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.stream(ctx)
+	}()
+
+	updates <- `{"monitors": [{"id": "a", "type": "deepmon_provisioned_mock", "config": {"target": "a.example.com"}}]}`
+	updates <- ``
+	updates <- `{"monitors": [{"id": "b", "type": "deepmon_provisioned_mock", "config": {"target": "b.example.com"}}]}`
+	close(updates)
+	require.NoError(t, <-done)
+	cancel()
+
+	require.Len(t, p.inputs, 1)
+	require.Contains(t, p.inputs, "b")
+	p.stopAll()
+	require.Empty(t, p.inputs)
+}
@@ -289,6 +289,23 @@ type AgentConfig struct {
 	// BufferDirectory is the directory to store buffer files for serialized
 	// to disk metrics when using the "disk" buffer strategy.
 	BufferDirectory string `toml:"buffer_directory"`
+
+	// ProvisioningURL is the endpoint of the monitoring backend serving the
+	// definitions of deepmon inputs. Those inputs are added, updated and
+	// removed while the agent is running.
+	ProvisioningURL string `toml:"provisioning_url"`
+
+	// ProvisioningMode is either "poll" to request the definitions every
+	// ProvisioningInterval or "stream" to keep the connection open and
+	// receive every change of the definitions.
+	ProvisioningMode string `toml:"provisioning_mode"`
+
+	// ProvisioningInterval is the polling interval and the delay before
+	// reconnecting a stream.
+	ProvisioningInterval Duration `toml:"provisioning_interval"`
+
+	// ProvisioningToken is sent as bearer token to the monitoring backend.
+	ProvisioningToken Secret `toml:"provisioning_token"`
 }
 
 // InputNames returns a list of strings of the configured inputs.
@@ -508,8 +525,16 @@ func (c *Config) LoadAll(configFiles ...string) error {
 	return c.LinkSecrets()
 }
 
+// loadMutex serializes loading plugins, which share the list of unlinked
+// secrets and the error and unused-field books of the config. Inputs are
+// created by NewInput while the agent is running.
+var loadMutex sync.Mutex
+
 // LoadConfigData loads TOML-formatted config data
 func (c *Config) LoadConfigData(data []byte) error {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
 	tbl, err := parseConfig(data)
 	if err != nil {
 		return fmt.Errorf("error parsing data: %w", err)
@@ -929,7 +954,14 @@ func (c *Config) addSecretStore(name string, table *ast.Table) error {
 }
 
 func (c *Config) LinkSecrets() error {
-	for _, s := range unlinkedSecrets {
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	return c.linkSecrets(unlinkedSecrets)
+}
+
+func (c *Config) linkSecrets(secrets []*Secret) error {
+	for _, s := range secrets {
 		resolvers := make(map[string]telegraf.ResolveFunc)
 		for _, ref := range s.GetUnlinked() {
 			// Split the reference and lookup the resolver
@@ -1236,6 +1268,50 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 		return nil
 	}
 
+	rp, err := c.newInput(name, table)
+	if err != nil {
+		return err
+	}
+	c.Inputs = append(c.Inputs, rp)
+
+	return nil
+}
+
+// NewInput creates a running input from the TOML data of a single plugin
+// table without adding it to the configuration. This is used for inputs
+// provisioned while the agent is running.
+func (c *Config) NewInput(name string, data []byte) (*models.RunningInput, error) {
+	tbl, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing data: %w", err)
+	}
+
+	loadMutex.Lock()
+	defer loadMutex.Unlock()
+
+	// Errors of one plugin must not fail the ones created later. Only the
+	// secrets of the plugin are linked and dropped from the list afterwards,
+	// which would otherwise grow with every input created.
+	linked := len(unlinkedSecrets)
+	defer func() {
+		c.errs = nil
+		c.UnusedFields = make(map[string]bool)
+		clear(unlinkedSecrets[linked:])
+		unlinkedSecrets = unlinkedSecrets[:linked]
+	}()
+
+	rp, err := c.newInput(name, tbl)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.UnusedFields) > 0 {
+		return nil, fmt.Errorf("configuration specified the fields %q, but they were not used", keys(c.UnusedFields))
+	}
+
+	return rp, c.linkSecrets(unlinkedSecrets[linked:])
+}
+
+func (c *Config) newInput(name string, table *ast.Table) (*models.RunningInput, error) {
 	// For inputs with parsers we need to compute the set of
 	// options that is not covered by both, the parser and the input.
 	// We achieve this by keeping a local book of missing entries
@@ -1252,10 +1328,10 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 		// Handle removed, deprecated plugins
 		if di, deprecated := inputs.Deprecations[name]; deprecated {
 			printHistoricPluginDeprecationNotice("inputs", name, di)
-			return errors.New("plugin deprecated")
+			return nil, errors.New("plugin deprecated")
 		}
 
-		return fmt.Errorf("undefined but requested input: %s", name)
+		return nil, fmt.Errorf("undefined but requested input: %s", name)
 	}
 	input := creator()
 
@@ -1265,7 +1341,7 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 		missCountThreshold = 1
 		parser, err := c.addParser("inputs", name, table)
 		if err != nil {
-			return fmt.Errorf("adding parser failed: %w", err)
+			return nil, fmt.Errorf("adding parser failed: %w", err)
 		}
 		t.SetParser(parser)
 	}
@@ -1273,7 +1349,7 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 	if t, ok := input.(telegraf.ParserFuncPlugin); ok {
 		missCountThreshold = 1
 		if !c.probeParser("inputs", name, table) {
-			return errors.New("parser not found")
+			return nil, errors.New("parser not found")
 		}
 		t.SetParserFunc(func() (telegraf.Parser, error) {
 			return c.addParser("inputs", name, table)
@@ -1282,20 +1358,20 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 
 	pluginConfig, err := c.buildInput(name, table)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := c.toml.UnmarshalTable(table, input); err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := c.printUserDeprecation("inputs", name, input); err != nil {
-		return err
+		return nil, err
 	}
 
 	if c, ok := interface{}(input).(interface{ TLSConfig() (*tls.Config, error) }); ok {
 		if _, err := c.TLSConfig(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -1305,15 +1381,14 @@ func (c *Config) addInput(name string, table *ast.Table) error {
 			continue
 		}
 		if err := c.missingTomlField(nil, key); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	rp := models.NewRunningInput(input, pluginConfig)
 	rp.SetDefaultTags(c.Tags)
-	c.Inputs = append(c.Inputs, rp)
 
-	return nil
+	return rp, nil
 }
 
 // buildAggregator parses Aggregator specific items from the ast.Table,
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"testing"
 
 	"github.com/awnumar/memguard"
@@ -417,6 +418,78 @@ func TestSecretStoreStatic(t *testing.T) {
 	}
 }
 
+func TestSecretStoreNewInput(t *testing.T) {
+	unlinkedSecrets = make([]*Secret, 0)
+	defer func() { unlinkedSecrets = make([]*Secret, 0) }()
+
+	// A secret of a store not available anymore
+	var stale Secret
+	require.NoError(t, stale.UnmarshalText([]byte("@{gone:secret}")))
+	require.Len(t, unlinkedSecrets, 1)
+
+	c := NewConfig()
+	store := &MockupSecretStore{
+		Secrets: map[string][]byte{"secret1": []byte("Ood Bnar")},
+	}
+	require.NoError(t, store.Init())
+	c.SecretStores["mock"] = store
+
+	// Only the secrets of the new input are linked and dropped afterwards
+	for range 3 {
+		input, err := c.NewInput("mockup", []byte(`secret = "@{mock:secret1}"`))
+		require.NoError(t, err)
+		secret, err := input.Input.(*MockupSecretPlugin).Secret.Get()
+		require.NoError(t, err)
+		require.EqualValues(t, "Ood Bnar", secret.TemporaryString())
+		secret.Destroy()
+		require.Len(t, unlinkedSecrets, 1)
+	}
+
+	_, err := c.NewInput("mockup", []byte(`secret = "@{unknown:secret1}"`))
+	require.ErrorContains(t, err, "unknown secret-store")
+	require.Len(t, unlinkedSecrets, 1)
+}
+
+func TestSecretStoreNewInputConcurrent(t *testing.T) {
+	unlinkedSecrets = make([]*Secret, 0)
+	defer func() { unlinkedSecrets = make([]*Secret, 0) }()
+
+	c := NewConfig()
+	store := &MockupSecretStore{
+		Secrets: map[string][]byte{"secret1": []byte("Ood Bnar")},
+	}
+	require.NoError(t, store.Init())
+	c.SecretStores["mock"] = store
+
+	// Inputs are created next to each other, e.g. by the provisioner
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := `secret = "@{mock:secret1}"`
+			if i%2 == 1 {
+				data = `secret = "@{unknown:secret1}"`
+			}
+			_, err := c.NewInput("mockup", []byte(data))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var failed int
+	for err := range errs {
+		if err != nil {
+			require.ErrorContains(t, err, "unknown secret-store")
+			failed++
+		}
+	}
+	require.Equal(t, 10, failed)
+	require.Empty(t, unlinkedSecrets)
+}
+
 func TestSecretStoreInvalidKeys(t *testing.T) {
 	cfg := []byte(
 		`
@@ -5,18 +5,27 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 
 	"github.com/influxdata/telegraf"
 )
 
+// ProvisionedPrefix marks the IDs of plugins registered after loading the
+// states, i.e. the inputs provisioned by the monitoring backend.
+const ProvisionedPrefix = "provisioned/"
+
 type Persister struct {
 	Filename string
 
 	register map[string]telegraf.StatefulPlugin
+	// states of provisioned plugins not registered when loading, kept until
+	// the plugins are registered
+	pending map[string][]byte
 }
 
 func (p *Persister) Init() error {
 	p.register = make(map[string]telegraf.StatefulPlugin)
+	p.pending = make(map[string][]byte)
 
 	return nil
 }
@@ -30,6 +39,32 @@ func (p *Persister) Register(id string, plugin telegraf.StatefulPlugin) error {
 	return nil
 }
 
+// Unregister removes the plugin, its state is dropped.
+func (p *Persister) Unregister(id string) {
+	delete(p.register, id)
+	delete(p.pending, id)
+}
+
+// Restore sets the loaded state of a provisioned plugin not registered when
+// loading.
+func (p *Persister) Restore(id string, plugin telegraf.StatefulPlugin) error {
+	serialized, found := p.pending[id]
+	if !found {
+		return nil
+	}
+	return setState(id, plugin, serialized)
+}
+
+// DropPending removes the loaded states of plugins not registered for which
+// the given function returns true.
+func (p *Persister) DropPending(drop func(id string) bool) {
+	for id := range p.pending {
+		if drop(id) {
+			delete(p.pending, id)
+		}
+	}
+}
+
 func (p *Persister) Load() error {
 	// Read the states from disk
 	in, err := os.ReadFile(p.Filename)
@@ -45,32 +80,47 @@ func (p *Persister) Load() error {
 
 	// Get the initialized state as blueprint for unmarshalling
 	for id, serialized := range states {
-		// Check if we have a plugin with that ID
+		// Check if we have a plugin with that ID, the states of provisioned
+		// plugins are kept for the plugins registered later on
 		plugin, found := p.register[id]
 		if !found {
+			if strings.HasPrefix(id, ProvisionedPrefix) {
+				p.pending[id] = serialized
+			}
 			continue
 		}
-
-		// Create a new empty state of the "state"-type. As we need a pointer
-		// of the state, we cannot dereference it here due to the unknown
-		// nature of the state-type.
-		nstate := reflect.New(reflect.TypeOf(plugin.GetState())).Interface()
-		if err := json.Unmarshal(serialized, &nstate); err != nil {
-			return fmt.Errorf("unmarshalling state for %q failed: %w", id, err)
+		if err := setState(id, plugin, serialized); err != nil {
+			return err
 		}
-		state := reflect.ValueOf(nstate).Elem().Interface()
+	}
 
-		// Set the state in the plugin
-		if err := plugin.SetState(state); err != nil {
-			return fmt.Errorf("setting state of %q failed: %w", id, err)
-		}
+	return nil
+}
+
+func setState(id string, plugin telegraf.StatefulPlugin, serialized []byte) error {
+	// Create a new empty state of the "state"-type. As we need a pointer
+	// of the state, we cannot dereference it here due to the unknown
+	// nature of the state-type.
+	nstate := reflect.New(reflect.TypeOf(plugin.GetState())).Interface()
+	if err := json.Unmarshal(serialized, &nstate); err != nil {
+		return fmt.Errorf("unmarshalling state for %q failed: %w", id, err)
 	}
+	state := reflect.ValueOf(nstate).Elem().Interface()
 
+	// Set the state in the plugin
+	if err := plugin.SetState(state); err != nil {
+		return fmt.Errorf("setting state of %q failed: %w", id, err)
+	}
 	return nil
 }
 
 func (p *Persister) Store() error {
-	states := make(map[string][]byte)
+	states := make(map[string][]byte, len(p.pending)+len(p.register))
+
+	// Keep the states of provisioned plugins not registered (yet)
+	for id, state := range p.pending {
+		states[id] = state
+	}
 
 	// Collect the states and serialize the individual data chunks
 	// to later serialize all items in the id / serialized-states map
@@ -0,0 +1,117 @@
+package persister
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockPlugin struct {
+	State string
+}
+
+func (m *mockPlugin) GetState() interface{} {
+	return m.State
+}
+
+func (m *mockPlugin) SetState(state interface{}) error {
+	m.State = state.(string)
+	return nil
+}
+
+// newPersister loads the states of the file with the given plugins registered
+func newPersister(t *testing.T, filename string, plugins map[string]*mockPlugin) *Persister {
+	p := &Persister{Filename: filename}
+	require.NoError(t, p.Init())
+	for id, plugin := range plugins {
+		require.NoError(t, p.Register(id, plugin))
+	}
+	if err := p.Load(); err != nil {
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	return p
+}
+
+func readStates(t *testing.T, filename string) map[string]string {
+	buf, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	var serialized map[string][]byte
+	require.NoError(t, json.Unmarshal(buf, &serialized))
+	states := make(map[string]string, len(serialized))
+	for id, state := range serialized {
+		var s string
+		require.NoError(t, json.Unmarshal(state, &s))
+		states[id] = s
+	}
+	return states
+}
+
+func TestRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "states.json")
+
+	p := newPersister(t, filename, map[string]*mockPlugin{
+		"static": {State: "a"},
+	})
+	require.NoError(t, p.Register("provisioned/mock/1", &mockPlugin{State: "b"}))
+	require.NoError(t, p.Store())
+
+	// Static plugins get their states when loading, provisioned ones when
+	// they are registered later on
+	static := &mockPlugin{}
+	p = newPersister(t, filename, map[string]*mockPlugin{"static": static})
+	require.Equal(t, "a", static.State)
+
+	provisioned := &mockPlugin{}
+	require.NoError(t, p.Restore("provisioned/mock/1", provisioned))
+	require.Equal(t, "b", provisioned.State)
+	unknown := &mockPlugin{}
+	require.NoError(t, p.Restore("provisioned/mock/2", unknown))
+	require.Empty(t, unknown.State)
+
+	// The pending state is kept until the plugin is registered
+	require.NoError(t, p.Store())
+	require.Equal(t, map[string]string{"static": "a", "provisioned/mock/1": "b"}, readStates(t, filename))
+	provisioned.State = "c"
+	require.NoError(t, p.Register("provisioned/mock/1", provisioned))
+	require.NoError(t, p.Store())
+	require.Equal(t, map[string]string{"static": "a", "provisioned/mock/1": "c"}, readStates(t, filename))
+
+	// Unregistered plugins are dropped
+	p.Unregister("provisioned/mock/1")
+	require.NoError(t, p.Store())
+	require.Equal(t, map[string]string{"static": "a"}, readStates(t, filename))
+}
+
+func TestDropPending(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "states.json")
+
+	p := newPersister(t, filename, nil)
+	require.NoError(t, p.Register("provisioned/mock/1", &mockPlugin{State: "a"}))
+	require.NoError(t, p.Register("provisioned/mock/2", &mockPlugin{State: "b"}))
+	require.NoError(t, p.Store())
+
+	p = newPersister(t, filename, nil)
+	p.DropPending(func(id string) bool { return id == "provisioned/mock/2" })
+	require.NoError(t, p.Store())
+	require.Equal(t, map[string]string{"provisioned/mock/1": "a"}, readStates(t, filename))
+}
+
+func TestDropRemovedStatic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "states.json")
+
+	p := newPersister(t, filename, map[string]*mockPlugin{
+		"kept":    {State: "a"},
+		"removed": {State: "b"},
+	})
+	require.NoError(t, p.Store())
+
+	// The states of plugins removed from the configuration are not kept
+	kept := &mockPlugin{}
+	p = newPersister(t, filename, map[string]*mockPlugin{"kept": kept})
+	require.Equal(t, "a", kept.State)
+	require.NoError(t, p.Store())
+	require.Equal(t, map[string]string{"kept": "a"}, readStates(t, filename))
+}
@@ -0,0 +1,5 @@
+//go:build !custom || aggregators || aggregators.deepmon_sla
+
+package all
+
+import _ "github.com/influxdata/telegraf/plugins/aggregators/deepmon_sla" // register plugin
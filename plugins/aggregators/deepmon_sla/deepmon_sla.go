@@ -0,0 +1,378 @@
+//go:generate ../../../tools/readme_config_includer/generator
+package deepmon_sla
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/aggregators"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+const measurement = "deepmon_sla"
+
+// bucketsPerWindow is the resolution of the windows, the checks of a window
+// are counted in this many buckets.
+const bucketsPerWindow = 60
+
+type SLA struct {
+	Windows   []config.Duration   `toml:"windows"`
+	SLO       float64             `toml:"slo"`
+	KeyTags   []string            `toml:"key_tags"`
+	DownField string              `toml:"down_field"`
+	UpValues  map[string][]string `toml:"up_values"`
+
+	up       map[string]map[string]bool
+	longest  time.Duration
+	monitors monitorStats
+	now      func() time.Time
+}
+
+// monitorStats holds the statistics of every monitor by its key, persisted
+// across restarts.
+type monitorStats map[string]*monitor
+
+// monitor holds the checks of a monitor by window and its outages within the
+// longest window.
+type monitor struct {
+	Tags    map[string]string   `json:"tags"`
+	First   time.Time           `json:"first"`
+	Last    time.Time           `json:"last"`
+	Down    bool                `json:"down"`
+	Windows map[string][]bucket `json:"windows"`
+	Outages []outage            `json:"outages,omitempty"`
+}
+
+// bucket counts the checks starting at the unix time.
+type bucket struct {
+	Start  int64 `json:"start"`
+	Checks int   `json:"checks"`
+	Failed int   `json:"failed"`
+}
+
+// outage lasts from the first failed check to the first successful one, the
+// end is zero while the outage is ongoing.
+type outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+func (*SLA) SampleConfig() string {
+	return sampleConfig
+}
+
+func (s *SLA) Init() error {
+	if len(s.Windows) == 0 {
+		return errors.New("at least one window is required")
+	}
+	seen := make(map[string]bool, len(s.Windows))
+	for _, w := range s.Windows {
+		if time.Duration(w) < bucketsPerWindow*time.Second {
+			return fmt.Errorf("window %s is shorter than %d seconds", time.Duration(w), bucketsPerWindow)
+		}
+		label := windowLabel(time.Duration(w))
+		if seen[label] {
+			return fmt.Errorf("duplicate window %s", label)
+		}
+		seen[label] = true
+		s.longest = max(s.longest, time.Duration(w))
+	}
+	if s.SLO <= 0 || s.SLO >= 100 {
+		return errors.New("slo must be between 0 and 100 percent")
+	}
+	// Set by default here as tables are merged into existing maps
+	if s.UpValues == nil {
+		s.UpValues = map[string][]string{"result": {"0"}}
+	}
+	s.up = make(map[string]map[string]bool, len(s.UpValues))
+	for field, values := range s.UpValues {
+		s.up[field] = make(map[string]bool, len(values))
+		for _, v := range values {
+			s.up[field][v] = true
+		}
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	// States are restored before the plugin is initialized, windows no longer
+	// configured are dropped
+	if s.monitors == nil {
+		s.monitors = make(monitorStats)
+	}
+	for _, m := range s.monitors {
+		for label := range m.Windows {
+			if !seen[label] {
+				delete(m.Windows, label)
+			}
+		}
+	}
+	return nil
+}
+
+// Add counts the check of the metric for its monitor.
+func (s *SLA) Add(in telegraf.Metric) {
+	down, found := s.isDown(in)
+	if !found {
+		return
+	}
+
+	key, tags := s.key(in)
+	m, found := s.monitors[key]
+	if !found {
+		m = &monitor{
+			Tags:    tags,
+			First:   in.Time(),
+			Windows: make(map[string][]bucket, len(s.Windows)),
+		}
+		s.monitors[key] = m
+	}
+	s.add(m, in.Time(), down)
+}
+
+// isDown returns whether the check of the metric failed. The down field
+// takes precedence as it is only set by inputs confirming failures.
+func (s *SLA) isDown(in telegraf.Metric) (down, found bool) {
+	if s.DownField != "" {
+		if v, ok := in.GetField(s.DownField); ok {
+			if b, ok := v.(bool); ok {
+				return b, true
+			}
+		}
+	}
+	for field, up := range s.up {
+		v, ok := in.GetField(field)
+		if !ok {
+			continue
+		}
+		found = true
+		if !up[fmt.Sprint(v)] {
+			return true, true
+		}
+	}
+	return false, found
+}
+
+// key identifies the monitor by the metric name and the key tags, which are
+// also the tags of the statistics.
+func (s *SLA) key(in telegraf.Metric) (string, map[string]string) {
+	tags := map[string]string{"source": in.Name()}
+	parts := []string{in.Name()}
+	for _, k := range s.KeyTags {
+		v, _ := in.GetTag(k)
+		if v != "" {
+			tags[k] = v
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ","), tags
+}
+
+func (s *SLA) add(m *monitor, t time.Time, down bool) {
+	for _, w := range s.Windows {
+		label := windowLabel(time.Duration(w))
+		m.Windows[label] = count(m.Windows[label], t.Truncate(resolution(time.Duration(w))).Unix(), down)
+	}
+
+	// Late checks are counted but do not change the state
+	if t.Before(m.Last) {
+		return
+	}
+	m.Last = t
+	if m.First.IsZero() || t.Before(m.First) {
+		m.First = t
+	}
+	switch {
+	case down && !m.Down:
+		m.Outages = append(m.Outages, outage{Start: t})
+	case !down && m.Down && len(m.Outages) > 0:
+		m.Outages[len(m.Outages)-1].End = t
+	}
+	m.Down = down
+
+	// Forget what left the windows
+	for _, w := range s.Windows {
+		label := windowLabel(time.Duration(w))
+		cutoff := m.Last.Add(-time.Duration(w) - resolution(time.Duration(w))).Unix()
+		buckets := m.Windows[label]
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Start > cutoff })
+		m.Windows[label] = buckets[i:]
+	}
+	cutoff := m.Last.Add(-s.longest)
+	i := sort.Search(len(m.Outages), func(i int) bool {
+		return m.Outages[i].End.IsZero() || m.Outages[i].End.After(cutoff)
+	})
+	m.Outages = m.Outages[i:]
+}
+
+// count adds the check to the bucket starting at the given time, the buckets
+// are kept in order.
+func count(buckets []bucket, start int64, down bool) []bucket {
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Start >= start })
+	if i == len(buckets) || buckets[i].Start != start {
+		buckets = append(buckets, bucket{})
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = bucket{Start: start}
+	}
+	buckets[i].Checks++
+	if down {
+		buckets[i].Failed++
+	}
+	return buckets
+}
+
+// Push emits the statistics of every monitor and window. The windows end at
+// the last check of the monitor. Monitors without a check within the longest
+// window stopped reporting and are dropped.
+func (s *SLA) Push(acc telegraf.Accumulator) {
+	expired := s.now().Add(-s.longest)
+	for key, m := range s.monitors {
+		if m.Last.Before(expired) {
+			delete(s.monitors, key)
+			continue
+		}
+		for _, w := range s.Windows {
+			label := windowLabel(time.Duration(w))
+			fields := s.statistics(m, label, time.Duration(w))
+			if fields == nil {
+				continue
+			}
+			tags := make(map[string]string, len(m.Tags)+1)
+			for k, v := range m.Tags {
+				tags[k] = v
+			}
+			tags["window"] = label
+			acc.AddFields(measurement, fields, tags, m.Last)
+		}
+	}
+}
+
+func (s *SLA) statistics(m *monitor, label string, window time.Duration) map[string]interface{} {
+	start := m.Last.Add(-window)
+	cutoff := m.Last.Add(-window).Truncate(resolution(window)).Unix()
+
+	var checks, failed int
+	for _, b := range m.Windows[label] {
+		if b.Start >= cutoff {
+			checks += b.Checks
+			failed += b.Failed
+		}
+	}
+	if checks == 0 {
+		return nil
+	}
+
+	errorRatio := float64(failed) / float64(checks)
+	burnRate := errorRatio / (1 - s.SLO/100)
+	fields := map[string]interface{}{
+		"slo":                    s.SLO,
+		"checks":                 checks,
+		"failed_checks":          failed,
+		"availability":           100 * (1 - errorRatio),
+		"burn_rate":              burnRate,
+		"error_budget_remaining": 100 * (1 - burnRate),
+	}
+
+	// Outages overlapping the window, the downtime is clipped to the window
+	var outages, resolved int
+	var downtime, repairs time.Duration
+	for _, o := range m.Outages {
+		end := o.End
+		if end.IsZero() {
+			end = m.Last
+		}
+		if !end.After(start) {
+			continue
+		}
+		outages++
+		downtime += end.Sub(laterOf(o.Start, start))
+		if !o.End.IsZero() {
+			resolved++
+			repairs += o.End.Sub(o.Start)
+		}
+	}
+	fields["outages"] = outages
+	if resolved > 0 {
+		fields["mttr"] = (repairs / time.Duration(resolved)).Seconds()
+	}
+	if outages > 0 {
+		observed := m.Last.Sub(laterOf(m.First, start))
+		fields["mtbf"] = ((observed - downtime) / time.Duration(outages)).Seconds()
+	}
+	return fields
+}
+
+// Reset keeps the statistics, the windows are rolling over the pushes.
+func (*SLA) Reset() {}
+
+func (s *SLA) GetState() interface{} {
+	return s.monitors
+}
+
+func (s *SLA) SetState(state interface{}) error {
+	monitors, ok := state.(monitorStats)
+	if !ok {
+		return errors.New("state has to be of type 'monitorStats'")
+	}
+	if s.monitors == nil {
+		s.monitors = make(monitorStats, len(monitors))
+	}
+	for k, m := range monitors {
+		if m == nil {
+			continue
+		}
+		if m.Windows == nil {
+			m.Windows = make(map[string][]bucket)
+		}
+		s.monitors[k] = m
+	}
+	return nil
+}
+
+// resolution is the time span of the buckets of the window.
+func resolution(window time.Duration) time.Duration {
+	return window / bucketsPerWindow
+}
+
+// windowLabel formats the window for the tag, e.g. "1h", "24h" or "30d".
+func windowLabel(window time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case window > day && window%day == 0:
+		return fmt.Sprintf("%dd", window/day)
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	}
+	return window.String()
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func init() {
+	aggregators.Add("deepmon_sla", func() telegraf.Aggregator {
+		return &SLA{
+			Windows: []config.Duration{
+				config.Duration(time.Hour),
+				config.Duration(24 * time.Hour),
+				config.Duration(30 * 24 * time.Hour),
+			},
+			SLO:       99.9,
+			KeyTags:   []string{"monitor", "domain"},
+			DownField: "confirmed_down",
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package deepmon_sla
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func newSLA() *SLA {
+	return &SLA{
+		Windows:   []config.Duration{config.Duration(time.Hour), config.Duration(24 * time.Hour)},
+		SLO:       99,
+		KeyTags:   []string{"monitor", "domain"},
+		DownField: "confirmed_down",
+		now:       func() time.Time { return start },
+	}
+}
+
+// check returns a result of the monitor at the given minute
+func check(domain string, minute, result int) telegraf.Metric {
+	return metric.New("deepmon_uptime",
+		map[string]string{"domain": domain},
+		map[string]interface{}{"result": result},
+		start.Add(time.Duration(minute)*time.Minute),
+	)
+}
+
+// byWindow pushes the statistics of the domain by window
+func byWindow(t *testing.T, s *SLA, domain string) map[string]map[string]interface{} {
+	var acc testutil.Accumulator
+	s.Push(&acc)
+	out := make(map[string]map[string]interface{})
+	for _, m := range acc.Metrics {
+		require.Equal(t, measurement, m.Measurement)
+		require.Equal(t, "deepmon_uptime", m.Tags["source"])
+		if m.Tags["domain"] == domain {
+			out[m.Tags["window"]] = m.Fields
+		}
+	}
+	return out
+}
+
+func TestStatistics(t *testing.T) {
+	s := newSLA()
+	require.NoError(t, s.Init())
+
+	// An outage from minute 10 to 13 and an ongoing one from minute 110 on
+	for minute := 0; minute < 120; minute++ {
+		result := 0
+		if (minute >= 10 && minute < 13) || minute >= 110 {
+			result = 2
+		}
+		s.Add(check("example.com", minute, result))
+	}
+	s.Add(check("example.org", 0, 0))
+
+	stats := byWindow(t, s, "example.com")
+	require.Len(t, stats, 2)
+
+	// The last hour only holds the ongoing outage
+	hour := stats["1h"]
+	require.Equal(t, 61, hour["checks"])
+	require.Equal(t, 10, hour["failed_checks"])
+	require.InDelta(t, 100*51.0/61.0, hour["availability"], 1e-9)
+	require.InDelta(t, (10.0/61.0)/0.01, hour["burn_rate"], 1e-9)
+	require.Equal(t, 1, hour["outages"])
+	require.NotContains(t, hour, "mttr")
+	// 60 minutes observed, 9 minutes down
+	require.InDelta(t, 51*60.0, hour["mtbf"], 1e-9)
+
+	day := stats["24h"]
+	require.Equal(t, 120, day["checks"])
+	require.Equal(t, 13, day["failed_checks"])
+	require.Equal(t, 2, day["outages"])
+	require.InDelta(t, 180.0, day["mttr"], 1e-9)
+	// 119 minutes observed, 12 minutes down
+	require.InDelta(t, (119-12)*60.0/2, day["mtbf"], 1e-9)
+	require.InDelta(t, 99.0, day["slo"], 0)
+
+	other := byWindow(t, s, "example.org")
+	require.InDelta(t, 100.0, other["1h"]["availability"], 0)
+	require.Equal(t, 0, other["1h"]["outages"])
+	require.NotContains(t, other["1h"], "mtbf")
+}
+
+func TestRollingWindow(t *testing.T) {
+	s := newSLA()
+	s.Windows = []config.Duration{config.Duration(time.Hour)}
+	require.NoError(t, s.Init())
+
+	s.Add(check("example.com", 0, 2))
+	s.Add(check("example.com", 1, 0))
+	require.Equal(t, 1, byWindow(t, s, "example.com")["1h"]["failed_checks"])
+
+	// The checks and the outage left the window
+	s.Add(check("example.com", 120, 0))
+	stats := byWindow(t, s, "example.com")["1h"]
+	require.Equal(t, 1, stats["checks"])
+	require.Equal(t, 0, stats["failed_checks"])
+	require.Equal(t, 0, stats["outages"])
+	require.Len(t, s.monitors["deepmon_uptime,monitor=,domain=example.com"].Outages, 0)
+}
+
+func TestExpiry(t *testing.T) {
+	now := start
+	s := newSLA()
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.Init())
+
+	s.Add(check("example.com", 0, 0))
+	s.Add(check("example.org", 0, 0))
+	now = start.Add(23 * time.Hour)
+	s.Add(check("example.org", 23*60, 0))
+	require.Len(t, byWindow(t, s, "example.com"), 2)
+
+	// A monitor without a check within the longest window is dropped
+	now = start.Add(25 * time.Hour)
+	require.Empty(t, byWindow(t, s, "example.com"))
+	require.Len(t, byWindow(t, s, "example.org"), 2)
+	require.Len(t, s.monitors, 1)
+}
+
+func TestDownFieldPrecedence(t *testing.T) {
+	s := newSLA()
+	require.NoError(t, s.Init())
+
+	m := check("example.com", 0, 2)
+	m.AddField("confirmed_down", false)
+	s.Add(m)
+	require.Equal(t, 0, byWindow(t, s, "example.com")["1h"]["failed_checks"])
+
+	// Metrics without status are ignored
+	s.Add(metric.New("deepmon_uptime", map[string]string{"domain": "example.com"}, map[string]interface{}{"latency": 1.0}, start))
+	require.Equal(t, 1, byWindow(t, s, "example.com")["1h"]["checks"])
+}
+
+func TestUpValues(t *testing.T) {
+	s := newSLA()
+	s.UpValues = map[string][]string{"result": {"0"}, "access": {"1"}}
+	require.NoError(t, s.Init())
+
+	m := check("example.com", 0, 0)
+	m.AddField("access", 0)
+	s.Add(m)
+	require.Equal(t, 1, byWindow(t, s, "example.com")["1h"]["failed_checks"])
+}
+
+func TestState(t *testing.T) {
+	s := newSLA()
+	require.NoError(t, s.Init())
+	for minute := 0; minute < 10; minute++ {
+		s.Add(check("example.com", minute, minute/5*2))
+	}
+
+	serialized, err := json.Marshal(s.GetState())
+	require.NoError(t, err)
+	var state monitorStats
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	// The statistics continue after a restart, windows no longer configured
+	// are dropped
+	restarted := newSLA()
+	restarted.Windows = []config.Duration{config.Duration(24 * time.Hour)}
+	require.NoError(t, restarted.SetState(state))
+	require.NoError(t, restarted.Init())
+	restarted.Add(check("example.com", 10, 0))
+
+	stats := byWindow(t, restarted, "example.com")
+	require.Len(t, stats, 1)
+	require.Equal(t, 11, stats["24h"]["checks"])
+	require.Equal(t, 5, stats["24h"]["failed_checks"])
+	require.InDelta(t, 300.0, stats["24h"]["mttr"], 0)
+
+	require.ErrorContains(t, restarted.SetState(map[string]int{}), "state has to be of type")
+}
+
+func TestInit(t *testing.T) {
+	s := newSLA()
+	s.Windows = nil
+	require.ErrorContains(t, s.Init(), "at least one window")
+
+	s = newSLA()
+	s.Windows = []config.Duration{config.Duration(time.Second)}
+	require.ErrorContains(t, s.Init(), "shorter than")
+
+	s = newSLA()
+	s.Windows = []config.Duration{config.Duration(time.Hour), config.Duration(60 * time.Minute)}
+	require.ErrorContains(t, s.Init(), "duplicate window 1h")
+
+	s = newSLA()
+	s.SLO = 100
+	require.ErrorContains(t, s.Init(), "slo")
+}
+
+func TestWindowLabel(t *testing.T) {
+	require.Equal(t, "1h", windowLabel(time.Hour))
+	require.Equal(t, "24h", windowLabel(24*time.Hour))
+	require.Equal(t, "30d", windowLabel(30*24*time.Hour))
+	require.Equal(t, "90m", windowLabel(90*time.Minute))
+}
@@ -0,0 +1,195 @@
+// Package dualstack lets an input plugin probe a target in a selected address
+// family or in both of them, probing every address independently and judging
+// the reachability of the families.
+package dualstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal/choice"
+)
+
+// Address families selected by the ip_version option
+const (
+	VERSION_Auto = "auto"
+	VERSION_4    = "4"
+	VERSION_6    = "6"
+	VERSION_Both = "both"
+)
+
+var versions = []string{
+	VERSION_Auto,
+	VERSION_4,
+	VERSION_6,
+	VERSION_Both,
+}
+
+// Verdicts on the reachability of the families
+const (
+	// Both families are reachable
+	VERDICT_DualStack = "dual_stack"
+	// Only one family has addresses, which are reachable
+	VERDICT_IPv4Only = "ipv4_only"
+	VERDICT_IPv6Only = "ipv6_only"
+	// An address of the family is unreachable while the other family works
+	VERDICT_IPv4Broken = "ipv4_broken"
+	VERDICT_IPv6Broken = "ipv6_broken"
+	// No family is reachable
+	VERDICT_Down = "down"
+)
+
+// Stack is embedded into the configuration of a plugin to select the address
+// families its target is probed in.
+type Stack struct {
+	IPVersion string `toml:"ip_version"`
+
+	// LookupIPAddr resolves the host, replaced for testing
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error) `toml:"-"`
+}
+
+// InitStack checks the selected family.
+func (s *Stack) InitStack() error {
+	if s.IPVersion == "" {
+		s.IPVersion = VERSION_Auto
+	}
+	if err := choice.Check(s.IPVersion, versions); err != nil {
+		return fmt.Errorf("config option ip_version: %w", err)
+	}
+	if s.LookupIPAddr == nil {
+		s.LookupIPAddr = net.DefaultResolver.LookupIPAddr
+	}
+	return nil
+}
+
+// Both returns whether every address of both families is probed.
+func (s *Stack) Both() bool {
+	return s.IPVersion == VERSION_Both
+}
+
+// Network restricts the network, e.g. "tcp", to the selected family. Both
+// families are allowed unless a single one is selected.
+func (s *Stack) Network(network string) string {
+	switch s.IPVersion {
+	case VERSION_4:
+		return network + "4"
+	case VERSION_6:
+		return network + "6"
+	}
+	return network
+}
+
+// Resolve returns the distinct addresses of the host in the selected family,
+// the IPv4 ones first.
+func (s *Stack) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := s.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if seen[addr.IP.String()] {
+			continue
+		}
+		seen[addr.IP.String()] = true
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+	switch s.IPVersion {
+	case VERSION_4:
+		v6 = nil
+	case VERSION_6:
+		v4 = nil
+	}
+	if len(v4)+len(v6) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	return append(v4, v6...), nil
+}
+
+// Version returns the family of the address, "4" or "6".
+func Version(ip net.IP) string {
+	if ip.To4() != nil {
+		return VERSION_4
+	}
+	return VERSION_6
+}
+
+// Report collects the results of the addresses of a target.
+type Report struct {
+	addresses map[string]int
+	failed    map[string]int
+}
+
+// Add records the result of probing the address.
+func (r *Report) Add(ip net.IP, ok bool) {
+	if r.addresses == nil {
+		r.addresses = make(map[string]int, 2)
+		r.failed = make(map[string]int, 2)
+	}
+	version := Version(ip)
+	r.addresses[version]++
+	if !ok {
+		r.failed[version]++
+	}
+}
+
+// Verdict judges the reachability of the families. A family is broken if any
+// of its addresses is unreachable, as clients pick any of them.
+func (r *Report) Verdict() string {
+	has4, has6 := r.addresses[VERSION_4] > 0, r.addresses[VERSION_6] > 0
+	ok4, ok6 := has4 && r.failed[VERSION_4] == 0, has6 && r.failed[VERSION_6] == 0
+	switch {
+	case ok4 && ok6:
+		return VERDICT_DualStack
+	case ok4 && !has6:
+		return VERDICT_IPv4Only
+	case ok6 && !has4:
+		return VERDICT_IPv6Only
+	case ok4 && has6:
+		return VERDICT_IPv6Broken
+	case ok6 && has4:
+		return VERDICT_IPv4Broken
+	}
+	return VERDICT_Down
+}
+
+// Fields returns the verdict with the number of addresses and failed ones
+// by family.
+func (r *Report) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"verdict":        r.Verdict(),
+		"ipv4_addresses": r.addresses[VERSION_4],
+		"ipv4_failed":    r.failed[VERSION_4],
+		"ipv6_addresses": r.addresses[VERSION_6],
+		"ipv6_failed":    r.failed[VERSION_6],
+	}
+}
+
+// Result maps the verdict to the result of the target. Broken families fail
+// the result partially.
+func (r *Report) Result() monitors.Result {
+	switch r.Verdict() {
+	case VERDICT_Down:
+		return monitors.Failed
+	case VERDICT_IPv4Broken, VERDICT_IPv6Broken:
+		return monitors.PartialFailure
+	}
+	return monitors.Success
+}
+
+// AddTo emits the verdict with its result as the "<measurement>_dualstack"
+// metric of the domain.
+func (r *Report) AddTo(acc telegraf.Accumulator, measurement, domain string) {
+	fields := r.Fields()
+	fields["result"] = int(r.Result())
+	acc.AddFields(measurement+"_dualstack", fields, map[string]string{"domain": domain})
+}
@@ -0,0 +1,135 @@
+package dualstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestInit(t *testing.T) {
+	s := &Stack{}
+	require.NoError(t, s.InitStack())
+	require.Equal(t, VERSION_Auto, s.IPVersion)
+	require.False(t, s.Both())
+	require.Equal(t, "tcp", s.Network("tcp"))
+
+	s = &Stack{IPVersion: "6"}
+	require.NoError(t, s.InitStack())
+	require.Equal(t, "udp6", s.Network("udp"))
+
+	s = &Stack{IPVersion: "5"}
+	require.ErrorContains(t, s.InitStack(), "ip_version")
+}
+
+func TestResolve(t *testing.T) {
+	s := &Stack{
+		IPVersion: VERSION_Both,
+		LookupIPAddr: func(_ context.Context, host string) ([]net.IPAddr, error) {
+			switch host {
+			case "example.com":
+				return []net.IPAddr{
+					{IP: net.ParseIP("::1")},
+					{IP: net.ParseIP("127.0.0.1")},
+					{IP: net.ParseIP("::1")},
+				}, nil
+			case "empty.example.com":
+				return nil, nil
+			}
+			return nil, errors.New("no such host")
+		},
+	}
+	require.NoError(t, s.InitStack())
+
+	ips, err := s.Resolve(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, ips)
+
+	// A single family restricts the addresses
+	s.IPVersion = VERSION_6
+	ips, err = s.Resolve(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("::1")}, ips)
+	s.IPVersion = VERSION_Both
+
+	_, err = s.Resolve(context.Background(), "empty.example.com")
+	require.ErrorContains(t, err, "no address found")
+	_, err = s.Resolve(context.Background(), "unknown.example.com")
+	require.ErrorContains(t, err, "no such host")
+}
+
+func TestVerdict(t *testing.T) {
+	v4, v4b, v6 := net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("::1")
+	tests := []struct {
+		name     string
+		results  map[string]bool
+		expected string
+	}{
+		{"both up", map[string]bool{"v4": true, "v6": true}, VERDICT_DualStack},
+		{"no AAAA", map[string]bool{"v4": true}, VERDICT_IPv4Only},
+		{"no A", map[string]bool{"v6": true}, VERDICT_IPv6Only},
+		{"AAAA broken", map[string]bool{"v4": true, "v6": false}, VERDICT_IPv6Broken},
+		{"A broken", map[string]bool{"v4": false, "v6": true}, VERDICT_IPv4Broken},
+		{"one A broken", map[string]bool{"v4": true, "v4b": false, "v6": true}, VERDICT_IPv4Broken},
+		{"all broken", map[string]bool{"v4": false, "v6": false}, VERDICT_Down},
+		{"nothing", map[string]bool{}, VERDICT_Down},
+	}
+	ips := map[string]net.IP{"v4": v4, "v4b": v4b, "v6": v6}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Report
+			for name, ok := range tt.results {
+				r.Add(ips[name], ok)
+			}
+			require.Equal(t, tt.expected, r.Verdict())
+		})
+	}
+
+	var r Report
+	r.Add(v4, true)
+	r.Add(v4b, false)
+	r.Add(v6, true)
+	require.Equal(t, map[string]interface{}{
+		"verdict":        VERDICT_IPv4Broken,
+		"ipv4_addresses": 2,
+		"ipv4_failed":    1,
+		"ipv6_addresses": 1,
+		"ipv6_failed":    0,
+	}, r.Fields())
+}
+
+func TestAddTo(t *testing.T) {
+	v4, v6 := net.ParseIP("127.0.0.1"), net.ParseIP("::1")
+	tests := []struct {
+		name     string
+		results  map[string]bool
+		expected monitors.Result
+	}{
+		{"both up", map[string]bool{"v4": true, "v6": true}, monitors.Success},
+		{"no AAAA", map[string]bool{"v4": true}, monitors.Success},
+		{"AAAA broken", map[string]bool{"v4": true, "v6": false}, monitors.PartialFailure},
+		{"all broken", map[string]bool{"v4": false, "v6": false}, monitors.Failed},
+	}
+	ips := map[string]net.IP{"v4": v4, "v6": v6}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Report
+			for name, ok := range tt.results {
+				r.Add(ips[name], ok)
+			}
+			var acc testutil.Accumulator
+			r.AddTo(&acc, "deepmon_port", "example.com")
+			require.Len(t, acc.Metrics, 1)
+			m := acc.Metrics[0]
+			require.Equal(t, "deepmon_port_dualstack", m.Measurement)
+			require.Equal(t, map[string]string{"domain": "example.com"}, m.Tags)
+			require.Equal(t, int(tt.expected), m.Fields["result"])
+			require.Equal(t, r.Verdict(), m.Fields["verdict"])
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Package retry lets an input plugin retry transient failures within a gather
+// and only confirm a failure after several consecutive failed gathers.
+package retry
+
+import (
+	"errors"
+	"time"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+const defaultBackoff = 500 * time.Millisecond
+
+// Policy is embedded into the configuration of a plugin to retry its checks.
+type Policy struct {
+	Retries      int             `toml:"retries"`
+	RetryBackoff config.Duration `toml:"retry_backoff"`
+	ConfirmAfter int             `toml:"confirm_after"`
+
+	// consecutive failed gathers by check
+	failures map[string]int
+
+	// replaced for testing
+	sleep func(time.Duration)
+}
+
+// InitRetries checks the settings and resets the tracked failures.
+func (p *Policy) InitRetries() error {
+	if p.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	if p.RetryBackoff < 0 {
+		return errors.New("retry_backoff must not be negative")
+	}
+	if p.ConfirmAfter < 0 {
+		return errors.New("confirm_after must not be negative")
+	}
+	if p.RetryBackoff == 0 {
+		p.RetryBackoff = config.Duration(defaultBackoff)
+	}
+	if p.sleep == nil {
+		p.sleep = time.Sleep
+	}
+	p.failures = make(map[string]int)
+	return nil
+}
+
+// Attempt runs the check until it succeeds or the retries are exhausted and
+// returns the number of attempts. The check returns whether it failed
+// transiently and is worth another attempt. The backoff doubles after every
+// attempt.
+func (p *Policy) Attempt(check func() (retry bool)) int {
+	backoff := time.Duration(p.RetryBackoff)
+	attempts := 1
+	for check() && attempts <= p.Retries {
+		p.sleep(backoff)
+		backoff *= 2
+		attempts++
+	}
+	return attempts
+}
+
+// Confirm tracks the consecutive failed gathers of the check and adds the
+// attempts, the consecutive failures and whether the failure is confirmed to
+// the fields. Without confirm_after every failure is confirmed right away.
+// Checks of the same plugin are told apart by their key. Nothing is added if
+// neither retries nor confirm_after are set.
+func (p *Policy) Confirm(key string, failed bool, attempts int, fields map[string]interface{}) {
+	if p.Retries == 0 && p.ConfirmAfter == 0 {
+		return
+	}
+	if failed {
+		p.failures[key]++
+	} else {
+		delete(p.failures, key)
+	}
+	fields["attempts"] = attempts
+	fields["consecutive_failures"] = p.failures[key]
+	fields["confirmed_down"] = failed && p.failures[key] >= max(p.ConfirmAfter, 1)
+}
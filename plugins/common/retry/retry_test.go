@@ -0,0 +1,114 @@
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+func TestInitRetriesInvalid(t *testing.T) {
+	require.ErrorContains(t, (&Policy{Retries: -1}).InitRetries(), "retries")
+	require.ErrorContains(t, (&Policy{RetryBackoff: config.Duration(-time.Second)}).InitRetries(), "retry_backoff")
+	require.ErrorContains(t, (&Policy{ConfirmAfter: -1}).InitRetries(), "confirm_after")
+}
+
+func TestAttempt(t *testing.T) {
+	var slept []time.Duration
+	p := &Policy{
+		Retries:      3,
+		RetryBackoff: config.Duration(100 * time.Millisecond),
+		sleep:        func(d time.Duration) { slept = append(slept, d) },
+	}
+	require.NoError(t, p.InitRetries())
+
+	// Succeeds on the first attempt
+	require.Equal(t, 1, p.Attempt(func() bool { return false }))
+	require.Empty(t, slept)
+
+	// Succeeds on the third attempt
+	calls := 0
+	require.Equal(t, 3, p.Attempt(func() bool {
+		calls++
+		return calls < 3
+	}))
+	require.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, slept)
+
+	// Retries exhausted
+	slept = nil
+	calls = 0
+	require.Equal(t, 4, p.Attempt(func() bool {
+		calls++
+		return true
+	}))
+	require.Equal(t, 4, calls)
+	require.Len(t, slept, 3)
+}
+
+func TestAttemptWithoutRetries(t *testing.T) {
+	p := &Policy{}
+	require.NoError(t, p.InitRetries())
+
+	calls := 0
+	require.Equal(t, 1, p.Attempt(func() bool {
+		calls++
+		return true
+	}))
+	require.Equal(t, 1, calls)
+}
+
+func TestConfirm(t *testing.T) {
+	p := &Policy{ConfirmAfter: 3}
+	require.NoError(t, p.InitRetries())
+
+	expected := []struct {
+		failed    bool
+		failures  int
+		confirmed bool
+	}{
+		{failed: true, failures: 1},
+		{failed: true, failures: 2},
+		{failed: true, failures: 3, confirmed: true},
+		{failed: true, failures: 4, confirmed: true},
+		{failed: false},
+		{failed: true, failures: 1},
+	}
+	for i, e := range expected {
+		fields := make(map[string]interface{})
+		p.Confirm("a", e.failed, 2, fields)
+		require.Equal(t, map[string]interface{}{
+			"attempts":             2,
+			"consecutive_failures": e.failures,
+			"confirmed_down":       e.confirmed,
+		}, fields, "gather %d", i)
+	}
+
+	// Checks are tracked separately
+	fields := make(map[string]interface{})
+	p.Confirm("b", true, 1, fields)
+	require.Equal(t, 1, fields["consecutive_failures"])
+}
+
+func TestConfirmImmediately(t *testing.T) {
+	p := &Policy{Retries: 1}
+	require.NoError(t, p.InitRetries())
+
+	fields := make(map[string]interface{})
+	p.Confirm("", true, 1, fields)
+	require.Equal(t, true, fields["confirmed_down"])
+
+	p.Confirm("", false, 1, fields)
+	require.Equal(t, false, fields["confirmed_down"])
+	require.Equal(t, 0, fields["consecutive_failures"])
+}
+
+func TestConfirmDisabled(t *testing.T) {
+	p := &Policy{}
+	require.NoError(t, p.InitRetries())
+
+	fields := make(map[string]interface{})
+	p.Confirm("", true, 1, fields)
+	require.Empty(t, fields)
+}
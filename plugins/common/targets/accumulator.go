@@ -0,0 +1,54 @@
+package targets
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// taggedAccumulator adds the tags of the target to every metric.
+type taggedAccumulator struct {
+	telegraf.Accumulator
+	tags map[string]string
+}
+
+func (a *taggedAccumulator) merge(tags map[string]string) map[string]string {
+	if len(a.tags) == 0 {
+		return tags
+	}
+	merged := make(map[string]string, len(tags)+len(a.tags))
+	for k, v := range tags {
+		merged[k] = v
+	}
+	for k, v := range a.tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (a *taggedAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddFields(measurement, fields, a.merge(tags), t...)
+}
+
+func (a *taggedAccumulator) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddGauge(measurement, fields, a.merge(tags), t...)
+}
+
+func (a *taggedAccumulator) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddCounter(measurement, fields, a.merge(tags), t...)
+}
+
+func (a *taggedAccumulator) AddSummary(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddSummary(measurement, fields, a.merge(tags), t...)
+}
+
+func (a *taggedAccumulator) AddHistogram(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddHistogram(measurement, fields, a.merge(tags), t...)
+}
+
+func (a *taggedAccumulator) AddMetric(m telegraf.Metric) {
+	for k, v := range a.tags {
+		m.AddTag(k, v)
+	}
+	a.Accumulator.AddMetric(m)
+}
@@ -0,0 +1,393 @@
+// Package targets lets an input plugin monitor a list of targets, each by its
+// own instance of the plugin, gathered by a bounded pool of workers.
+package targets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+)
+
+const defaultMaxConcurrency = 10
+
+// maxListSize limits the size of target lists read from a file or URL.
+const maxListSize = 32 << 20
+
+// Target is a single monitored endpoint with the tags added to its metrics.
+type Target struct {
+	Address string            `toml:"address" json:"address"`
+	Tags    map[string]string `toml:"tags" json:"tags"`
+}
+
+// Factory creates and initializes the plugin instance monitoring the target.
+type Factory func(target Target) (telegraf.Input, error)
+
+// Batch is embedded into the configuration of a plugin to monitor a list of
+// targets instead of a single one.
+type Batch struct {
+	Targets        []string        `toml:"targets"`
+	Target         []Target        `toml:"target"`
+	TargetsFile    string          `toml:"targets_file"`
+	TargetsURL     string          `toml:"targets_url"`
+	TargetsRefresh config.Duration `toml:"targets_refresh_interval"`
+	MaxConcurrency int             `toml:"max_concurrency"`
+	TargetJitter   config.Duration `toml:"target_jitter"`
+
+	factory Factory
+	client  *http.Client
+	loaded  time.Time
+	members []*member
+	// start of the previous gather, the time in between bounds the jitter
+	last   time.Time
+	warned bool
+
+	// states restored before the members were created
+	states map[string]json.RawMessage
+	// targets which failed to initialize, reported on the next gather
+	invalid []error
+}
+
+// member is the plugin instance of a target.
+type member struct {
+	key    string
+	target Target
+	plugin telegraf.Input
+	// start of the gather within the jitter window
+	offset time.Duration
+}
+
+// HasTargets returns whether any targets are configured.
+func (b *Batch) HasTargets() bool {
+	return len(b.Targets) > 0 || len(b.Target) > 0 || b.TargetsFile != "" || b.TargetsURL != ""
+}
+
+// InitTargets loads the target list and creates a plugin instance for every
+// target. Targets failing to initialize are skipped and reported as errors
+// of the next gather.
+func (b *Batch) InitTargets(factory Factory) error {
+	if b.MaxConcurrency == 0 {
+		b.MaxConcurrency = defaultMaxConcurrency
+	}
+	if b.MaxConcurrency < 0 {
+		return errors.New("max_concurrency must be positive")
+	}
+	if b.TargetJitter < 0 {
+		return errors.New("target_jitter must not be negative")
+	}
+	b.factory = factory
+	b.client = &http.Client{Timeout: 30 * time.Second}
+
+	list, err := b.load()
+	if err != nil {
+		return err
+	}
+	b.update(list)
+	if len(b.members) == 0 && len(b.invalid) > 0 {
+		return fmt.Errorf("no valid targets: %w", errors.Join(b.invalid...))
+	}
+	return nil
+}
+
+// GatherTargets gathers all targets, at most max_concurrency at the same
+// time.
+func (b *Batch) GatherTargets(acc telegraf.Accumulator) error {
+	if b.TargetsRefresh > 0 && (b.TargetsFile != "" || b.TargetsURL != "") && time.Since(b.loaded) >= time.Duration(b.TargetsRefresh) {
+		if list, err := b.load(); err != nil {
+			acc.AddError(fmt.Errorf("refreshing targets: %w", err))
+		} else {
+			b.update(list)
+		}
+	}
+	for _, err := range b.invalid {
+		acc.AddError(err)
+	}
+	b.invalid = nil
+
+	// Members are dispatched in the order of their offsets, so a busy pool
+	// delays but never reorders them
+	scheduled := make([]*member, len(b.members))
+	copy(scheduled, b.members)
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		return scheduled[i].offset < scheduled[j].offset
+	})
+
+	jobs := make(chan *member)
+	var wg sync.WaitGroup
+	for i := 0; i < min(b.MaxConcurrency, len(scheduled)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range jobs {
+				tacc := &taggedAccumulator{Accumulator: acc, tags: m.target.Tags}
+				if err := m.plugin.Gather(tacc); err != nil {
+					acc.AddError(fmt.Errorf("target %q: %w", m.target.Address, err))
+				}
+			}
+		}()
+	}
+	start := time.Now()
+	window := b.window(acc, start)
+	for _, m := range scheduled {
+		offset := m.offset
+		if window < time.Duration(b.TargetJitter) {
+			offset = time.Duration(float64(offset) * float64(window) / float64(b.TargetJitter))
+		}
+		if wait := time.Until(start.Add(offset)); wait > 0 {
+			time.Sleep(wait)
+		}
+		jobs <- m
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
+// window returns the time the gathers of the targets are spread over. The
+// jitter is bounded to half the time since the previous gather, which leaves
+// the last targets time to complete within the interval.
+func (b *Batch) window(acc telegraf.Accumulator, start time.Time) time.Duration {
+	previous := b.last
+	b.last = start
+	window := time.Duration(b.TargetJitter)
+	if previous.IsZero() {
+		return window
+	}
+	if limit := start.Sub(previous) / 2; window > limit {
+		if !b.warned {
+			acc.AddError(fmt.Errorf("target_jitter %s exceeds half the interval, spreading the targets over %s", window, limit))
+			b.warned = true
+		}
+		window = limit
+	}
+	return window
+}
+
+// TargetsState returns the states of the stateful instances by target.
+func (b *Batch) TargetsState() interface{} {
+	states := make(map[string]json.RawMessage, len(b.states)+len(b.members))
+	// Keep the restored states of targets not loaded (yet)
+	for key, state := range b.states {
+		states[key] = state
+	}
+	for _, m := range b.members {
+		plugin, ok := m.plugin.(telegraf.StatefulPlugin)
+		if !ok {
+			continue
+		}
+		serialized, err := json.Marshal(plugin.GetState())
+		if err != nil {
+			continue
+		}
+		states[m.key] = serialized
+	}
+	return states
+}
+
+// SetTargetsState restores the states of the instances, which might not be
+// created yet.
+func (b *Batch) SetTargetsState(state interface{}) error {
+	states, ok := state.(map[string]json.RawMessage)
+	if !ok {
+		return errors.New("state has to be of type 'map[string]json.RawMessage'")
+	}
+	b.states = states
+	for _, m := range b.members {
+		if err := b.restore(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore sets the restored state of the member, unmarshalled into the type
+// of its current state.
+func (b *Batch) restore(m *member) error {
+	plugin, ok := m.plugin.(telegraf.StatefulPlugin)
+	if !ok {
+		return nil
+	}
+	serialized, found := b.states[m.key]
+	if !found {
+		return nil
+	}
+	delete(b.states, m.key)
+
+	nstate := reflect.New(reflect.TypeOf(plugin.GetState())).Interface()
+	if err := json.Unmarshal(serialized, &nstate); err != nil {
+		return fmt.Errorf("unmarshalling state of target %q failed: %w", m.target.Address, err)
+	}
+	return plugin.SetState(reflect.ValueOf(nstate).Elem().Interface())
+}
+
+// update creates the instances of new targets and drops the ones of removed
+// targets, existing instances keep their state.
+func (b *Batch) update(list []Target) {
+	existing := make(map[string]*member, len(b.members))
+	for _, m := range b.members {
+		existing[m.key] = m
+	}
+
+	members := make([]*member, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, target := range list {
+		key := target.key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if m, found := existing[key]; found {
+			members = append(members, m)
+			continue
+		}
+
+		plugin, err := b.factory(target)
+		if err != nil {
+			b.invalid = append(b.invalid, fmt.Errorf("target %q: %w", target.Address, err))
+			continue
+		}
+		m := &member{key: key, target: target, plugin: plugin}
+		if b.TargetJitter > 0 {
+			// Stable offsets keep the time between the checks of a target
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			m.offset = time.Duration(h.Sum64() % uint64(b.TargetJitter))
+		}
+		if err := b.restore(m); err != nil {
+			b.invalid = append(b.invalid, err)
+		}
+		members = append(members, m)
+	}
+	b.members = members
+}
+
+// load reads the configured targets, the ones of the file and the URL.
+func (b *Batch) load() ([]Target, error) {
+	list := make([]Target, 0, len(b.Targets)+len(b.Target))
+	for _, address := range b.Targets {
+		list = append(list, Target{Address: address})
+	}
+	list = append(list, b.Target...)
+
+	if b.TargetsFile != "" {
+		data, err := os.ReadFile(b.TargetsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading targets file: %w", err)
+		}
+		targets, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing targets file: %w", err)
+		}
+		list = append(list, targets...)
+	}
+	if b.TargetsURL != "" {
+		data, err := b.fetch()
+		if err != nil {
+			return nil, fmt.Errorf("fetching targets: %w", err)
+		}
+		targets, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing targets of %q: %w", b.TargetsURL, err)
+		}
+		list = append(list, targets...)
+	}
+	b.loaded = time.Now()
+	return list, nil
+}
+
+func (b *Batch) fetch() ([]byte, error) {
+	resp, err := b.client.Get(b.TargetsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxListSize))
+}
+
+// Parse reads a target list, either a JSON array of addresses or target
+// objects, or one target per line followed by optional tags:
+//
+//	example.com customer=acme,tier=gold
+//
+// Empty lines and lines starting with '#' are skipped.
+func Parse(data []byte) ([]Target, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var raw []json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &raw); err != nil {
+			return nil, err
+		}
+		list := make([]Target, 0, len(raw))
+		for _, entry := range raw {
+			var target Target
+			if err := json.Unmarshal(entry, &target.Address); err != nil {
+				if err := json.Unmarshal(entry, &target); err != nil {
+					return nil, err
+				}
+			}
+			if target.Address == "" {
+				return nil, fmt.Errorf("target without address: %s", entry)
+			}
+			list = append(list, target)
+		}
+		return list, nil
+	}
+
+	var list []Target
+	for i, line := range strings.Split(trimmed, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, fields[2])
+		}
+		target := Target{Address: fields[0]}
+		if len(fields) == 2 {
+			target.Tags = make(map[string]string)
+			for _, pair := range strings.Split(fields[1], ",") {
+				k, v, found := strings.Cut(pair, "=")
+				if !found || k == "" {
+					return nil, fmt.Errorf("line %d: invalid tag %q", i+1, pair)
+				}
+				target.Tags[k] = v
+			}
+		}
+		list = append(list, target)
+	}
+	return list, nil
+}
+
+// key identifies the target, the same address with other tags is another
+// target.
+func (t Target) key() string {
+	if len(t.Tags) == 0 {
+		return t.Address
+	}
+	keys := make([]string, 0, len(t.Tags))
+	for k := range t.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(t.Address)
+	for _, k := range keys {
+		sb.WriteString(" " + k + "=" + t.Tags[k])
+	}
+	return sb.String()
+}
@@ -0,0 +1,268 @@
+package targets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+// counter counts its gathers and keeps the count as state.
+type counter struct {
+	address string
+	gathers int
+
+	running *atomic.Int32
+	peak    *atomic.Int32
+}
+
+func (*counter) SampleConfig() string {
+	return ""
+}
+
+func (c *counter) Gather(acc telegraf.Accumulator) error {
+	if c.running != nil {
+		n := c.running.Add(1)
+		defer c.running.Add(-1)
+		for {
+			peak := c.peak.Load()
+			if n <= peak || c.peak.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.gathers++
+	if c.address == "broken.example.com" {
+		return errors.New("gather failed")
+	}
+	acc.AddFields("counter", map[string]interface{}{"gathers": c.gathers}, map[string]string{"domain": c.address})
+	return nil
+}
+
+func (c *counter) GetState() interface{} {
+	return c.gathers
+}
+
+func (c *counter) SetState(state interface{}) error {
+	c.gathers = state.(int)
+	return nil
+}
+
+func counterFactory(target Target) (telegraf.Input, error) {
+	if target.Address == "invalid" {
+		return nil, errors.New("domain is missing or invalid")
+	}
+	return &counter{address: target.Address}, nil
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse([]byte(`
+# customers
+example.com customer=acme,tier=gold
+
+example.org
+`))
+	require.NoError(t, err)
+	require.Equal(t, []Target{
+		{Address: "example.com", Tags: map[string]string{"customer": "acme", "tier": "gold"}},
+		{Address: "example.org"},
+	}, list)
+
+	list, err = Parse([]byte(`["example.com", {"address": "example.org", "tags": {"customer": "acme"}}]`))
+	require.NoError(t, err)
+	require.Equal(t, []Target{
+		{Address: "example.com"},
+		{Address: "example.org", Tags: map[string]string{"customer": "acme"}},
+	}, list)
+
+	_, err = Parse([]byte("example.com customer"))
+	require.ErrorContains(t, err, `line 1: invalid tag "customer"`)
+	_, err = Parse([]byte(`[{"tags": {"customer": "acme"}}]`))
+	require.ErrorContains(t, err, "target without address")
+}
+
+func TestGatherTargets(t *testing.T) {
+	b := &Batch{
+		Targets: []string{"example.com", "broken.example.com", "invalid", "example.com"},
+		Target:  []Target{{Address: "example.org", Tags: map[string]string{"customer": "acme"}}},
+	}
+	require.NoError(t, b.InitTargets(counterFactory))
+	require.Len(t, b.members, 3)
+
+	var acc testutil.Accumulator
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, acc.Metrics, 2)
+	for _, m := range acc.Metrics {
+		if m.Tags["domain"] == "example.org" {
+			require.Equal(t, "acme", m.Tags["customer"])
+		} else {
+			require.NotContains(t, m.Tags, "customer")
+		}
+	}
+	require.Len(t, acc.Errors, 2)
+	require.ErrorContains(t, errors.Join(acc.Errors...), `target "invalid": domain is missing or invalid`)
+	require.ErrorContains(t, errors.Join(acc.Errors...), `target "broken.example.com": gather failed`)
+
+	// Invalid targets are only reported once
+	acc.ClearMetrics()
+	acc.Errors = nil
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, acc.Errors, 1)
+
+	require.ErrorContains(t, (&Batch{Targets: []string{"invalid"}}).InitTargets(counterFactory), "no valid targets")
+}
+
+func TestConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	b := &Batch{MaxConcurrency: 3}
+	for i := 0; i < 12; i++ {
+		b.Targets = append(b.Targets, "target"+string(rune('a'+i)))
+	}
+	require.NoError(t, b.InitTargets(func(target Target) (telegraf.Input, error) {
+		return &counter{address: target.Address, running: &running, peak: &peak}, nil
+	}))
+
+	var acc testutil.Accumulator
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, acc.Metrics, 12)
+	require.EqualValues(t, 3, peak.Load())
+}
+
+func TestJitter(t *testing.T) {
+	b := &Batch{
+		Targets:      []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"},
+		TargetJitter: config.Duration(100 * time.Millisecond),
+	}
+	require.NoError(t, b.InitTargets(counterFactory))
+	offsets := make(map[string]time.Duration)
+	for _, m := range b.members {
+		require.Less(t, m.offset, 100*time.Millisecond)
+		offsets[m.key] = m.offset
+	}
+
+	var acc testutil.Accumulator
+	start := time.Now()
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, acc.Metrics, 4)
+	var latest time.Duration
+	for _, offset := range offsets {
+		latest = max(latest, offset)
+	}
+	require.GreaterOrEqual(t, time.Since(start), latest)
+
+	// Offsets are stable across restarts
+	restarted := &Batch{Targets: b.Targets, TargetJitter: b.TargetJitter}
+	require.NoError(t, restarted.InitTargets(counterFactory))
+	for _, m := range restarted.members {
+		require.Equal(t, offsets[m.key], m.offset)
+	}
+}
+
+func TestJitterBounded(t *testing.T) {
+	b := &Batch{
+		Targets:      []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"},
+		TargetJitter: config.Duration(time.Hour),
+	}
+	require.NoError(t, b.InitTargets(counterFactory))
+
+	// The jitter is bounded by the time between the gathers
+	b.last = time.Now().Add(-200 * time.Millisecond)
+	var acc testutil.Accumulator
+	start := time.Now()
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Less(t, time.Since(start), 150*time.Millisecond)
+	require.Len(t, acc.Metrics, 4)
+	require.Len(t, acc.Errors, 1)
+	require.ErrorContains(t, acc.Errors[0], "exceeds half the interval")
+
+	// The warning is only given once
+	acc.ClearMetrics()
+	acc.Errors = nil
+	b.last = time.Now().Add(-20 * time.Millisecond)
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Empty(t, acc.Errors)
+}
+
+func TestRefreshFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "targets.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("example.com\nexample.org\n"), 0600))
+
+	b := &Batch{TargetsFile: filename, TargetsRefresh: config.Duration(time.Nanosecond)}
+	require.NoError(t, b.InitTargets(counterFactory))
+	var acc testutil.Accumulator
+	require.NoError(t, b.GatherTargets(&acc))
+	kept := b.members[0].plugin
+
+	require.NoError(t, os.WriteFile(filename, []byte("example.com\nexample.net\n"), 0600))
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, b.members, 2)
+	require.Same(t, kept, b.members[0].plugin)
+	require.Equal(t, 2, kept.(*counter).gathers)
+	require.Equal(t, "example.net", b.members[1].target.Address)
+
+	// A broken list keeps the current targets
+	require.NoError(t, os.Remove(filename))
+	acc.Errors = nil
+	require.NoError(t, b.GatherTargets(&acc))
+	require.Len(t, b.members, 2)
+	require.Len(t, acc.Errors, 1)
+	require.ErrorContains(t, acc.Errors[0], "refreshing targets")
+}
+
+func TestTargetsURL(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`["example.com", "example.org"]`)) //nolint:errcheck // checked by the client
+	}))
+	defer ts.Close()
+
+	b := &Batch{TargetsURL: ts.URL}
+	require.NoError(t, b.InitTargets(counterFactory))
+	require.Len(t, b.members, 2)
+
+	// Without a refresh interval the list is only loaded once
+	var acc testutil.Accumulator
+	require.NoError(t, b.GatherTargets(&acc))
+	require.EqualValues(t, 1, requests.Load())
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	require.ErrorContains(t, (&Batch{TargetsURL: failing.URL}).InitTargets(counterFactory), "status 404")
+}
+
+func TestState(t *testing.T) {
+	b := &Batch{Targets: []string{"example.com", "example.org"}}
+	require.NoError(t, b.InitTargets(counterFactory))
+	var acc testutil.Accumulator
+	require.NoError(t, b.GatherTargets(&acc))
+	require.NoError(t, b.GatherTargets(&acc))
+
+	// Round-trip the state through JSON like the persister does
+	serialized, err := json.Marshal(b.TargetsState())
+	require.NoError(t, err)
+	var state map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	// States are restored before the targets are initialized, the state of
+	// a removed target is kept
+	restarted := &Batch{Targets: []string{"example.com"}}
+	require.NoError(t, restarted.SetTargetsState(state))
+	require.NoError(t, restarted.InitTargets(counterFactory))
+	require.Equal(t, 2, restarted.members[0].plugin.(*counter).gathers)
+	require.Contains(t, restarted.TargetsState(), "example.org")
+
+	require.Error(t, restarted.SetTargetsState(map[string]int{}))
+}
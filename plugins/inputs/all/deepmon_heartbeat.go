@@ -0,0 +1,5 @@
+//go:build !custom || inputs || inputs.deepmon_heartbeat
+
+package all
+
+import _ "github.com/influxdata/telegraf/plugins/inputs/deepmon_heartbeat" // register plugin
@@ -0,0 +1,218 @@
+package deepmon_cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	REVOCATION_Good    string = "good"
+	REVOCATION_Revoked string = "revoked"
+	REVOCATION_Unknown string = "unknown"
+	REVOCATION_Error   string = "error"
+)
+
+// maxRevocationResponseSize limits the size of downloaded OCSP responses
+// and CRLs.
+const maxRevocationResponseSize = 16 << 20
+
+func daysUntil(t, now time.Time) int {
+	return int(t.Sub(now).Hours() / 24)
+}
+
+// inspectChain verifies the presented chain and adds the chain, expiry and
+// revocation details to the fields.
+func (u *Tls) inspectChain(state tls.ConnectionState, fields map[string]interface{}) {
+	now := time.Now()
+	certs := state.PeerCertificates
+	leaf := certs[0]
+
+	// The handshake skips verification so the certificates of broken chains
+	// can still be reported, the chain is verified here instead
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         u.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	fields["chain_verified"] = err == nil
+	fields["chain_error"] = ""
+	if err != nil {
+		fields["chain_error"] = err.Error()
+	}
+
+	fields["hostname_mismatch"] = false
+	if u.hostname != "" {
+		fields["hostname_mismatch"] = leaf.VerifyHostname(u.hostname) != nil
+	}
+	fields["self_signed"] = bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignatureFrom(leaf) == nil
+
+	// Prefer the verified chain as it includes the root
+	chain := certs
+	if len(chains) > 0 {
+		chain = chains[0]
+	}
+	fields["chain_length"] = len(chain)
+	fields["days_until_expiry"] = daysUntil(leaf.NotAfter, now)
+
+	earliest := leaf
+	for _, cert := range chain {
+		if cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	fields["chain_days_until_expiry"] = daysUntil(earliest.NotAfter, now)
+	fields["chain_earliest_expiry_subject"] = earliest.Subject.String()
+
+	for i, cert := range certs[1:] {
+		prefix := "intermediate_" + strconv.Itoa(i+1) + "_"
+		fields[prefix+"subject"] = cert.Subject.String()
+		fields[prefix+"not_after"] = cert.NotAfter.Format(time.RFC3339)
+		fields[prefix+"days_until_expiry"] = daysUntil(cert.NotAfter, now)
+	}
+
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	u.checkRevocation(state, leaf, issuer, fields)
+}
+
+// checkRevocation reports the stapled OCSP response and, if enabled, queries
+// the OCSP responder and the CRL of the leaf certificate.
+func (u *Tls) checkRevocation(state tls.ConnectionState, leaf, issuer *x509.Certificate, fields map[string]interface{}) {
+	revoked := false
+
+	fields["ocsp_stapled"] = len(state.OCSPResponse) > 0
+	if len(state.OCSPResponse) > 0 {
+		status, err := parseOCSP(state.OCSPResponse, leaf, issuer)
+		fields["ocsp_stapled_status"] = status
+		if err != nil {
+			fields["ocsp_stapled_error"] = err.Error()
+		}
+		revoked = revoked || status == REVOCATION_Revoked
+	}
+
+	if u.CheckOCSP {
+		status, err := u.queryOCSP(leaf, issuer)
+		fields["ocsp_status"] = status
+		if err != nil {
+			fields["ocsp_error"] = err.Error()
+		}
+		revoked = revoked || status == REVOCATION_Revoked
+	}
+
+	if u.CheckCRL {
+		status, err := u.queryCRL(leaf, issuer)
+		fields["crl_status"] = status
+		if err != nil {
+			fields["crl_error"] = err.Error()
+		}
+		revoked = revoked || status == REVOCATION_Revoked
+	}
+
+	fields["revoked"] = revoked
+}
+
+func parseOCSP(raw []byte, leaf, issuer *x509.Certificate) (string, error) {
+	if issuer == nil {
+		return REVOCATION_Error, errors.New("issuer certificate not available")
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return REVOCATION_Good, nil
+	case ocsp.Revoked:
+		return REVOCATION_Revoked, nil
+	}
+	return REVOCATION_Unknown, nil
+}
+
+func (u *Tls) queryOCSP(leaf, issuer *x509.Certificate) (string, error) {
+	if issuer == nil {
+		return REVOCATION_Error, errors.New("issuer certificate not available")
+	}
+	responder := u.OCSPResponderURL
+	if responder == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return REVOCATION_Error, errors.New("certificate has no OCSP responder")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	resp, err := u.revocationClient.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return REVOCATION_Error, fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	return parseOCSP(body, leaf, issuer)
+}
+
+func (u *Tls) queryCRL(leaf, issuer *x509.Certificate) (string, error) {
+	if issuer == nil {
+		return REVOCATION_Error, errors.New("issuer certificate not available")
+	}
+	address := u.CRLURL
+	if address == "" {
+		if len(leaf.CRLDistributionPoints) == 0 {
+			return REVOCATION_Error, errors.New("certificate has no CRL distribution point")
+		}
+		address = leaf.CRLDistributionPoints[0]
+	}
+
+	resp, err := u.revocationClient.Get(address)
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return REVOCATION_Error, fmt.Errorf("CRL endpoint returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return REVOCATION_Error, err
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return REVOCATION_Error, fmt.Errorf("invalid CRL signature: %w", err)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return REVOCATION_Error, errors.New("CRL is outdated")
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return REVOCATION_Revoked, nil
+		}
+	}
+	return REVOCATION_Good, nil
+}
@@ -2,20 +2,56 @@
 package deepmon_cert
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/proxy"
+	"github.com/influxdata/telegraf/plugins/common/targets"
+	commontls "github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
 type Tls struct {
-	Domain string `toml:"domain"`
+	Domain  string          `toml:"domain"`
+	Timeout config.Duration `toml:"timeout"`
+
+	// Direct TLS dialing instead of an https request
+	Address  string `toml:"address"`
+	Port     int    `toml:"port"`
+	SNI      string `toml:"server_name"`
+	StartTLS string `toml:"starttls"`
+
+	// Revocation checks
+	CheckOCSP        bool   `toml:"check_ocsp"`
+	OCSPResponderURL string `toml:"ocsp_responder_url"`
+	CheckCRL         bool   `toml:"check_crl"`
+	CRLURL           string `toml:"crl_url"`
+
+	commontls.ClientConfig
+	proxy.HTTPProxy
+	targets.Batch
+
+	url              string
+	hostname         string
+	client           *http.Client
+	revocationClient *http.Client
+	tlsConfig        *tls.Config
+	roots            *x509.CertPool
 }
 
 var pluginName = monitors.MonitorTypes_DEEPMON_TLS.String()
@@ -27,7 +63,116 @@ func (u *Tls) SampleConfig() string {
 	return sampleConfig
 }
 
+func (u *Tls) Init() error {
+	if u.HasTargets() {
+		// The address is dialed instead of the domain, so it cannot be shared
+		if u.Address != "" {
+			return errors.New("address cannot be used with targets")
+		}
+		return u.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *u
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			return &child, child.Init()
+		})
+	}
+	if u.Timeout == 0 {
+		u.Timeout = config.Duration(5 * time.Second)
+	}
+	prox, err := u.HTTPProxy.Proxy()
+	if err != nil {
+		return fmt.Errorf("failed to set proxy: %w", err)
+	}
+	u.revocationClient = &http.Client{
+		Transport: &http.Transport{Proxy: prox},
+		Timeout:   time.Duration(u.Timeout),
+	}
+	if err := u.initTLSConfig(); err != nil {
+		return err
+	}
+	if u.Address != "" {
+		return u.initDial()
+	}
+	if u.Domain == "" {
+		return errors.New("domain is missing")
+	}
+	// A bare domain is checked over https, a full URL is used as-is
+	u.url = u.Domain
+	if !strings.Contains(u.Domain, "://") {
+		u.url = "https://" + u.Domain
+	}
+	parsedURL, err := url.Parse(u.url)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme != "https" {
+		return fmt.Errorf("invalid protocol: %s", parsedURL.Scheme)
+	}
+	u.hostname = parsedURL.Hostname()
+	if u.tlsConfig.ServerName != "" {
+		u.hostname = u.tlsConfig.ServerName
+	}
+
+	u.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:             prox,
+			TLSClientConfig:   u.tlsConfig,
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Duration(u.Timeout),
+		// Only the certificate of the configured endpoint is of interest
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (u *Tls) initDial() error {
+	if err := choice.Check(u.StartTLS, starttlsProtocols); err != nil {
+		return fmt.Errorf("config option starttls: %w", err)
+	}
+	if u.Port == 0 {
+		u.Port = defaultPorts[u.StartTLS]
+	}
+	if u.Port < 1 || u.Port > 65535 {
+		return errors.New("port is invalid")
+	}
+	// SNI is only sent for host names, not for IP addresses
+	if u.SNI == "" && net.ParseIP(u.Address) == nil {
+		u.SNI = u.Address
+	}
+	if u.Domain == "" {
+		u.Domain = u.Address
+	}
+	if u.tlsConfig.ServerName == "" {
+		u.tlsConfig.ServerName = u.SNI
+	}
+	u.hostname = u.tlsConfig.ServerName
+	return nil
+}
+
+// initTLSConfig prepares the handshake configuration. The handshake itself
+// never verifies the peer so certificates of broken chains can be reported,
+// the chain is verified against the system or configured roots afterwards.
+func (u *Tls) initTLSConfig() error {
+	tlsCfg, err := u.ClientConfig.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to set TLS config: %w", err)
+	}
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	u.roots = tlsCfg.RootCAs
+	tlsCfg.InsecureSkipVerify = true //nolint:gosec // the chain is verified in inspectChain
+	u.tlsConfig = tlsCfg
+	return nil
+}
+
 func (u *Tls) Gather(acc telegraf.Accumulator) error {
+	if u.HasTargets() {
+		return u.GatherTargets(acc)
+	}
 	u.sendData(acc)
 	return nil
 }
@@ -39,27 +184,52 @@ func init() {
 }
 
 type TlsStats struct {
-	Latency float64
+	Latency          float64
+	ConnectLatency   float64
+	HandshakeLatency float64
+	RemoteAddr       string
 	tls.ConnectionState
 }
 
 func (u *Tls) gotls() (*TlsStats, error) {
+	if u.Address != "" {
+		return u.dialTLS()
+	}
+
 	us := &TlsStats{}
 	start := time.Now()
 
-	//url kontrolü yaparak başına http veya https ekler
-	correctedUrl, err := u.checkProtocol()
+	// Trace the connect and handshake phases of the request
+	var connectStart, handshakeStart time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(_, _ string) { connectStart = time.Now() },
+		ConnectDone: func(_, addr string, err error) {
+			if err == nil {
+				us.ConnectLatency = float64(time.Since(connectStart)) / float64(time.Millisecond)
+				us.RemoteAddr = addr
+			}
+		},
+		TLSHandshakeStart: func() { handshakeStart = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				us.HandshakeLatency = float64(time.Since(handshakeStart)) / float64(time.Millisecond)
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, u.url, nil)
 	if err != nil {
-		return nil, err
+		return us, err
 	}
-
-	resp, err := http.Get(correctedUrl)
+	resp, err := u.client.Do(req)
 	// Measure TLS handshake time
 	if err != nil {
 		us.Latency = 0
 		return us, err
 	}
 	defer resp.Body.Close()
+	if resp.TLS == nil {
+		return us, fmt.Errorf("no TLS connection to %s", u.url)
+	}
 
 	//return all data
 	elapsed := time.Since(start) //zaman değerini int64 milisaniye olarak değiştirdim
@@ -79,8 +249,20 @@ func (u *Tls) sendData(acc telegraf.Accumulator) {
 		Data:   fields,
 	}
 	stats, err := u.gotls()
+	// Fields that are not part of TlsData are emitted on top of it
+	extra := map[string]interface{}{
+		"connect_latency":   stats.ConnectLatency,
+		"handshake_latency": stats.HandshakeLatency,
+		"remote_addr":       stats.RemoteAddr,
+	}
 	if err != nil {
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
+		extra["error"] = err.Error()
+		addFields(acc, tags, extra)
+		return
+	}
+	if len(stats.PeerCertificates) == 0 {
+		extra["error"] = "no peer certificates"
+		addFields(acc, tags, extra)
 		return
 	}
 	//PeerCertificates beginning
@@ -128,37 +310,16 @@ func (u *Tls) sendData(acc telegraf.Accumulator) {
 	fields.NegotiatedProtocolIsMutual = stats.NegotiatedProtocolIsMutual
 	fields.ServerName = stats.ServerName
 
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
+	u.inspectChain(stats.ConnectionState, extra)
 
+	addFields(acc, tags, extra)
 }
 
-func (u *Tls) checkProtocol() (string, error) {
-	// Define the protocols to check in order
-	protocols := []string{"http", "https"}
-
-	// Iterate over each protocol
-	for _, protocol := range protocols {
-		// Build the full URL
-		fullURL := protocol + "://" + u.Domain
-
-		// Send the request
-		client := &http.Client{
-			Timeout: 5 * time.Second, // Set a timeout to avoid hanging
-		}
-		resp, err := client.Get(fullURL)
-		if err != nil {
-			continue // If there's an error, try the next protocol
-		}
-
-		// Close the response body
-		defer resp.Body.Close()
-
-		// Check the status code
-		if resp.StatusCode == http.StatusOK {
-			return fullURL, nil // Return the URL if accessible
-		}
+// addFields emits the TlsData fields merged with the extra fields.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.TlsData], extra map[string]interface{}) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
 	}
-
-	// If neither HTTPS nor HTTP is accessible, return an error
-	return "", fmt.Errorf("neither HTTPS nor HTTP is accessible for %s", u.Domain)
+	acc.AddFields(pluginName, data, tags.GetTags())
 }
@@ -0,0 +1,330 @@
+package deepmon_cert
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/influxdata/telegraf/testutil"
+)
+
+var pki = testutil.NewPKI("../../../testutil/pki")
+
+// startServer accepts a single connection, runs the plain-text part of the
+// protocol and then serves TLS on it.
+func startServer(t *testing.T, plain func(net.Conn, *bufio.Reader)) int {
+	serverCfg, err := pki.TLSServerConfig().TLSConfig()
+	require.NoError(t, err)
+	serverCfg.ClientAuth = tls.NoClientCert
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if plain != nil {
+			plain(conn, bufio.NewReader(conn))
+		}
+		tlsConn := tls.Server(conn, serverCfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, tlsConn)
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func gather(t *testing.T, plugin *Tls) map[string]interface{} {
+	plugin.TLSCA = pki.CACertPath()
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	return acc.Metrics[0].Fields
+}
+
+func TestDirectTLS(t *testing.T) {
+	port := startServer(t, nil)
+	fields := gather(t, &Tls{Address: "127.0.0.1", Port: port, SNI: "localhost"})
+	require.NotContains(t, fields, "error")
+	require.Equal(t, "CN=localhost", fields["subject"])
+	require.Equal(t, "localhost", fields["server_name"])
+	require.Equal(t, "127.0.0.1:"+strconv.Itoa(port), fields["remote_addr"])
+	require.Positive(t, fields["handshake_latency"])
+}
+
+func TestStartTLS(t *testing.T) {
+	tests := []struct {
+		protocol string
+		plain    func(net.Conn, *bufio.Reader)
+	}{
+		{
+			protocol: STARTTLS_SMTP,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				_, _ = conn.Write([]byte("220 mail ESMTP\r\n"))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte("250-mail\r\n250-SIZE 1000\r\n250 STARTTLS\r\n"))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte("220 Ready to start TLS\r\n"))
+			},
+		},
+		{
+			protocol: STARTTLS_IMAP,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				_, _ = conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte("* CAPABILITY IMAP4rev1\r\na001 OK Begin TLS negotiation now\r\n"))
+			},
+		},
+		{
+			protocol: STARTTLS_POP3,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				_, _ = conn.Write([]byte("+OK POP3 ready\r\n"))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte("+OK Begin TLS negotiation\r\n"))
+			},
+		},
+		{
+			protocol: STARTTLS_FTP,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				_, _ = conn.Write([]byte("220 FTP ready\r\n"))
+				_, _ = r.ReadString('\n')
+				_, _ = conn.Write([]byte("234 AUTH TLS successful\r\n"))
+			},
+		},
+		{
+			protocol: STARTTLS_LDAP,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				request := make([]byte, len(ldapStartTLSRequest))
+				_, _ = io.ReadFull(r, request)
+				_, _ = conn.Write([]byte{0x30, 0x0c, 0x02, 0x01, 0x01, 0x78, 0x07, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00})
+			},
+		},
+		{
+			protocol: STARTTLS_Postgres,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				request := make([]byte, 8)
+				_, _ = io.ReadFull(r, request)
+				_, _ = conn.Write([]byte("S"))
+			},
+		},
+		{
+			protocol: STARTTLS_XMPP,
+			plain: func(conn net.Conn, r *bufio.Reader) {
+				_, _ = r.ReadString('>')
+				_, _ = r.ReadString('>')
+				_, _ = conn.Write([]byte("<stream:stream from='localhost' version='1.0'><stream:features>" +
+					"<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>"))
+				_, _ = r.ReadString('>')
+				_, _ = conn.Write([]byte("<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			port := startServer(t, tt.plain)
+			fields := gather(t, &Tls{Address: "localhost", Port: port, StartTLS: tt.protocol})
+			require.NotContains(t, fields, "error")
+			require.Equal(t, "CN=localhost", fields["subject"])
+		})
+	}
+}
+
+func TestStartTLSRefused(t *testing.T) {
+	port := startServer(t, func(conn net.Conn, r *bufio.Reader) {
+		request := make([]byte, 8)
+		_, _ = io.ReadFull(r, request)
+		_, _ = conn.Write([]byte("N"))
+		conn.Close()
+	})
+	fields := gather(t, &Tls{Address: "localhost", Port: port, StartTLS: STARTTLS_Postgres})
+	require.Equal(t, "postgres server does not support SSL", fields["error"])
+	require.Positive(t, fields["connect_latency"])
+}
+
+func TestInitDial(t *testing.T) {
+	plugin := &Tls{Address: "mail.example.com", StartTLS: STARTTLS_SMTP}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, 25, plugin.Port)
+	require.Equal(t, "mail.example.com", plugin.SNI)
+	require.Equal(t, "mail.example.com", plugin.Domain)
+
+	plugin = &Tls{Address: "10.0.0.1"}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, 443, plugin.Port)
+	require.Empty(t, plugin.SNI)
+
+	plugin = &Tls{Address: "mail.example.com", StartTLS: "smtps"}
+	require.EqualError(t, plugin.Init(), "config option starttls: unknown choice smtps")
+
+	plugin = &Tls{Domain: "http://example.com"}
+	require.True(t, strings.HasPrefix(plugin.Init().Error(), "invalid protocol"))
+}
+
+func loadCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	block, _ := pem.Decode([]byte(pki.ReadCACert()))
+	require.NotNil(t, block)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	raw, err := os.ReadFile("../../../testutil/pki/cakey.pem")
+	require.NoError(t, err)
+	block, _ = pem.Decode(raw)
+	require.NotNil(t, block)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	// Signing CRLs requires a subject key identifier the test CA lacks
+	spki, err := x509.MarshalPKIXPublicKey(ca.PublicKey)
+	require.NoError(t, err)
+	ski := sha1.Sum(spki) //nolint:gosec // only used as an identifier
+	ca.SubjectKeyId = ski[:]
+	return ca, key.(crypto.Signer)
+}
+
+func loadServerCert(t *testing.T) *x509.Certificate {
+	block, _ := pem.Decode([]byte(pki.ReadServerCert()))
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestChainValidation(t *testing.T) {
+	port := startServer(t, nil)
+	fields := gather(t, &Tls{Address: "localhost", Port: port})
+	require.Equal(t, true, fields["chain_verified"])
+	require.Equal(t, false, fields["hostname_mismatch"])
+	require.Equal(t, false, fields["self_signed"])
+	require.Equal(t, 2, fields["chain_length"])
+	require.Equal(t, "CN=localhost", fields["chain_earliest_expiry_subject"])
+	require.Positive(t, fields["days_until_expiry"])
+	require.Equal(t, false, fields["ocsp_stapled"])
+	require.Equal(t, false, fields["revoked"])
+
+	// Without the test CA the chain cannot be verified but is still reported
+	port = startServer(t, nil)
+	plugin := &Tls{Address: "localhost", Port: port, SNI: "example.com"}
+	require.NoError(t, plugin.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	fields = acc.Metrics[0].Fields
+	require.Equal(t, false, fields["chain_verified"])
+	require.NotEmpty(t, fields["chain_error"])
+	require.Equal(t, true, fields["hostname_mismatch"])
+	require.Equal(t, "CN=localhost", fields["subject"])
+}
+
+func TestRevocation(t *testing.T) {
+	ca, key := loadCA(t)
+	leaf := loadServerCert(t)
+
+	var ocspStatus int
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocspStatus,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, key)
+		require.NoError(t, err)
+		_, _ = w.Write(resp)
+	}))
+	defer responder.Close()
+
+	var revokedSerials []*big.Int
+	crlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		entries := make([]x509.RevocationListEntry, 0, len(revokedSerials))
+		for _, serial := range revokedSerials {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: time.Now()})
+		}
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-time.Hour),
+			NextUpdate:                time.Now().Add(time.Hour),
+			RevokedCertificateEntries: entries,
+		}, ca, key)
+		require.NoError(t, err)
+		_, _ = w.Write(crl)
+	}))
+	defer crlServer.Close()
+
+	newPlugin := func() *Tls {
+		return &Tls{
+			Address:          "localhost",
+			Port:             startServer(t, nil),
+			CheckOCSP:        true,
+			OCSPResponderURL: responder.URL,
+			CheckCRL:         true,
+			CRLURL:           crlServer.URL,
+		}
+	}
+
+	ocspStatus = ocsp.Good
+	fields := gather(t, newPlugin())
+	require.Equal(t, REVOCATION_Good, fields["ocsp_status"])
+	require.Equal(t, REVOCATION_Good, fields["crl_status"])
+	require.Equal(t, false, fields["revoked"])
+
+	ocspStatus = ocsp.Revoked
+	revokedSerials = []*big.Int{leaf.SerialNumber}
+	fields = gather(t, newPlugin())
+	require.Equal(t, REVOCATION_Revoked, fields["ocsp_status"])
+	require.Equal(t, REVOCATION_Revoked, fields["crl_status"])
+	require.Equal(t, true, fields["revoked"])
+}
+
+func TestOCSPStapling(t *testing.T) {
+	ca, key := loadCA(t)
+	leaf := loadServerCert(t)
+	staple, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, key)
+	require.NoError(t, err)
+
+	serverCfg, err := pki.TLSServerConfig().TLSConfig()
+	require.NoError(t, err)
+	serverCfg.ClientAuth = tls.NoClientCert
+	serverCfg.Certificates[0].OCSPStaple = staple
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	ts.TLS = serverCfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	fields := gather(t, &Tls{Domain: ts.URL})
+	require.Equal(t, true, fields["chain_verified"])
+	require.Equal(t, true, fields["ocsp_stapled"])
+	require.Equal(t, REVOCATION_Good, fields["ocsp_stapled_status"])
+	require.Positive(t, fields["handshake_latency"])
+}
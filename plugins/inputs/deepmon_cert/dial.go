@@ -0,0 +1,42 @@
+package deepmon_cert
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+)
+
+// dialTLS connects to address:port directly, negotiates STARTTLS if
+// configured and runs the TLS handshake with the configured SNI.
+func (u *Tls) dialTLS() (*TlsStats, error) {
+	us := &TlsStats{}
+	timeout := time.Duration(u.Timeout)
+	deadline := time.Now().Add(timeout)
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Address, strconv.Itoa(u.Port)), timeout)
+	if err != nil {
+		return us, err
+	}
+	defer conn.Close()
+	us.ConnectLatency = float64(time.Since(start)) / float64(time.Millisecond)
+	us.RemoteAddr = conn.RemoteAddr().String()
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return us, err
+	}
+	if err := startTLS(conn, u.StartTLS, u.SNI); err != nil {
+		return us, err
+	}
+
+	handshakeStart := time.Now()
+	tlsConn := tls.Client(conn, u.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return us, err
+	}
+	us.HandshakeLatency = float64(time.Since(handshakeStart)) / float64(time.Millisecond)
+	us.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	us.ConnectionState = tlsConn.ConnectionState()
+	return us, nil
+}
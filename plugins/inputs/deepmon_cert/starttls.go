@@ -0,0 +1,281 @@
+package deepmon_cert
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	STARTTLS_None     string = ""
+	STARTTLS_SMTP     string = "smtp"
+	STARTTLS_IMAP     string = "imap"
+	STARTTLS_POP3     string = "pop3"
+	STARTTLS_FTP      string = "ftp"
+	STARTTLS_LDAP     string = "ldap"
+	STARTTLS_Postgres string = "postgres"
+	STARTTLS_XMPP     string = "xmpp"
+)
+
+var starttlsProtocols = []string{
+	STARTTLS_None,
+	STARTTLS_SMTP,
+	STARTTLS_IMAP,
+	STARTTLS_POP3,
+	STARTTLS_FTP,
+	STARTTLS_LDAP,
+	STARTTLS_Postgres,
+	STARTTLS_XMPP,
+}
+
+// defaultPorts are the plain-text ports the STARTTLS protocols listen on.
+var defaultPorts = map[string]int{
+	STARTTLS_None:     443,
+	STARTTLS_SMTP:     25,
+	STARTTLS_IMAP:     143,
+	STARTTLS_POP3:     110,
+	STARTTLS_FTP:      21,
+	STARTTLS_LDAP:     389,
+	STARTTLS_Postgres: 5432,
+	STARTTLS_XMPP:     5222,
+}
+
+// startTLS upgrades a plain-text connection so the TLS handshake can start
+// right after it returns. The connection must have a deadline set.
+func startTLS(conn net.Conn, protocol, serverName string) error {
+	switch protocol {
+	case STARTTLS_None:
+		return nil
+	case STARTTLS_SMTP:
+		return startTLSSMTP(conn)
+	case STARTTLS_IMAP:
+		return startTLSIMAP(conn)
+	case STARTTLS_POP3:
+		return startTLSPOP3(conn)
+	case STARTTLS_FTP:
+		return startTLSFTP(conn)
+	case STARTTLS_LDAP:
+		return startTLSLDAP(conn)
+	case STARTTLS_Postgres:
+		return startTLSPostgres(conn)
+	case STARTTLS_XMPP:
+		return startTLSXMPP(conn, serverName)
+	}
+	return fmt.Errorf("unknown starttls protocol %q", protocol)
+}
+
+func startTLSSMTP(conn net.Conn) error {
+	tp := textproto.NewConn(conn)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp greeting: %w", err)
+	}
+	if err := tp.PrintfLine("EHLO telegraf"); err != nil {
+		return err
+	}
+	_, msg, err := tp.ReadResponse(250)
+	if err != nil {
+		return fmt.Errorf("smtp EHLO: %w", err)
+	}
+	if !strings.Contains(strings.ToUpper(msg), "STARTTLS") {
+		return errors.New("smtp server does not offer STARTTLS")
+	}
+	if err := tp.PrintfLine("STARTTLS"); err != nil {
+		return err
+	}
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp STARTTLS: %w", err)
+	}
+	return nil
+}
+
+func startTLSIMAP(conn net.Conn) error {
+	tp := textproto.NewConn(conn)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return fmt.Errorf("imap greeting: %w", err)
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("imap greeting: %s", line)
+	}
+	if err := tp.PrintfLine("a001 STARTTLS"); err != nil {
+		return err
+	}
+	// Skip untagged responses until the tagged one
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return fmt.Errorf("imap STARTTLS: %w", err)
+		}
+		if !strings.HasPrefix(line, "a001 ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "a001 OK") {
+			return fmt.Errorf("imap STARTTLS: %s", line)
+		}
+		return nil
+	}
+}
+
+func startTLSPOP3(conn net.Conn) error {
+	tp := textproto.NewConn(conn)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return fmt.Errorf("pop3 greeting: %w", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("pop3 greeting: %s", line)
+	}
+	if err := tp.PrintfLine("STLS"); err != nil {
+		return err
+	}
+	line, err = tp.ReadLine()
+	if err != nil {
+		return fmt.Errorf("pop3 STLS: %w", err)
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("pop3 STLS: %s", line)
+	}
+	return nil
+}
+
+func startTLSFTP(conn net.Conn) error {
+	tp := textproto.NewConn(conn)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("ftp greeting: %w", err)
+	}
+	if err := tp.PrintfLine("AUTH TLS"); err != nil {
+		return err
+	}
+	if _, _, err := tp.ReadResponse(234); err != nil {
+		return fmt.Errorf("ftp AUTH TLS: %w", err)
+	}
+	return nil
+}
+
+// ldapStartTLSRequest is the BER encoded LDAPMessage with message ID 1 and an
+// ExtendedRequest for the StartTLS OID 1.3.6.1.4.1.1466.20037.
+var ldapStartTLSRequest = append([]byte{
+	0x30, 0x1d, // LDAPMessage SEQUENCE
+	0x02, 0x01, 0x01, // messageID 1
+	0x77, 0x18, // [APPLICATION 23] ExtendedRequest
+	0x80, 0x16, // [0] requestName
+}, []byte("1.3.6.1.4.1.1466.20037")...)
+
+func startTLSLDAP(conn net.Conn) error {
+	if _, err := conn.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+	msg, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("ldap StartTLS response: %w", err)
+	}
+	// Skip the messageID and look for the result code of the ExtendedResponse
+	// ([APPLICATION 24]), which is its first element (ENUMERATED)
+	idx := bytes.Index(msg, []byte{0x0a, 0x01})
+	if len(msg) < 2 || idx < 0 || idx+2 >= len(msg) || !bytes.Contains(msg[:idx], []byte{0x78}) {
+		return errors.New("ldap StartTLS: malformed response")
+	}
+	if code := msg[idx+2]; code != 0 {
+		return fmt.Errorf("ldap StartTLS: result code %d", code)
+	}
+	return nil
+}
+
+// readBER reads a single BER encoded element and returns its content.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, errors.New("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > 1<<16 {
+		return nil, errors.New("BER element too large")
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// postgresSSLRequest is the SSLRequest message, a length of 8 followed by the
+// magic code 80877103.
+var postgresSSLRequest = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103)
+
+func startTLSPostgres(conn net.Conn) error {
+	if _, err := conn.Write(postgresSSLRequest); err != nil {
+		return err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return fmt.Errorf("postgres SSLRequest: %w", err)
+	}
+	if answer[0] != 'S' {
+		return errors.New("postgres server does not support SSL")
+	}
+	return nil
+}
+
+func startTLSXMPP(conn net.Conn, serverName string) error {
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", serverName)
+	if _, err := conn.Write([]byte(header)); err != nil {
+		return err
+	}
+	features, err := readUntil(conn, "</stream:features>")
+	if err != nil {
+		return fmt.Errorf("xmpp stream features: %w", err)
+	}
+	if !strings.Contains(features, "urn:ietf:params:xml:ns:xmpp-tls") {
+		return errors.New("xmpp server does not offer STARTTLS")
+	}
+	if _, err := conn.Write([]byte("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")); err != nil {
+		return err
+	}
+	answer, err := readUntil(conn, ">")
+	if err != nil {
+		return fmt.Errorf("xmpp STARTTLS: %w", err)
+	}
+	if !strings.Contains(answer, "<proceed") {
+		return fmt.Errorf("xmpp STARTTLS: %s", answer)
+	}
+	return nil
+}
+
+// readUntil reads byte by byte so nothing belonging to the TLS handshake is
+// consumed after the marker.
+func readUntil(conn net.Conn, marker string) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for len(buf) < 1<<16 {
+		if _, err := conn.Read(b); err != nil {
+			return string(buf), err
+		}
+		buf = append(buf, b[0])
+		if bytes.HasSuffix(buf, []byte(marker)) {
+			return string(buf), nil
+		}
+	}
+	return string(buf), errors.New("response too large")
+}
@@ -0,0 +1,123 @@
+package deepmon_dns
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+)
+
+const (
+	CONSISTENCY_Agree     string = "agree"
+	CONSISTENCY_Partial   string = "partial"
+	CONSISTENCY_Divergent string = "divergent"
+	CONSISTENCY_Unknown   string = "unknown"
+)
+
+// consistencyReport compares the answer sets of the resolvers against the
+// most common one.
+type consistencyReport struct {
+	verdict   string
+	answered  int
+	agreeing  int
+	consensus map[string]bool
+	sets      []map[string]bool
+}
+
+// answerSet returns the records as "TYPE DATA" without the TTLs, which
+// differ between caching resolvers anyway.
+func answerSet(fields *monitors.DNSData) map[string]bool {
+	set := make(map[string]bool, len(fields.Records))
+	for _, record := range fields.Records {
+		set[record.RType+" "+record.RData] = true
+	}
+	return set
+}
+
+func setKey(set map[string]bool) string {
+	records := make([]string, 0, len(set))
+	for record := range set {
+		records = append(records, record)
+	}
+	sort.Strings(records)
+	return strings.Join(records, "\n")
+}
+
+// checkConsistency compares the answers of the resolvers which answered all
+// queries. The verdict is "agree" if all of them returned the same records,
+// "partial" if a majority did and "divergent" otherwise.
+func checkConsistency(results []*monitors.DNSData) *consistencyReport {
+	report := &consistencyReport{
+		verdict: CONSISTENCY_Unknown,
+		sets:    make([]map[string]bool, len(results)),
+	}
+
+	counts := make(map[string]int)
+	for i, fields := range results {
+		// Incomplete answers cannot be compared
+		if fields.Result != monitors.Success {
+			continue
+		}
+		report.sets[i] = answerSet(fields)
+		counts[setKey(report.sets[i])]++
+		report.answered++
+	}
+	if report.answered == 0 {
+		return report
+	}
+
+	// The most common set is the consensus, ties are broken by the order of
+	// the resolvers to keep the verdict stable
+	for _, set := range report.sets {
+		if set == nil {
+			continue
+		}
+		if key := setKey(set); counts[key] > report.agreeing {
+			report.agreeing = counts[key]
+			report.consensus = set
+		}
+	}
+
+	switch {
+	case report.agreeing == report.answered:
+		report.verdict = CONSISTENCY_Agree
+	case report.agreeing*2 > report.answered:
+		report.verdict = CONSISTENCY_Partial
+	default:
+		report.verdict = CONSISTENCY_Divergent
+	}
+	return report
+}
+
+// fields returns the consistency fields of the i-th resolver. The differing
+// records are prefixed with "+" if only the resolver returned them and with
+// "-" if the resolver lacks them.
+func (c *consistencyReport) fields(i int) map[string]interface{} {
+	extra := map[string]interface{}{
+		"consistency":        c.verdict,
+		"resolvers_answered": c.answered,
+		"resolvers_agreeing": c.agreeing,
+		"consistent":         false,
+		"differing_records":  "",
+	}
+	set := c.sets[i]
+	if set == nil {
+		return extra
+	}
+
+	var differing []string
+	for record := range set {
+		if !c.consensus[record] {
+			differing = append(differing, "+"+record)
+		}
+	}
+	for record := range c.consensus {
+		if !set[record] {
+			differing = append(differing, "-"+record)
+		}
+	}
+	sort.Strings(differing)
+	extra["consistent"] = len(differing) == 0
+	extra["differing_records"] = strings.Join(differing, ", ")
+	return extra
+}
@@ -6,15 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 	"github.com/ResulCelik0/go-tld"
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/retry"
+	"github.com/influxdata/telegraf/plugins/common/targets"
+	commontls "github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
@@ -27,12 +33,30 @@ var pluginName = monitors.MonitorTypes_DEEPMON_DNS.String()
 
 type DeepmonDNS struct {
 	Domain           string          `toml:"domain"`
-	ResolverIP       string          `toml:"resolver_ip"` //TODO: Burada birden fazla resolver olabilsin
+	ResolverIP       string          `toml:"resolver_ip"`
+	Resolvers        []string        `toml:"resolvers"`
 	ResolverPort     int             `toml:"resolver_port"`
 	ResolverProtocol string          `toml:"resolver_protocol"`
+	DoHMethod        string          `toml:"doh_method"`
 	Timeout          config.Duration `toml:"timeout"`
-	tlsConfig        *tls.Config
-	client           *dns.Client
+	DNSSECValidation bool            `toml:"dnssec_validation"`
+	TrustAnchors     []string        `toml:"trust_anchors"`
+	Expect           []Expectation   `toml:"expect"`
+	TrackChanges     bool            `toml:"track_changes"`
+	SweepNameservers bool            `toml:"sweep_nameservers"`
+	commontls.ClientConfig
+	targets.Batch
+	retry.Policy
+
+	tlsConfig    *tls.Config
+	resolvers    []*resolver
+	trustAnchors []*dns.DS
+
+	// last seen records per resolver, persisted across restarts
+	lastRecords map[string][]string
+
+	// port of the authoritative servers, only changed for testing
+	nameserverPort int
 }
 
 var recordTypes []uint16 = []uint16{
@@ -54,61 +78,255 @@ func (d *DeepmonDNS) SampleConfig() string {
 }
 
 func (d *DeepmonDNS) Init() error {
+	if d.HasTargets() {
+		return d.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *d
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			return &child, child.Init()
+		})
+	}
 	if _, err := idna.Lookup.ToASCII(d.Domain); err != nil || d.Domain == "" {
 		return errors.New("domain is missing or invalid")
 	}
 
-	if net.ParseIP(d.ResolverIP) == nil {
+	if d.ResolverIP != "" && net.ParseIP(d.ResolverIP) == nil {
+		return errors.New("resolver_ip is missing or invalid")
+	}
+	entries := d.Resolvers
+	if d.ResolverIP != "" {
+		entries = append([]string{d.ResolverIP}, entries...)
+	}
+	if len(entries) == 0 {
 		return errors.New("resolver_ip is missing or invalid")
 	}
 
+	if choice.Check(d.ResolverProtocol, protocols) != nil {
+		d.ResolverProtocol = PROTOCOL_UDP
+	}
+	if d.ResolverPort == 0 {
+		d.ResolverPort = defaultPorts[d.ResolverProtocol]
+	}
 	if d.ResolverPort > 65535 || d.ResolverPort < 1 {
 		return errors.New("resolver_port is missing or invalid")
 	}
-	if d.ResolverProtocol != "udp" && d.ResolverProtocol != "tcp" && d.ResolverProtocol != "tcp-tls" {
-		d.ResolverProtocol = "udp"
+	if d.DoHMethod == "" {
+		d.DoHMethod = http.MethodPost
 	}
-
-	if d.ResolverProtocol == "tcp-tls" {
-		d.tlsConfig = &tls.Config{
-			ServerName: d.ResolverIP,
-		}
+	if d.DoHMethod != http.MethodGet && d.DoHMethod != http.MethodPost {
+		return fmt.Errorf("doh_method %q is invalid", d.DoHMethod)
 	}
 	if d.Timeout == 0 {
 		d.Timeout = config.Duration(2 * time.Second)
 	}
-	d.client = &dns.Client{
-		Timeout:   time.Duration(d.Timeout),
-		Net:       d.ResolverProtocol,
-		TLSConfig: d.tlsConfig,
+	if err := d.InitRetries(); err != nil {
+		return err
+	}
+
+	tlsCfg, err := d.ClientConfig.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to set TLS config: %w", err)
+	}
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{}
+	}
+	d.tlsConfig = tlsCfg
+
+	if len(d.TrustAnchors) == 0 {
+		d.TrustAnchors = defaultTrustAnchors
+	}
+	if d.trustAnchors, err = parseTrustAnchors(d.TrustAnchors); err != nil {
+		return err
+	}
+	if err := d.initExpectations(); err != nil {
+		return err
+	}
+	if d.lastRecords == nil {
+		d.lastRecords = make(map[string][]string)
+	}
+
+	d.resolvers = d.resolvers[:0]
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		r, err := d.newResolver(entry)
+		if err != nil {
+			return err
+		}
+		if seen[r.address] {
+			continue
+		}
+		seen[r.address] = true
+		d.resolvers = append(d.resolvers, r)
 	}
 	return nil
 }
-func (d *DeepmonDNS) senMessage(domain string, recordType uint16) (r *dns.Msg, rtt time.Duration, err error) {
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(domain), recordType)
-	msg.SetEdns0(2048, true)
-	return d.client.Exchange(msg, net.JoinHostPort(d.ResolverIP, strconv.Itoa(d.ResolverPort)))
-}
 
 func (d *DeepmonDNS) Gather(acc telegraf.Accumulator) error {
-	fields := &monitors.DNSData{}
-	tags := monitors.MonitorData[*monitors.DNSData]{
-		Domain: d.Domain,
-		Data:   fields,
+	if d.HasTargets() {
+		return d.GatherTargets(acc)
+	}
+	// Query all resolvers concurrently so their answers are comparable
+	results := make([]*monitors.DNSData, len(d.resolvers))
+	extras := make([]map[string]interface{}, len(d.resolvers))
+	attempts := make([]int, len(d.resolvers))
+	var wg sync.WaitGroup
+	for i, r := range d.resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.close()
+			// Lost packets fail single queries, so partial failures are
+			// retried as well
+			var fields *monitors.DNSData
+			attempts[i] = d.Attempt(func() bool {
+				r.close()
+				fields = &monitors.DNSData{}
+				d.getQuery(r, fields)
+				switch fields.Result {
+				case monitors.Timeout, monitors.ConnectionFailed, monitors.PartialFailure:
+					return true
+				}
+				return false
+			})
+			results[i] = fields
+			extras[i] = make(map[string]interface{})
+			if d.DNSSECValidation {
+				for k, v := range d.validateChain(r, d.Domain, dns.TypeA) {
+					extras[i][k] = v
+				}
+			}
+			if len(d.Expect) > 0 {
+				failed := d.checkExpectations(fields)
+				extras[i]["assertions_passed"] = len(failed) == 0
+				extras[i]["failed_assertions"] = strings.Join(failed, ",")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if d.TrackChanges {
+		d.trackChanges(acc, results, extras)
+	}
+	if d.SweepNameservers {
+		d.sweepNameservers(acc, d.resolvers[0])
+	}
+
+	// With several resolvers every metric carries the consistency verdict
+	// and is tagged with its resolver to keep the series apart
+	var report *consistencyReport
+	if len(results) > 1 {
+		report = checkConsistency(results)
+	}
+	for i, fields := range results {
+		// Mismatching answers only fail the result once the complete
+		// answers were compared and tracked
+		if passed, found := extras[i]["assertions_passed"]; found && !passed.(bool) {
+			fields.Result = monitors.Failed
+		}
+		d.Confirm(d.resolvers[i].address, fields.Result != monitors.Success, attempts[i], extras[i])
+		tags := monitors.MonitorData[*monitors.DNSData]{
+			Domain: d.Domain,
+			Data:   fields,
+		}
+		if report == nil {
+			addFields(acc, tags, extras[i], nil)
+			continue
+		}
+		extra := report.fields(i)
+		for k, v := range extras[i] {
+			extra[k] = v
+		}
+		addFields(acc, tags, extra, map[string]string{"resolver": d.resolvers[i].address})
+	}
+	return nil
+}
+
+func (d *DeepmonDNS) GetState() interface{} {
+	if d.HasTargets() {
+		return d.TargetsState()
+	}
+	return d.lastRecords
+}
+
+func (d *DeepmonDNS) SetState(state interface{}) error {
+	if d.HasTargets() {
+		return d.SetTargetsState(state)
+	}
+	records, ok := state.(map[string][]string)
+	if !ok {
+		return errors.New("state has to be of type 'map[string][]string'")
+	}
+	// States are restored before the plugin is initialized
+	if d.lastRecords == nil {
+		d.lastRecords = make(map[string][]string, len(records))
+	}
+	for k, v := range records {
+		d.lastRecords[k] = v
 	}
-	d.getQuery(fields)
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
 	return nil
 }
 
-func (d *DeepmonDNS) getQuery(fields *monitors.DNSData) {
+// trackChanges compares the complete answers with the last seen ones and
+// emits a change event listing the added and removed records.
+func (d *DeepmonDNS) trackChanges(acc telegraf.Accumulator, results []*monitors.DNSData, extras []map[string]interface{}) {
+	for i, fields := range results {
+		// Incomplete answers would report records as removed
+		if fields.Result != monitors.Success {
+			continue
+		}
+		address := d.resolvers[i].address
+		records := strings.Split(setKey(answerSet(fields)), "\n")
+		if len(fields.Records) == 0 {
+			records = nil
+		}
+		previous, seen := d.lastRecords[address]
+		d.lastRecords[address] = records
+		if !seen {
+			extras[i]["records_changed"] = false
+			continue
+		}
+
+		added, removed := diffRecords(previous, records)
+		changed := len(added) > 0 || len(removed) > 0
+		extras[i]["records_changed"] = changed
+		if !changed {
+			continue
+		}
+		acc.AddFields(pluginName+"_change",
+			map[string]interface{}{
+				"added":         strings.Join(added, ", "),
+				"removed":       strings.Join(removed, ", "),
+				"added_count":   len(added),
+				"removed_count": len(removed),
+			},
+			map[string]string{
+				"domain":   d.Domain,
+				"resolver": address,
+			},
+		)
+	}
+}
+
+// addFields emits the DNSData merged with the extra fields and tags.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.DNSData], extra map[string]interface{}, extraTags map[string]string) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	for k, v := range extraTags {
+		t[k] = v
+	}
+	acc.AddFields(pluginName, data, t)
+}
+
+func (d *DeepmonDNS) getQuery(r *resolver, fields *monitors.DNSData) {
 	var suc, fail bool
 	var totalRtt float64
 	// DNSKEYs
 	dnsKeys := make([]*dns.DNSKEY, 0)
 	keyRRSIG := new(dns.RRSIG)
-	keyRec, _, err := d.senMessage(d.Domain, dns.TypeDNSKEY)
+	keyRec, _, err := r.senMessage(d.Domain, dns.TypeDNSKEY)
 	if err != nil {
 		fields.Result = monitors.ConnectionFailed
 		return
@@ -137,9 +355,10 @@ func (d *DeepmonDNS) getQuery(fields *monitors.DNSData) {
 
 	// RR
 	for _, recordType := range recordTypes {
-		rec, rtt, err := d.senMessage(d.Domain, recordType)
+		rec, rtt, err := r.senMessage(d.Domain, recordType)
 		if err != nil {
-			if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
 				fields.Result = monitors.Timeout
 			} else {
 				fields.Result = monitors.ConnectionFailed
@@ -150,7 +369,7 @@ func (d *DeepmonDNS) getQuery(fields *monitors.DNSData) {
 		suc = true
 		totalRtt += (float64(rtt.Milliseconds()))
 		if len(rec.Answer) > 0 {
-			if ksk, record := d.recordParser(rec, rtt, dnsKeys); record != nil {
+			if ksk, record := d.recordParser(r, rec, rtt, dnsKeys); record != nil {
 				fields.KSKVerified = ksk
 				fields.Records = append(fields.Records, record...)
 			}
@@ -161,11 +380,14 @@ func (d *DeepmonDNS) getQuery(fields *monitors.DNSData) {
 	} else if suc {
 		fields.Result = monitors.Success
 	}
-	fields.ResolverIP = d.ResolverIP
-	fields.ResolverPort = strconv.Itoa(d.ResolverPort)
+	fields.ResolverIP = r.ip
+	fields.ResolverPort = strconv.Itoa(r.port)
 	fields.ResolverProtocol = d.ResolverProtocol
 	fields.ResponseTime = strconv.FormatFloat(totalRtt, 'f', 0, 64)
-	fields.ResolverName = getResolverName(d.ResolverIP)
+	fields.ResolverName = r.name
+	if r.name == "" {
+		fields.ResolverName = getResolverName(r.ip)
+	}
 	return
 
 }
@@ -178,7 +400,7 @@ func getResolverName(resolverIP string) string {
 	return names[0]
 }
 
-func (d *DeepmonDNS) verifyRRWithRRSIG(resp *dns.Msg, dnsKey []*dns.DNSKEY) bool {
+func (d *DeepmonDNS) verifyRRWithRRSIG(r *resolver, resp *dns.Msg, dnsKey []*dns.DNSKEY) bool {
 	if len(dnsKey) == 0 {
 		return false
 	}
@@ -201,14 +423,14 @@ func (d *DeepmonDNS) verifyRRWithRRSIG(resp *dns.Msg, dnsKey []*dns.DNSKEY) bool
 		if err != nil {
 			return false
 		}
-		r, _, err := d.senMessage(tl.Domain, dns.TypeDNSKEY)
+		keys, _, err := r.senMessage(tl.Domain, dns.TypeDNSKEY)
 		if err != nil {
 			return false
 		}
-		for _, ans := range r.Answer {
+		for _, ans := range keys.Answer {
 			switch ans.Header().Rrtype {
 			case dns.TypeDNSKEY:
-				if err := rrsig.Verify(ans.(*dns.DNSKEY), r.Answer); err == nil {
+				if err := rrsig.Verify(ans.(*dns.DNSKEY), keys.Answer); err == nil {
 					flag = true
 					break
 				}
@@ -265,8 +487,8 @@ func verifyKSKKeys(dnsKeys []*dns.DNSKEY, ds *dns.DS) (KSKVerified bool) {
 	return
 }
 
-func (d *DeepmonDNS) recordParser(resp *dns.Msg, rtt time.Duration, dnsKeys []*dns.DNSKEY) (KSKVerifed bool, result []monitors.DNSRecord) {
-	verify := d.verifyRRWithRRSIG(resp, dnsKeys)
+func (d *DeepmonDNS) recordParser(r *resolver, resp *dns.Msg, rtt time.Duration, dnsKeys []*dns.DNSKEY) (KSKVerifed bool, result []monitors.DNSRecord) {
+	verify := d.verifyRRWithRRSIG(r, resp, dnsKeys)
 	for _, ans := range resp.Answer {
 		var record = &monitors.DNSRecord{
 			RCode:          dns.RcodeToString[resp.Rcode],
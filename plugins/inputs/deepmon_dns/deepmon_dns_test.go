@@ -1,15 +1,676 @@
 package deepmon_dns
 
 import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/require"
 )
 
+// zone answers queries with the given records of the "example.com." zone.
+func zone(t *testing.T, records ...string) func(*dns.Msg) *dns.Msg {
+	rrs := make(map[uint16][]dns.RR)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		rrs[rr.Header().Rrtype] = append(rrs[rr.Header().Rrtype], rr)
+	}
+	return func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = rrs[req.Question[0].Qtype]
+		return resp
+	}
+}
+
+// startResolver serves the records on a local UDP port and returns its
+// address.
+func startResolver(t *testing.T, records ...string) string {
+	return startServer(t, zone(t, records...))
+}
+
+// startServer answers queries with the handler on a local UDP port and
+// returns its address.
+func startServer(t *testing.T, answer func(*dns.Msg) *dns.Msg) string {
+	return startServerAt(t, "127.0.0.1:0", answer)
+}
+
+func startServerAt(t *testing.T, address string, answer func(*dns.Msg) *dns.Msg) string {
+	conn, err := net.ListenPacket("udp", address)
+	require.NoError(t, err)
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			// Queries without answer are dropped
+			if resp := answer(req); resp != nil {
+				_ = w.WriteMsg(resp)
+			}
+		}),
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+var pki = testutil.NewPKI("../../../testutil/pki")
+
+func serverTLSConfig(t *testing.T) *tls.Config {
+	cfg, err := pki.TLSServerConfig().TLSConfig()
+	require.NoError(t, err)
+	cfg.ClientAuth = tls.NoClientCert
+	return cfg
+}
+
+// startDoH serves the records over DNS-over-HTTPS and counts the requests
+// per method.
+func startDoH(t *testing.T, records ...string) (*httptest.Server, map[string]*int32) {
+	answer := zone(t, records...)
+	counts := map[string]*int32{http.MethodGet: new(int32), http.MethodPost: new(int32)}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var packed []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			packed, err = io.ReadAll(r.Body)
+		}
+		if err != nil || r.URL.Path != defaultDoHPath {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(counts[r.Method], 1)
+
+		req := new(dns.Msg)
+		if err := req.Unpack(packed); err != nil || req.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := answer(req).Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(resp)
+	}))
+	ts.TLS = serverTLSConfig(t)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, counts
+}
+
+// startDoQ serves the records over DNS-over-QUIC.
+func startDoQ(t *testing.T, records ...string) string {
+	answer := zone(t, records...)
+	cfg := serverTLSConfig(t)
+	cfg.NextProtos = []string{"doq"}
+	listener, err := quic.ListenAddr("127.0.0.1:0", cfg, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					var length uint16
+					if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+						return
+					}
+					packed := make([]byte, length)
+					if _, err := io.ReadFull(stream, packed); err != nil {
+						return
+					}
+					req := new(dns.Msg)
+					if err := req.Unpack(packed); err != nil || req.Id != 0 {
+						return
+					}
+					resp, err := answer(req).Pack()
+					if err != nil {
+						return
+					}
+					_, _ = stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+					_, _ = stream.Write(resp)
+					_ = stream.Close()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDoH(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			ts, counts := startDoH(t, "example.com. 300 IN A 93.184.215.14")
+
+			var acc testutil.Accumulator
+			c := DeepmonDNS{
+				ResolverProtocol: PROTOCOL_HTTPS,
+				Resolvers:        []string{ts.URL + defaultDoHPath},
+				DoHMethod:        method,
+				Domain:           "example.com",
+				Timeout:          config.Duration(time.Second),
+			}
+			c.TLSCA = pki.CACertPath()
+			require.NoError(t, c.Init())
+			require.NoError(t, c.Gather(&acc))
+			require.Len(t, acc.Metrics, 1)
+
+			fields := acc.Metrics[0].Fields
+			require.Equal(t, monitors.Success, fields["result"])
+			require.Equal(t, "127.0.0.1", fields["resolver_ip"])
+			require.Equal(t, PROTOCOL_HTTPS, fields["resolver_protocol"])
+			records := fields["records"].([]monitors.DNSRecord)
+			require.Len(t, records, 1)
+			require.Equal(t, "93.184.215.14", records[0].RData)
+			require.Positive(t, atomic.LoadInt32(counts[method]))
+		})
+	}
+}
+
+func TestDoHUntrusted(t *testing.T) {
+	ts, _ := startDoH(t, "example.com. 300 IN A 93.184.215.14")
+
+	var acc testutil.Accumulator
+	c := DeepmonDNS{
+		ResolverProtocol: PROTOCOL_HTTPS,
+		Resolvers:        []string{ts.URL + defaultDoHPath},
+		Domain:           "example.com",
+		Timeout:          config.Duration(time.Second),
+	}
+	require.NoError(t, c.Init())
+	require.NoError(t, c.Gather(&acc))
+	require.Equal(t, monitors.ConnectionFailed, acc.Metrics[0].Fields["result"])
+}
+
+func TestDoQ(t *testing.T) {
+	address := startDoQ(t, "example.com. 300 IN A 93.184.215.14", "example.com. 300 IN AAAA 2606:2800:21f:cb07:6820:80da:af6b:8b2c")
+
+	var acc testutil.Accumulator
+	c := DeepmonDNS{
+		ResolverProtocol: PROTOCOL_QUIC,
+		Resolvers:        []string{address},
+		Domain:           "example.com",
+		Timeout:          config.Duration(time.Second),
+	}
+	c.TLSCA = pki.CACertPath()
+	require.NoError(t, c.Init())
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+
+	fields := acc.Metrics[0].Fields
+	require.Equal(t, monitors.Success, fields["result"])
+	require.Equal(t, PROTOCOL_QUIC, fields["resolver_protocol"])
+	require.Len(t, fields["records"], 2)
+	require.Nil(t, c.resolvers[0].quic)
+}
+
+func TestDoHResolverDefaults(t *testing.T) {
+	c := DeepmonDNS{
+		ResolverProtocol: PROTOCOL_HTTPS,
+		ResolverIP:       "1.1.1.1",
+		Resolvers:        []string{"https://dns.google/dns-query"},
+		Domain:           "example.com",
+	}
+	require.NoError(t, c.Init())
+	require.Equal(t, 443, c.ResolverPort)
+	require.Equal(t, http.MethodPost, c.DoHMethod)
+	require.Equal(t, "https://1.1.1.1:443/dns-query", c.resolvers[0].url)
+	require.Equal(t, "dns.google", c.resolvers[1].name)
+
+	c = DeepmonDNS{
+		ResolverProtocol: PROTOCOL_HTTPS,
+		ResolverIP:       "1.1.1.1",
+		DoHMethod:        http.MethodPut,
+		Domain:           "example.com",
+	}
+	require.EqualError(t, c.Init(), `doh_method "PUT" is invalid`)
+}
+
+// testZone is a DNSSEC signed zone using a single key.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the records followed by their signature expiring at the
+// given time.
+func (z *testZone) sign(t *testing.T, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		TypeCovered: hdr.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		Labels:      uint8(dns.CountLabel(hdr.Name)),
+		OrigTtl:     hdr.Ttl,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.name,
+	}
+	require.NoError(t, sig.Sign(z.priv, rrs))
+	return append(rrs, sig)
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+func rr(t *testing.T, record string) dns.RR {
+	r, err := dns.NewRR(record)
+	require.NoError(t, err)
+	return r
+}
+
+// startSignedResolver serves a signed hierarchy below the "test." anchor and
+// returns the resolver address and the trust anchor.
+func startSignedResolver(t *testing.T) (string, string) {
+	valid := time.Now().Add(30 * 24 * time.Hour)
+	root := newTestZone(t, "test.")
+	secure := newTestZone(t, "secure.test.")
+	expired := newTestZone(t, "expired.test.")
+	wrongKey := newTestZone(t, "wrongkey.test.")
+	other := newTestZone(t, "wrongkey.test.")
+
+	type response struct {
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+	}
+	responses := map[string]response{
+		"test. DNSKEY": {answer: root.sign(t, valid, root.key)},
+
+		"secure.test. DS":     {answer: root.sign(t, valid, secure.ds())},
+		"secure.test. DNSKEY": {answer: secure.sign(t, valid, secure.key)},
+		"www.secure.test. DS": {ns: secure.sign(t, valid,
+			rr(t, "www.secure.test. 3600 IN NSEC secure.test. A RRSIG NSEC"))},
+		"www.secure.test. A": {answer: secure.sign(t, time.Now().Add(50*time.Hour),
+			rr(t, "www.secure.test. 300 IN A 192.0.2.1"))},
+		"missing.secure.test. DS": {rcode: dns.RcodeNameError, ns: secure.sign(t, valid,
+			rr(t, "secure.test. 3600 IN NSEC www.secure.test. NS SOA RRSIG NSEC DNSKEY"))},
+
+		"insecure.test. DS": {ns: root.sign(t, valid,
+			rr(t, "insecure.test. 3600 IN NSEC secure.test. NS RRSIG NSEC"))},
+
+		"expired.test. DS":     {answer: root.sign(t, valid, expired.ds())},
+		"expired.test. DNSKEY": {answer: expired.sign(t, time.Now().Add(-time.Hour), expired.key)},
+
+		"wrongkey.test. DS":     {answer: root.sign(t, valid, other.ds())},
+		"wrongkey.test. DNSKEY": {answer: wrongKey.sign(t, valid, wrongKey.key)},
+	}
+
+	address := startServer(t, func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		found, ok := responses[q.Name+" "+dns.TypeToString[q.Qtype]]
+		if !ok {
+			resp.Rcode = dns.RcodeServerFailure
+			return resp
+		}
+		resp.Rcode = found.rcode
+		resp.Answer = found.answer
+		resp.Ns = found.ns
+		return resp
+	})
+	return address, root.ds().String()
+}
+
+func TestDNSSECChain(t *testing.T) {
+	address, anchor := startSignedResolver(t)
+	c := DeepmonDNS{
+		Resolvers:    []string{address},
+		Domain:       "www.secure.test",
+		TrustAnchors: []string{anchor},
+		Timeout:      config.Duration(time.Second),
+	}
+	require.NoError(t, c.Init())
+
+	tests := []struct {
+		name   string
+		status string
+		link   string
+	}{
+		{name: "www.secure.test", status: DNSSEC_Secure},
+		{name: "missing.secure.test", status: DNSSEC_Secure},
+		{name: "www.insecure.test", status: DNSSEC_Insecure, link: "DS insecure.test.: unsigned delegation"},
+		{name: "www.expired.test", status: DNSSEC_Bogus, link: "DNSKEY expired.test.: RRSIG of key"},
+		{name: "www.wrongkey.test", status: DNSSEC_Bogus, link: "DNSKEY wrongkey.test.: no DNSKEY matches the DS records"},
+		{name: "www.unknown.test", status: DNSSEC_Indeterminate, link: "DS unknown.test.: resolver answered SERVFAIL"},
+		{name: "example.com", status: DNSSEC_Indeterminate, link: "no trust anchor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := c.validateChain(c.resolvers[0], tt.name, dns.TypeA)
+			require.Equal(t, tt.status, fields["dnssec_status"], fields["dnssec_failing_link"])
+			require.Contains(t, fields["dnssec_failing_link"], tt.link)
+		})
+	}
+
+	// The earliest signature expiry of the chain is reported
+	fields := c.validateChain(c.resolvers[0], "www.secure.test", dns.TypeA)
+	require.Equal(t, 49, fields["rrsig_expires_in_hours"])
+}
+
+func TestDNSSECValidationGather(t *testing.T) {
+	address, anchor := startSignedResolver(t)
+	c := DeepmonDNS{
+		Resolvers:        []string{address},
+		Domain:           "www.secure.test",
+		TrustAnchors:     []string{anchor},
+		DNSSECValidation: true,
+		Timeout:          config.Duration(time.Second),
+	}
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	require.Equal(t, DNSSEC_Secure, acc.Metrics[0].Fields["dnssec_status"])
+	require.Equal(t, "", acc.Metrics[0].Fields["dnssec_failing_link"])
+}
+
+func TestDenialProofs(t *testing.T) {
+	nsec := rr(t, "a.example. 3600 IN NSEC d.example. A RRSIG NSEC").(*dns.NSEC)
+	require.True(t, nsecCovers(nsec, "b.example."))
+	require.True(t, nsecCovers(nsec, "x.b.example."))
+	require.False(t, nsecCovers(nsec, "e.example."))
+	require.False(t, nsecCovers(nsec, "a.example."))
+
+	last := rr(t, "z.example. 3600 IN NSEC example. A RRSIG NSEC").(*dns.NSEC)
+	require.True(t, nsecCovers(last, "zz.example."))
+	require.False(t, nsecCovers(last, "b.example."))
+
+	require.Negative(t, canonicalCompare("example.", "*.example."))
+	require.Negative(t, canonicalCompare("*.example.", "a.example."))
+	require.Negative(t, canonicalCompare("z.example.", "a.z.example."))
+	require.Equal(t, "example.", commonAncestor("b.example.", "a.example."))
+
+	_, err := parseTrustAnchors([]string{"example. IN A 192.0.2.1"})
+	require.ErrorContains(t, err, "is not a DS record")
+}
+
+func TestExpectations(t *testing.T) {
+	address := startResolver(t,
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN A 192.0.2.2",
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"example.com. 300 IN MX 20 backup.example.com.",
+		`example.com. 300 IN TXT "v=spf1 include:_spf.example.com -all"`,
+	)
+
+	tests := []struct {
+		name   string
+		expect []Expectation
+		failed string
+	}{
+		{
+			name: "passing",
+			expect: []Expectation{
+				{Type: "a", Values: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, Match: MATCH_Subset},
+				{Type: "MX", Values: []string{"20 Backup.example.com", "10 mail.example.com."}},
+				{Type: "TXT", Values: []string{"v=spf1"}, Match: MATCH_Contains},
+				{Type: "AAAA"},
+			},
+		},
+		{
+			name: "failing",
+			expect: []Expectation{
+				{Type: "A", Values: []string{"192.0.2.1"}, Match: MATCH_Subset},
+				{Type: "MX", Values: []string{"10 mail.example.com"}},
+				{Type: "TXT", Values: []string{"v=DMARC1"}, Match: MATCH_Contains},
+				{Type: "A", Values: []string{"192.0.2.1", "192.0.2.2"}},
+			},
+			failed: "A[0],MX[1],TXT[2]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DeepmonDNS{
+				Resolvers: []string{address},
+				Domain:    "example.com",
+				Expect:    tt.expect,
+				Timeout:   config.Duration(time.Second),
+			}
+			require.NoError(t, c.Init())
+			var acc testutil.Accumulator
+			require.NoError(t, c.Gather(&acc))
+			require.Len(t, acc.Metrics, 1)
+			fields := acc.Metrics[0].Fields
+			require.Equal(t, tt.failed, fields["failed_assertions"])
+			require.Equal(t, tt.failed == "", fields["assertions_passed"])
+			if tt.failed != "" {
+				require.Equal(t, monitors.Failed, fields["result"])
+			} else {
+				require.Equal(t, monitors.Success, fields["result"])
+			}
+		})
+	}
+
+	c := DeepmonDNS{ResolverIP: "8.8.8.8", Domain: "example.com", Expect: []Expectation{{Type: "CAA"}}}
+	require.ErrorContains(t, c.Init(), `record type "CAA" is not queried`)
+	c = DeepmonDNS{ResolverIP: "8.8.8.8", Domain: "example.com", Expect: []Expectation{{Type: "A", Match: MATCH_Subset}}}
+	require.ErrorContains(t, c.Init(), "needs values")
+}
+
+func TestTrackChanges(t *testing.T) {
+	var current atomic.Pointer[func(*dns.Msg) *dns.Msg]
+	setRecords := func(records ...string) {
+		answer := zone(t, records...)
+		current.Store(&answer)
+	}
+	setRecords("example.com. 300 IN A 192.0.2.1", "example.com. 300 IN MX 10 mail.example.com.")
+	address := startServer(t, func(req *dns.Msg) *dns.Msg {
+		return (*current.Load())(req)
+	})
+
+	c := DeepmonDNS{
+		Resolvers:    []string{address},
+		Domain:       "example.com",
+		TrackChanges: true,
+		Timeout:      config.Duration(time.Second),
+	}
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	require.Equal(t, false, acc.Metrics[0].Fields["records_changed"])
+
+	// Only the TTL differs, which is no change
+	setRecords("example.com. 60 IN A 192.0.2.1", "example.com. 300 IN MX 10 mail.example.com.")
+	acc.ClearMetrics()
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	require.Equal(t, false, acc.Metrics[0].Fields["records_changed"])
+
+	// Persist the state and continue in a restarted instance
+	serialized, err := json.Marshal(c.GetState())
+	require.NoError(t, err)
+	var state map[string][]string
+	require.NoError(t, json.Unmarshal(serialized, &state))
+	restarted := DeepmonDNS{
+		Resolvers:    []string{address},
+		Domain:       "example.com",
+		TrackChanges: true,
+		Timeout:      config.Duration(time.Second),
+	}
+	require.NoError(t, restarted.Init())
+	require.NoError(t, restarted.SetState(state))
+
+	setRecords("example.com. 300 IN A 203.0.113.7", "example.com. 300 IN MX 10 mail.example.com.")
+	acc.ClearMetrics()
+	require.NoError(t, restarted.Gather(&acc))
+	require.Len(t, acc.Metrics, 2)
+	change := acc.Metrics[0]
+	require.Equal(t, pluginName+"_change", change.Measurement)
+	require.Equal(t, map[string]string{"domain": "example.com", "resolver": address}, change.Tags)
+	require.Equal(t, "A 203.0.113.7", change.Fields["added"])
+	require.Equal(t, "A 192.0.2.1", change.Fields["removed"])
+	require.Equal(t, 1, change.Fields["added_count"])
+	require.Equal(t, true, acc.Metrics[1].Fields["records_changed"])
+}
+
+func TestSweepNameservers(t *testing.T) {
+	soa := func(serial int) string {
+		return fmt.Sprintf("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. %d 7200 3600 1209600 3600", serial)
+	}
+	authoritative := func(serial int) func(*dns.Msg) *dns.Msg {
+		answer := zone(t, soa(serial))
+		return func(req *dns.Msg) *dns.Msg {
+			resp := answer(req)
+			resp.Authoritative = true
+			return resp
+		}
+	}
+
+	// The primary and a lagging secondary, the third server refuses the zone
+	primary := startServerAt(t, "127.0.0.1:0", authoritative(2024010102))
+	_, port, err := net.SplitHostPort(primary)
+	require.NoError(t, err)
+	startServerAt(t, "127.0.0.2:"+port, authoritative(2024010101))
+	startServerAt(t, "127.0.0.3:"+port, func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	})
+
+	// The resolver serves the zone's NS records and their addresses
+	nsAddresses := map[string]string{
+		"ns1.example.com.": "127.0.0.1",
+		"ns2.example.com.": "127.0.0.2",
+		"ns3.example.com.": "127.0.0.3",
+	}
+	apex := zone(t, soa(2024010102),
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 3600 IN NS ns2.example.com.",
+		"example.com. 3600 IN NS ns3.example.com.",
+		"example.com. 3600 IN NS ns4.example.com.",
+	)
+	resolver := startServer(t, func(req *dns.Msg) *dns.Msg {
+		q := req.Question[0]
+		if q.Name == "example.com." {
+			return apex(req)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if address, found := nsAddresses[q.Name]; found && q.Qtype == dns.TypeA {
+			resp.Answer = []dns.RR{rr(t, q.Name+" 300 IN A "+address)}
+		}
+		if q.Name == "www.example.com." && q.Qtype == dns.TypeSOA {
+			resp.Ns = []dns.RR{rr(t, soa(2024010102))}
+		}
+		return resp
+	})
+
+	c := DeepmonDNS{
+		Resolvers:        []string{resolver},
+		Domain:           "www.example.com",
+		SweepNameservers: true,
+		Timeout:          config.Duration(time.Second),
+		nameserverPort:   mustAtoi(t, port),
+	}
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	servers := make(map[string]map[string]interface{})
+	var summary map[string]interface{}
+	for _, m := range acc.Metrics {
+		switch m.Measurement {
+		case pluginName + "_nameserver":
+			require.Equal(t, "example.com.", m.Tags["zone"])
+			servers[m.Tags["nameserver"]] = m.Fields
+		case pluginName + "_zone":
+			summary = m.Fields
+		}
+	}
+	require.Len(t, servers, 4)
+
+	require.Equal(t, true, servers["ns1.example.com."]["authoritative"])
+	require.Equal(t, int64(2024010102), servers["ns1.example.com."]["soa_serial"])
+	require.Equal(t, false, servers["ns1.example.com."]["serial_drift"])
+	require.Equal(t, true, servers["ns2.example.com."]["serial_drift"])
+	require.Equal(t, false, servers["ns2.example.com."]["lame"])
+	require.Equal(t, true, servers["ns3.example.com."]["reachable"])
+	require.Equal(t, true, servers["ns3.example.com."]["lame"])
+	require.Equal(t, "REFUSED", servers["ns3.example.com."]["rcode"])
+	require.Equal(t, true, servers["ns1.example.com."]["resolved"])
+	require.Equal(t, false, servers["ns4.example.com."]["resolved"])
+	require.Equal(t, false, servers["ns4.example.com."]["reachable"])
+	require.Equal(t, false, servers["ns4.example.com."]["lame"])
+	require.Equal(t, "nameserver has no address", servers["ns4.example.com."]["error"])
+
+	require.Equal(t, 4, summary["nameservers"])
+	require.Equal(t, 3, summary["nameservers_reachable"])
+	require.Equal(t, 1, summary["lame_delegations"])
+	require.Equal(t, 1, summary["nameservers_unresolved"])
+	require.Equal(t, false, summary["serial_consistent"])
+	require.Equal(t, "2024010101,2024010102", summary["serials"])
+	require.Equal(t, int64(2024010102), summary["max_serial"])
+
+	require.True(t, serialNewer(1, 4294967295))
+	require.False(t, serialNewer(4294967295, 1))
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	n, err := strconv.Atoi(s)
+	require.NoError(t, err)
+	return n
+}
+
 func TestDoT(t *testing.T) {
 	// Init plugin
 	var acc testutil.Accumulator
@@ -110,6 +771,112 @@ func TestGatherInvalidResolverProtocol(t *testing.T) {
 	require.NoError(t, c.Init())
 }
 
+func TestMultipleResolvers(t *testing.T) {
+	good := "example.com. 300 IN A 93.184.215.14"
+	agreeing1 := startResolver(t, good, "example.com. 300 IN MX 10 mail.example.com.")
+	agreeing2 := startResolver(t, good, "example.com. 60 IN MX 10 mail.example.com.")
+	hijacked := startResolver(t, "example.com. 300 IN A 10.0.0.1", "example.com. 300 IN MX 10 mail.example.com.")
+
+	var acc testutil.Accumulator
+	c := DeepmonDNS{
+		ResolverProtocol: "udp",
+		Resolvers:        []string{agreeing1, agreeing2, hijacked, agreeing1},
+		Domain:           "example.com",
+		Timeout:          config.Duration(time.Second),
+	}
+	require.NoError(t, c.Init())
+	require.Len(t, c.resolvers, 3)
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 3)
+
+	byResolver := make(map[string]map[string]interface{})
+	for _, m := range acc.Metrics {
+		require.Equal(t, "example.com", m.Tags["domain"])
+		byResolver[m.Tags["resolver"]] = m.Fields
+	}
+	for _, address := range []string{agreeing1, agreeing2, hijacked} {
+		fields := byResolver[address]
+		require.NotNil(t, fields, address)
+		require.Equal(t, monitors.Success, fields["result"])
+		require.Equal(t, CONSISTENCY_Partial, fields["consistency"])
+		require.Equal(t, 3, fields["resolvers_answered"])
+		require.Equal(t, 2, fields["resolvers_agreeing"])
+	}
+	require.Equal(t, true, byResolver[agreeing1]["consistent"])
+	require.Equal(t, "", byResolver[agreeing2]["differing_records"])
+	require.Equal(t, false, byResolver[hijacked]["consistent"])
+	require.Equal(t, "+A 10.0.0.1, -A 93.184.215.14", byResolver[hijacked]["differing_records"])
+}
+
+func TestRetries(t *testing.T) {
+	answer := zone(t, "example.com. 300 IN A 93.184.215.14")
+	var dropped atomic.Int32
+	address := startServer(t, func(req *dns.Msg) *dns.Msg {
+		// Lose the first query of every gather
+		if req.Question[0].Qtype == dns.TypeDNSKEY && dropped.Add(1)%2 == 1 {
+			return nil
+		}
+		return answer(req)
+	})
+
+	c := DeepmonDNS{
+		ResolverProtocol: "udp",
+		Resolvers:        []string{address},
+		Domain:           "example.com",
+		Timeout:          config.Duration(100 * time.Millisecond),
+	}
+	c.Retries = 1
+	c.RetryBackoff = config.Duration(time.Millisecond)
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	fields := acc.Metrics[0].Fields
+	require.Equal(t, monitors.Success, fields["result"])
+	require.Equal(t, 2, fields["attempts"])
+	require.Equal(t, 0, fields["consecutive_failures"])
+	require.Equal(t, false, fields["confirmed_down"])
+}
+
+func TestResolverConsistencyVerdicts(t *testing.T) {
+	answer := func(result monitors.Result, data ...string) *monitors.DNSData {
+		fields := &monitors.DNSData{Result: result}
+		for _, d := range data {
+			fields.Records = append(fields.Records, monitors.DNSRecord{RType: "A", RData: d})
+		}
+		return fields
+	}
+
+	report := checkConsistency([]*monitors.DNSData{answer(monitors.Success, "1.1.1.1", "2.2.2.2"), answer(monitors.Success, "2.2.2.2", "1.1.1.1")})
+	require.Equal(t, CONSISTENCY_Agree, report.verdict)
+
+	report = checkConsistency([]*monitors.DNSData{answer(monitors.Success, "1.1.1.1"), answer(monitors.Success, "2.2.2.2")})
+	require.Equal(t, CONSISTENCY_Divergent, report.verdict)
+	require.Equal(t, "+A 2.2.2.2, -A 1.1.1.1", report.fields(1)["differing_records"])
+
+	report = checkConsistency([]*monitors.DNSData{answer(monitors.ConnectionFailed), answer(monitors.PartialFailure, "1.1.1.1")})
+	require.Equal(t, CONSISTENCY_Unknown, report.verdict)
+	require.Equal(t, false, report.fields(0)["consistent"])
+}
+
+func TestGatherInvalidResolvers(t *testing.T) {
+	c := DeepmonDNS{
+		Resolvers: []string{"8.8.8.8", "dns.google:53"},
+		Domain:    "example.com",
+	}
+	require.EqualError(t, c.Init(), `resolver "dns.google:53" is invalid`)
+
+	c = DeepmonDNS{
+		Resolvers: []string{"8.8.8.8:0"},
+		Domain:    "example.com",
+	}
+	require.EqualError(t, c.Init(), `port of resolver "8.8.8.8:0" is invalid`)
+
+	c = DeepmonDNS{Domain: "example.com"}
+	require.EqualError(t, c.Init(), "resolver_ip is missing or invalid")
+}
+
 func getMockDataExampleComDNSSECTrue(acc *testutil.Accumulator, result monitors.Result, res_name, res_ip, res_port, res_protocol string) (data monitors.MonitorData[*monitors.DNSData]) {
 	data = monitors.MonitorData[*monitors.DNSData]{
 		Domain: "example.com",
@@ -0,0 +1,507 @@
+package deepmon_dns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSSEC_Secure        string = "secure"
+	DNSSEC_Insecure      string = "insecure"
+	DNSSEC_Bogus         string = "bogus"
+	DNSSEC_Indeterminate string = "indeterminate"
+)
+
+// defaultTrustAnchors are the DS records of the root zone KSKs published by
+// IANA (KSK-2017 and KSK-2024).
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// chainError ends the validation, the link names the record set at which the
+// chain of trust broke.
+type chainError struct {
+	status string
+	link   string
+	err    error
+}
+
+func (e *chainError) Error() string {
+	return e.link + ": " + e.err.Error()
+}
+
+func bogus(link string, err error) *chainError {
+	return &chainError{status: DNSSEC_Bogus, link: link, err: err}
+}
+
+// validator walks the chain of trust from a trust anchor down to the queried
+// name over a single resolver.
+type validator struct {
+	r       *resolver
+	anchors []*dns.DS
+	now     time.Time
+
+	// earliest expiration of the verified signatures
+	expires time.Time
+}
+
+// parseTrustAnchors parses DS records in presentation format.
+func parseTrustAnchors(records []string) ([]*dns.DS, error) {
+	anchors := make([]*dns.DS, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %w", record, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", record)
+		}
+		ds.Hdr.Name = dns.CanonicalName(ds.Hdr.Name)
+		anchors = append(anchors, ds)
+	}
+	return anchors, nil
+}
+
+// validateChain validates the answer for the name and record type and returns
+// the extra fields reporting the DNSSEC status.
+func (d *DeepmonDNS) validateChain(r *resolver, name string, qtype uint16) map[string]interface{} {
+	v := &validator{r: r, anchors: d.trustAnchors, now: time.Now()}
+	fields := map[string]interface{}{
+		"dnssec_status":       DNSSEC_Secure,
+		"dnssec_failing_link": "",
+	}
+	if err := v.validate(name, qtype); err != nil {
+		fields["dnssec_status"] = err.status
+		fields["dnssec_failing_link"] = err.Error()
+	}
+	if !v.expires.IsZero() {
+		fields["rrsig_expires_in_hours"] = int(math.Floor(v.expires.Sub(v.now).Hours()))
+	}
+	return fields
+}
+
+func (v *validator) validate(name string, qtype uint16) *chainError {
+	name = dns.CanonicalName(name)
+
+	// Start at the deepest trust anchor above the name
+	zone := ""
+	var trusted []*dns.DS
+	for _, ds := range v.anchors {
+		if !dns.IsSubDomain(ds.Hdr.Name, name) {
+			continue
+		}
+		if dns.CountLabel(ds.Hdr.Name) > dns.CountLabel(zone) || zone == "" {
+			zone = ds.Hdr.Name
+			trusted = nil
+		}
+		if ds.Hdr.Name == zone {
+			trusted = append(trusted, ds)
+		}
+	}
+	if zone == "" {
+		return &chainError{status: DNSSEC_Indeterminate, link: name, err: errors.New("no trust anchor for the name")}
+	}
+	keys, cerr := v.zoneKeys(zone, trusted)
+	if cerr != nil {
+		return cerr
+	}
+
+	// Follow the delegations label by label
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		link := "DS " + child
+
+		msg, cerr := v.query(child, dns.TypeDS)
+		if cerr != nil {
+			return cerr
+		}
+		if dsSet, sigs := rrset(msg.Answer, child, dns.TypeDS); len(dsSet) > 0 {
+			if err := v.verify(dsSet, sigs, keys, zone); err != nil {
+				return bogus(link, err)
+			}
+			trusted = trusted[:0]
+			for _, rr := range dsSet {
+				trusted = append(trusted, rr.(*dns.DS))
+			}
+			if keys, cerr = v.zoneKeys(child, trusted); cerr != nil {
+				return cerr
+			}
+			zone = child
+			continue
+		}
+
+		// Without a DS record the parent has to prove its absence
+		if msg.Rcode == dns.RcodeNameError {
+			if err := v.verifyNameError(msg, child, keys, zone); err != nil {
+				return bogus(link, err)
+			}
+			return nil
+		}
+		delegation, err := v.verifyNoData(msg, child, dns.TypeDS, keys, zone)
+		if err != nil {
+			return bogus(link, err)
+		}
+		if delegation {
+			return &chainError{status: DNSSEC_Insecure, link: link, err: errors.New("unsigned delegation")}
+		}
+	}
+
+	// Validate the answer itself with the keys of its zone
+	link := dns.TypeToString[qtype] + " " + name
+	msg, cerr := v.query(name, qtype)
+	if cerr != nil {
+		return cerr
+	}
+	answered := false
+	for _, t := range []uint16{qtype, dns.TypeCNAME} {
+		set, sigs := rrset(msg.Answer, name, t)
+		if len(set) == 0 {
+			continue
+		}
+		answered = true
+		if err := v.verify(set, sigs, keys, zone); err != nil {
+			return bogus(dns.TypeToString[t]+" "+name, err)
+		}
+	}
+	if answered {
+		return nil
+	}
+	if msg.Rcode == dns.RcodeNameError {
+		if err := v.verifyNameError(msg, name, keys, zone); err != nil {
+			return bogus(link, err)
+		}
+		return nil
+	}
+	if _, err := v.verifyNoData(msg, name, qtype, keys, zone); err != nil {
+		return bogus(link, err)
+	}
+	return nil
+}
+
+// query asks the resolver with checking disabled, so bogus data is returned
+// to be inspected instead of a SERVFAIL.
+func (v *validator) query(name string, qtype uint16) (*dns.Msg, *chainError) {
+	link := dns.TypeToString[qtype] + " " + name
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(4096, true)
+	msg.CheckingDisabled = true
+
+	resp, _, err := v.r.exchange(msg)
+	// DNSKEY sets easily exceed the UDP size, retry those over TCP
+	if err == nil && resp.Truncated && v.r.protocol == PROTOCOL_UDP {
+		client := &dns.Client{Net: PROTOCOL_TCP, Timeout: v.r.timeout}
+		resp, _, err = client.Exchange(msg, v.r.address)
+	}
+	if err != nil {
+		return nil, &chainError{status: DNSSEC_Indeterminate, link: link, err: err}
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, &chainError{
+			status: DNSSEC_Indeterminate,
+			link:   link,
+			err:    fmt.Errorf("resolver answered %s", dns.RcodeToString[resp.Rcode]),
+		}
+	}
+	return resp, nil
+}
+
+// zoneKeys returns the DNSKEYs of the zone once the key set is signed by a
+// key matching one of the trusted DS records.
+func (v *validator) zoneKeys(zone string, trusted []*dns.DS) ([]*dns.DNSKEY, *chainError) {
+	link := "DNSKEY " + zone
+	msg, cerr := v.query(zone, dns.TypeDNSKEY)
+	if cerr != nil {
+		return nil, cerr
+	}
+	set, sigs := rrset(msg.Answer, zone, dns.TypeDNSKEY)
+	if len(set) == 0 {
+		return nil, bogus(link, errors.New("no DNSKEY records"))
+	}
+
+	keys := make([]*dns.DNSKEY, 0, len(set))
+	var entry []*dns.DNSKEY
+	for _, rr := range set {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, ds := range trusted {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				entry = append(entry, key)
+				break
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return nil, bogus(link, errors.New("no DNSKEY matches the DS records"))
+	}
+	if err := v.verify(set, sigs, entry, zone); err != nil {
+		return nil, bogus(link, err)
+	}
+	return keys, nil
+}
+
+// rrset returns the records of the type owned by the name and the signatures
+// covering them.
+func rrset(rrs []dns.RR, name string, qtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == qtype {
+				sigs = append(sigs, sig)
+			}
+		} else if rr.Header().Rrtype == qtype {
+			set = append(set, rr)
+		}
+	}
+	return set, sigs
+}
+
+// sigTime converts the serial number arithmetic timestamps of RRSIGs.
+func sigTime(t uint32, now time.Time) time.Time {
+	return time.Unix(now.Unix()+int64(int32(t-uint32(now.Unix()))), 0)
+}
+
+// verify checks that a signature of the zone made by one of the keys is valid
+// and within its validity period.
+func (v *validator) verify(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, zone string) error {
+	if len(sigs) == 0 {
+		return errors.New("no RRSIG")
+	}
+	var last error
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zone) {
+			last = fmt.Errorf("RRSIG signed by %s instead of %s", sig.SignerName, zone)
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, set); err != nil {
+				last = fmt.Errorf("invalid RRSIG of key %d: %w", sig.KeyTag, err)
+				continue
+			}
+			if inception := sigTime(sig.Inception, v.now); v.now.Before(inception) {
+				last = fmt.Errorf("RRSIG of key %d not valid before %s", sig.KeyTag, inception.UTC().Format(time.RFC3339))
+				continue
+			}
+			expiration := sigTime(sig.Expiration, v.now)
+			if v.now.After(expiration) {
+				last = fmt.Errorf("RRSIG of key %d expired at %s", sig.KeyTag, expiration.UTC().Format(time.RFC3339))
+				continue
+			}
+			if v.expires.IsZero() || expiration.Before(v.expires) {
+				v.expires = expiration
+			}
+			return nil
+		}
+	}
+	if last == nil {
+		last = errors.New("no RRSIG made by a key of the zone")
+	}
+	return last
+}
+
+// denialRecords returns the verified NSEC and NSEC3 records of the authority
+// section.
+func (v *validator) denialRecords(msg *dns.Msg, keys []*dns.DNSKEY, zone string) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range msg.Ns {
+		var t uint16
+		switch rec := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rec)
+			t = dns.TypeNSEC
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rec)
+			t = dns.TypeNSEC3
+		default:
+			continue
+		}
+		set, sigs := rrset(msg.Ns, rr.Header().Name, t)
+		if err := v.verify(set, sigs, keys, zone); err != nil {
+			return nil, nil, fmt.Errorf("%s %s: %w", dns.TypeToString[t], rr.Header().Name, err)
+		}
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return nil, nil, errors.New("no NSEC or NSEC3 records proving the denial")
+	}
+	return nsecs, nsec3s, nil
+}
+
+// verifyNoData checks the proof that the name has no records of the type.
+// It returns whether the name is a delegation, which is only meaningful for
+// DS queries.
+func (v *validator) verifyNoData(msg *dns.Msg, name string, qtype uint16, keys []*dns.DNSKEY, zone string) (bool, error) {
+	nsecs, nsec3s, err := v.denialRecords(msg, keys, zone)
+	if err != nil {
+		return false, err
+	}
+	for _, nsec := range nsecs {
+		// Empty non-terminals are proven by a record covering the name and
+		// pointing to one of its descendants
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return false, nil
+		}
+		if !strings.EqualFold(nsec.Hdr.Name, name) {
+			continue
+		}
+		if hasType(nsec.TypeBitMap, qtype) || hasType(nsec.TypeBitMap, dns.TypeCNAME) {
+			return false, fmt.Errorf("NSEC %s lists the type", nsec.Hdr.Name)
+		}
+		return hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA), nil
+	}
+	for _, nsec3 := range nsec3s {
+		if !nsec3.Match(name) {
+			continue
+		}
+		if hasType(nsec3.TypeBitMap, qtype) || hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+			return false, fmt.Errorf("NSEC3 %s lists the type", nsec3.Hdr.Name)
+		}
+		return hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeSOA), nil
+	}
+
+	// Unsigned delegations may be skipped by opt-out NSEC3 chains, which is
+	// proven by an opt-out record covering the next closer name
+	if qtype == dns.TypeDS && len(nsec3s) > 0 {
+		_, next, err := closestEncloser(nsec3s, name)
+		if err != nil {
+			return false, err
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(next) && nsec3.Flags&1 == 1 {
+				return true, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("no NSEC or NSEC3 record proves the absence of %s", dns.TypeToString[qtype])
+}
+
+// verifyNameError checks the proof that neither the name nor a wildcard
+// covering it exist.
+func (v *validator) verifyNameError(msg *dns.Msg, name string, keys []*dns.DNSKEY, zone string) error {
+	nsecs, nsec3s, err := v.denialRecords(msg, keys, zone)
+	if err != nil {
+		return err
+	}
+
+	if len(nsec3s) > 0 {
+		encloser, next, err := closestEncloser(nsec3s, name)
+		if err != nil {
+			return err
+		}
+		if !anyCovers3(nsec3s, next) {
+			return fmt.Errorf("no NSEC3 record covers %s", next)
+		}
+		if !anyCovers3(nsec3s, "*."+encloser) {
+			return fmt.Errorf("no NSEC3 record covers the wildcard *.%s", encloser)
+		}
+		return nil
+	}
+
+	var covering *dns.NSEC
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			covering = nsec
+			break
+		}
+	}
+	if covering == nil {
+		return fmt.Errorf("no NSEC record covers %s", name)
+	}
+	// The closest encloser is the longest common ancestor of the name and
+	// the records surrounding it
+	encloser := commonAncestor(name, covering.Hdr.Name)
+	if other := commonAncestor(name, covering.NextDomain); dns.CountLabel(other) > dns.CountLabel(encloser) {
+		encloser = other
+	}
+	wildcard := "*." + encloser
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, wildcard) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no NSEC record covers the wildcard %s", wildcard)
+}
+
+// closestEncloser finds the closest existing ancestor of the name proven by a
+// matching NSEC3 record and returns it along with the next closer name.
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (string, string, error) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(encloser) {
+				return encloser, dns.Fqdn(strings.Join(labels[i-1:], ".")), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no NSEC3 record proves the closest encloser of %s", name)
+}
+
+func anyCovers3(nsec3s []*dns.NSEC3, name string) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers returns whether the name falls between the owner and the next
+// name of the record in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last record of the zone points back to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare orders names by their labels from right to left
+// (RFC 4034, section 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func commonAncestor(a, b string) string {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(la[len(la)-n:], "."))
+}
@@ -0,0 +1,148 @@
+package deepmon_dns
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/miekg/dns"
+)
+
+// Expectation declares the expected answer for a record type of the domain.
+type Expectation struct {
+	Type   string   `toml:"type"`
+	Values []string `toml:"values"`
+	Match  string   `toml:"match"`
+}
+
+const (
+	MATCH_Exact    string = "exact"
+	MATCH_Subset   string = "subset"
+	MATCH_Contains string = "contains"
+)
+
+var matchModes = []string{
+	MATCH_Exact,
+	MATCH_Subset,
+	MATCH_Contains,
+}
+
+func (d *DeepmonDNS) initExpectations() error {
+	for i := range d.Expect {
+		e := &d.Expect[i]
+		e.Type = strings.ToUpper(e.Type)
+		qtype, found := dns.StringToType[e.Type]
+		if !found || !slices.Contains(recordTypes, qtype) {
+			return fmt.Errorf("expect: record type %q is not queried", e.Type)
+		}
+		if e.Match == "" {
+			e.Match = MATCH_Exact
+		}
+		if err := choice.Check(e.Match, matchModes); err != nil {
+			return fmt.Errorf("expect: config option match: %w", err)
+		}
+		if len(e.Values) == 0 && e.Match != MATCH_Exact {
+			return fmt.Errorf("expect: %s needs values to match", e.Type)
+		}
+	}
+	return nil
+}
+
+// normalizeRData makes answers comparable to configured values, names are
+// compared case-insensitively without the trailing dot and MX records as
+// "preference exchange".
+func normalizeRData(rtype, data string) string {
+	data = strings.TrimSpace(data)
+	switch rtype {
+	case "TXT", "SPF":
+		// Keep the case of text records and only drop the quotes of single
+		// strings
+		if strings.Count(data, `"`) == 2 {
+			data = strings.Trim(data, `"`)
+		}
+		return data
+	case "MX":
+		data = strings.NewReplacer("(", "", ")", "").Replace(data)
+	}
+	return strings.TrimSuffix(strings.ToLower(data), ".")
+}
+
+// checkExpectations returns the failed expectations as TYPE[index].
+func (d *DeepmonDNS) checkExpectations(fields *monitors.DNSData) []string {
+	var failed []string
+	for i, e := range d.Expect {
+		answers := make(map[string]bool)
+		for _, record := range fields.Records {
+			if record.RType == e.Type {
+				answers[normalizeRData(e.Type, record.RData)] = true
+			}
+		}
+		if !e.matches(answers) {
+			failed = append(failed, fmt.Sprintf("%s[%d]", e.Type, i))
+		}
+	}
+	return failed
+}
+
+func (e *Expectation) matches(answers map[string]bool) bool {
+	expected := make(map[string]bool, len(e.Values))
+	for _, v := range e.Values {
+		expected[normalizeRData(e.Type, v)] = true
+	}
+
+	switch e.Match {
+	case MATCH_Subset:
+		// Every answer has to be one of the values
+		if len(answers) == 0 {
+			return false
+		}
+		for answer := range answers {
+			if !expected[answer] {
+				return false
+			}
+		}
+		return true
+	case MATCH_Contains:
+		// Every value has to be contained in one of the answers
+		for value := range expected {
+			found := false
+			for answer := range answers {
+				if strings.Contains(answer, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	return setKey(answers) == setKey(expected)
+}
+
+// diffRecords returns the records added and removed since the last answer.
+func diffRecords(previous, current []string) (added, removed []string) {
+	prev := make(map[string]bool, len(previous))
+	for _, record := range previous {
+		prev[record] = true
+	}
+	cur := make(map[string]bool, len(current))
+	for _, record := range current {
+		cur[record] = true
+		if !prev[record] {
+			added = append(added, record)
+		}
+	}
+	for _, record := range previous {
+		if !cur[record] {
+			removed = append(removed, record)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
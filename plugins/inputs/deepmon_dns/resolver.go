@@ -0,0 +1,301 @@
+package deepmon_dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	PROTOCOL_UDP   string = "udp"
+	PROTOCOL_TCP   string = "tcp"
+	PROTOCOL_TLS   string = "tcp-tls"
+	PROTOCOL_HTTPS string = "https"
+	PROTOCOL_QUIC  string = "quic"
+)
+
+var protocols = []string{
+	PROTOCOL_UDP,
+	PROTOCOL_TCP,
+	PROTOCOL_TLS,
+	PROTOCOL_HTTPS,
+	PROTOCOL_QUIC,
+}
+
+var defaultPorts = map[string]int{
+	PROTOCOL_UDP:   53,
+	PROTOCOL_TCP:   53,
+	PROTOCOL_TLS:   853,
+	PROTOCOL_HTTPS: 443,
+	PROTOCOL_QUIC:  853,
+}
+
+// defaultDoHPath is the path used for DNS-over-HTTPS resolvers given as IP.
+const defaultDoHPath = "/dns-query"
+
+// dohMediaType is the media type of DNS wire format messages (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// resolver is a single DNS server the domain is queried at.
+type resolver struct {
+	ip      string
+	name    string
+	port    int
+	address string
+
+	protocol  string
+	client    *dns.Client
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	// DNS-over-HTTPS
+	url       string
+	method    string
+	transport *http.Transport
+	http      *http.Client
+
+	// DNS-over-QUIC, the connection is reused for the queries of a gather
+	quic *quic.Conn
+}
+
+// newResolver parses a resolver given as ip or ip:port, the port defaults to
+// resolver_port. DNS-over-HTTPS resolvers can also be given as URL.
+func (d *DeepmonDNS) newResolver(entry string) (*resolver, error) {
+	r := &resolver{
+		ip:       entry,
+		port:     d.ResolverPort,
+		protocol: d.ResolverProtocol,
+		timeout:  time.Duration(d.Timeout),
+	}
+	if d.ResolverProtocol == PROTOCOL_HTTPS && strings.HasPrefix(entry, "https://") {
+		return r, r.initDoH(entry, d)
+	}
+
+	if net.ParseIP(entry) == nil {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("resolver %q is invalid", entry)
+		}
+		r.ip = host
+		if r.port, err = strconv.Atoi(port); err != nil || r.port < 1 || r.port > 65535 {
+			return nil, fmt.Errorf("port of resolver %q is invalid", entry)
+		}
+	}
+	r.address = net.JoinHostPort(r.ip, strconv.Itoa(r.port))
+
+	// Certificates of resolvers given as IP are checked against the IP
+	tlsCfg := d.tlsConfig.Clone()
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = r.ip
+	}
+
+	switch d.ResolverProtocol {
+	case PROTOCOL_HTTPS:
+		return r, r.initDoH("https://"+r.address+defaultDoHPath, d)
+	case PROTOCOL_QUIC:
+		// DoQ is identified by its ALPN token (RFC 9250, section 4.1.1)
+		tlsCfg.NextProtos = []string{"doq"}
+		r.tlsConfig = tlsCfg
+	default:
+		r.client = &dns.Client{
+			Timeout: r.timeout,
+			Net:     d.ResolverProtocol,
+		}
+		if d.ResolverProtocol == PROTOCOL_TLS {
+			r.client.TLSConfig = tlsCfg
+		}
+	}
+	return r, nil
+}
+
+func (r *resolver) initDoH(address string, d *DeepmonDNS) error {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("resolver %q is invalid", address)
+	}
+	r.url = u.String()
+	r.address = r.url
+	r.method = d.DoHMethod
+	r.ip = u.Hostname()
+	if net.ParseIP(r.ip) == nil {
+		r.name = r.ip
+	}
+	if port := u.Port(); port != "" {
+		r.port, _ = strconv.Atoi(port)
+	} else {
+		r.port = defaultPorts[PROTOCOL_HTTPS]
+	}
+
+	r.transport = &http.Transport{
+		TLSClientConfig:   d.tlsConfig.Clone(),
+		ForceAttemptHTTP2: true,
+	}
+	r.http = &http.Client{
+		Transport: r.transport,
+		Timeout:   r.timeout,
+	}
+	return nil
+}
+
+func (r *resolver) senMessage(domain string, recordType uint16) (*dns.Msg, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(domain), recordType)
+	msg.SetEdns0(2048, true)
+	return r.exchange(msg)
+}
+
+func (r *resolver) exchange(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	switch r.protocol {
+	case PROTOCOL_HTTPS:
+		return r.exchangeDoH(msg)
+	case PROTOCOL_QUIC:
+		return r.exchangeDoQ(msg)
+	}
+	return r.client.Exchange(msg, r.address)
+}
+
+// close releases the connections kept open during a gather.
+func (r *resolver) close() {
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
+	if r.quic != nil {
+		_ = r.quic.CloseWithError(0, "")
+		r.quic = nil
+	}
+}
+
+// exchangeDoH sends the query as DNS wire format over HTTPS (RFC 8484).
+func (r *resolver) exchangeDoH(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// The ID should be 0 to make the responses cacheable
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if r.method == http.MethodGet {
+		u := r.url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+		if strings.Contains(r.url, "?") {
+			u = r.url + "&dns=" + base64.RawURLEncoding.EncodeToString(packed)
+		}
+		req, err = http.NewRequest(http.MethodGet, u, nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, r.url, bytes.NewReader(packed))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("DoH resolver returned status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMediaType) {
+		return nil, rtt, fmt.Errorf("DoH resolver returned content type %q", ct)
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	return answer, rtt, nil
+}
+
+// exchangeDoQ sends the query on a new stream of the QUIC connection, both
+// messages are prefixed with their length (RFC 9250, section 4.2).
+func (r *resolver) exchangeDoQ(msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	if r.quic == nil {
+		conn, err := quic.DialAddr(ctx, r.address, r.tlsConfig, &quic.Config{HandshakeIdleTimeout: r.timeout})
+		if err != nil {
+			return nil, 0, err
+		}
+		r.quic = conn
+	}
+
+	// The ID must be 0 as the stream identifies the query
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	stream, err := r.quic.OpenStreamSync(ctx)
+	if err != nil {
+		// Drop the connection so the next query dials a new one
+		r.close()
+		return nil, 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	// A failed query resets both sides of the stream
+	abort := func() {
+		stream.CancelWrite(0)
+		stream.CancelRead(0)
+	}
+	if _, err := stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+		abort()
+		return nil, 0, err
+	}
+	if _, err := stream.Write(packed); err != nil {
+		abort()
+		return nil, 0, err
+	}
+	// Closing the stream signals the end of the query
+	if err := stream.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, time.Since(start), err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, time.Since(start), err
+	}
+	rtt := time.Since(start)
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	if answer.Id != 0 {
+		return nil, rtt, errors.New("DoQ resolver returned a non-zero message ID")
+	}
+	return answer, rtt, nil
+}
@@ -0,0 +1,246 @@
+package deepmon_dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/miekg/dns"
+)
+
+// nameserver is a single address of an authoritative server of the zone.
+type nameserver struct {
+	name    string
+	address string
+	ipv6    bool
+
+	reachable     bool
+	authoritative bool
+	rtt           time.Duration
+	rcode         string
+	serial        uint32
+	hasSerial     bool
+	err           error
+}
+
+// resolved returns whether an address of the server was found.
+func (ns *nameserver) resolved() bool {
+	return ns.address != ""
+}
+
+// lame returns whether the server is listed in the delegation but does not
+// serve the zone. Servers without an address are unresolved instead.
+func (ns *nameserver) lame() bool {
+	return ns.reachable && (!ns.authoritative || !ns.hasSerial)
+}
+
+// sweepNameservers discovers the authoritative servers of the domain's zone
+// and queries the SOA record at each of their addresses directly. The
+// resolver was already closed after its own query, so the connections opened
+// for the discovery are closed again.
+func (d *DeepmonDNS) sweepNameservers(acc telegraf.Accumulator, r *resolver) {
+	defer r.close()
+	zone, err := findZone(r, d.Domain)
+	if err != nil {
+		acc.AddError(fmt.Errorf("discovering zone of %q: %w", d.Domain, err))
+		return
+	}
+	servers, err := discoverNameservers(r, zone)
+	if err != nil {
+		acc.AddError(fmt.Errorf("discovering nameservers of %q: %w", zone, err))
+		return
+	}
+
+	port := d.nameserverPort
+	if port == 0 {
+		port = 53
+	}
+	var wg sync.WaitGroup
+	for _, ns := range servers {
+		if !ns.resolved() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ns.querySOA(zone, port, time.Duration(d.Timeout))
+		}()
+	}
+	wg.Wait()
+
+	// Secondaries lagging behind the highest serial did not pick up the
+	// latest zone transfer
+	var maxSerial uint32
+	serials := make(map[uint32]bool)
+	for _, ns := range servers {
+		if !ns.hasSerial || !ns.authoritative {
+			continue
+		}
+		if len(serials) == 0 || serialNewer(ns.serial, maxSerial) {
+			maxSerial = ns.serial
+		}
+		serials[ns.serial] = true
+	}
+
+	var reachable, lame, unresolved int
+	for _, ns := range servers {
+		if ns.reachable {
+			reachable++
+		}
+		if ns.lame() {
+			lame++
+		}
+		if !ns.resolved() {
+			unresolved++
+		}
+		fields := map[string]interface{}{
+			"resolved":      ns.resolved(),
+			"reachable":     ns.reachable,
+			"authoritative": ns.authoritative,
+			"lame":          ns.lame(),
+			"rtt":           float64(ns.rtt) / float64(time.Millisecond),
+			"rcode":         ns.rcode,
+			"serial_drift":  ns.hasSerial && ns.authoritative && ns.serial != maxSerial,
+			"error":         "",
+		}
+		if ns.hasSerial {
+			fields["soa_serial"] = int64(ns.serial)
+		}
+		if ns.err != nil {
+			fields["error"] = ns.err.Error()
+		}
+		ipVersion := "4"
+		if ns.ipv6 {
+			ipVersion = "6"
+		}
+		acc.AddFields(pluginName+"_nameserver", fields, map[string]string{
+			"domain":     d.Domain,
+			"zone":       zone,
+			"nameserver": ns.name,
+			"address":    ns.address,
+			"ip_version": ipVersion,
+		})
+	}
+
+	distinct := make([]string, 0, len(serials))
+	for serial := range serials {
+		distinct = append(distinct, strconv.FormatUint(uint64(serial), 10))
+	}
+	sort.Strings(distinct)
+	acc.AddFields(pluginName+"_zone", map[string]interface{}{
+		"nameservers":            len(servers),
+		"nameservers_reachable":  reachable,
+		"nameservers_unresolved": unresolved,
+		"lame_delegations":       lame,
+		"serial_consistent":      len(serials) <= 1,
+		"serials":                strings.Join(distinct, ","),
+		"max_serial":             int64(maxSerial),
+	}, map[string]string{
+		"domain": d.Domain,
+		"zone":   zone,
+	})
+}
+
+// serialNewer compares SOA serials using serial number arithmetic
+// (RFC 1982).
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// findZone returns the apex of the zone the name belongs to, given by the
+// owner of the SOA record in the answer or the authority section.
+func findZone(r *resolver, name string) (string, error) {
+	msg, _, err := r.senMessage(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(msg.Answer, msg.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return dns.CanonicalName(soa.Hdr.Name), nil
+		}
+	}
+	return "", fmt.Errorf("no SOA record in the answer (%s)", dns.RcodeToString[msg.Rcode])
+}
+
+// discoverNameservers resolves the addresses of the zone's NS records. Names
+// without any address are returned with an empty address.
+func discoverNameservers(r *resolver, zone string) ([]*nameserver, error) {
+	msg, _, err := r.senMessage(zone, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, rr := range msg.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			names = append(names, dns.CanonicalName(ns.Ns))
+		}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no NS records")
+	}
+	sort.Strings(names)
+
+	var servers []*nameserver
+	for _, name := range names {
+		var addresses int
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, _, err := r.senMessage(name, qtype)
+			if err != nil {
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rec := rr.(type) {
+				case *dns.A:
+					servers = append(servers, &nameserver{name: name, address: rec.A.String()})
+					addresses++
+				case *dns.AAAA:
+					servers = append(servers, &nameserver{name: name, address: rec.AAAA.String(), ipv6: true})
+					addresses++
+				}
+			}
+		}
+		if addresses == 0 {
+			servers = append(servers, &nameserver{name: name, err: errors.New("nameserver has no address")})
+		}
+	}
+	return servers, nil
+}
+
+// querySOA asks the server for the zone's SOA record without recursion.
+func (ns *nameserver) querySOA(zone string, port int, timeout time.Duration) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(zone, dns.TypeSOA)
+	msg.RecursionDesired = false
+
+	address := net.JoinHostPort(ns.address, strconv.Itoa(port))
+	client := &dns.Client{Net: PROTOCOL_UDP, Timeout: timeout}
+	resp, rtt, err := client.Exchange(msg, address)
+	if err == nil && resp.Truncated {
+		client.Net = PROTOCOL_TCP
+		resp, rtt, err = client.Exchange(msg, address)
+	}
+	if err != nil {
+		ns.err = err
+		return
+	}
+	ns.reachable = true
+	ns.rtt = rtt
+	ns.rcode = dns.RcodeToString[resp.Rcode]
+	ns.authoritative = resp.Authoritative && resp.Rcode == dns.RcodeSuccess
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, zone) {
+			ns.serial = soa.Serial
+			ns.hasSerial = true
+			break
+		}
+	}
+	if !ns.authoritative {
+		ns.err = fmt.Errorf("server is not authoritative for %s", zone)
+	}
+}
@@ -3,21 +3,69 @@ package deepmon_domain
 
 import (
 	_ "embed"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/targets"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/likexian/whois"
 	whoisparser "github.com/likexian/whois-parser"
 )
 
+const (
+	LOOKUP_Auto  string = "auto"
+	LOOKUP_RDAP  string = "rdap"
+	LOOKUP_WHOIS string = "whois"
+)
+
+var lookups = []string{
+	LOOKUP_Auto,
+	LOOKUP_RDAP,
+	LOOKUP_WHOIS,
+}
+
 type MontimeDomain struct {
 	//param for func
-	domain string `toml:"domain"`
+	Domain  string          `toml:"domain"`
+	Timeout config.Duration `toml:"timeout"`
+	// Lookup method, RDAP with a WHOIS fallback by default
+	Lookup           string `toml:"lookup"`
+	RDAPBootstrapURL string `toml:"rdap_bootstrap_url"`
+	RDAPServer       string `toml:"rdap_server"`
+	// Registries rate-limit lookups, so results are cached for this long
+	MinQueryInterval config.Duration `toml:"min_query_interval"`
 	//log keeper
+	Log telegraf.Logger `toml:"-"`
+
+	client *http.Client
+	whois  *whois.Client
+
+	targets.Batch
+
+	// RDAP servers by TLD, shared by the instances of all targets
+	registry *rdapRegistry
+
+	cache domainCache
+}
+
+// domainCache is the last successful lookup and the last failed one since,
+// persisted across restarts.
+type domainCache struct {
+	Domain  string       `json:"domain"`
+	Source  string       `json:"source"`
+	Queried time.Time    `json:"queried"`
+	Stats   *domainStats `json:"stats"`
+	// Failed lookups are not repeated before min_query_interval either
+	Failed time.Time `json:"failed,omitempty"`
+	Error  string    `json:"error,omitempty"`
 }
 
 //go:embed sample.conf
@@ -29,7 +77,76 @@ func (t *MontimeDomain) SampleConfig() string {
 	return sampleConfig
 }
 
+func (t *MontimeDomain) Init() error {
+	if t.HasTargets() {
+		registry := &rdapRegistry{}
+		return t.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *t
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			child.registry = registry
+			return &child, child.Init()
+		})
+	}
+	if t.Domain == "" {
+		return errors.New("domain is missing")
+	}
+	t.Domain = strings.ToLower(strings.TrimSuffix(t.Domain, "."))
+	if t.Timeout == 0 {
+		t.Timeout = config.Duration(10 * time.Second)
+	}
+	if t.Lookup == "" {
+		t.Lookup = LOOKUP_Auto
+	}
+	if err := choice.Check(t.Lookup, lookups); err != nil {
+		return fmt.Errorf("config option lookup: %w", err)
+	}
+	if t.RDAPBootstrapURL == "" {
+		t.RDAPBootstrapURL = defaultRDAPBootstrapURL
+	}
+	if t.MinQueryInterval == 0 {
+		t.MinQueryInterval = config.Duration(12 * time.Hour)
+	}
+	if t.MinQueryInterval < 0 {
+		return errors.New("min_query_interval cannot be negative")
+	}
+
+	t.client = &http.Client{Timeout: time.Duration(t.Timeout)}
+	if t.registry == nil {
+		t.registry = &rdapRegistry{}
+	}
+	t.whois = whois.NewClient().SetTimeout(time.Duration(t.Timeout))
+	return nil
+}
+
+func (t *MontimeDomain) GetState() interface{} {
+	if t.HasTargets() {
+		return t.TargetsState()
+	}
+	return t.cache
+}
+
+func (t *MontimeDomain) SetState(state interface{}) error {
+	if t.HasTargets() {
+		return t.SetTargetsState(state)
+	}
+	cache, ok := state.(domainCache)
+	if !ok {
+		return errors.New("state has to be of type 'domainCache'")
+	}
+	// Drop the cache if the configured domain changed in the meantime, the
+	// state is restored before the domain is normalized by Init
+	if cache.Domain != strings.ToLower(strings.TrimSuffix(t.Domain, ".")) || (cache.Stats == nil && cache.Failed.IsZero()) {
+		return nil
+	}
+	t.cache = cache
+	return nil
+}
+
 func (t *MontimeDomain) Gather(acc telegraf.Accumulator) error {
+	if t.HasTargets() {
+		return t.GatherTargets(acc)
+	}
 	t.sendData(acc)
 	return nil
 }
@@ -49,6 +166,7 @@ type domainStats struct {
 	}
 	CreationDate   string
 	ExpirationDate string
+	ExpiresAt      *time.Time
 	UpdatedDate    string
 	Status         string
 	NameServers    string
@@ -74,7 +192,7 @@ func (t *MontimeDomain) FetchWhoisData() (*domainStats, error) {
 	ts := &domainStats{}
 
 	// Perform WHOIS lookup
-	rawWhois, err := whois.Whois(t.domain)
+	rawWhois, err := t.whois.Whois(t.Domain)
 	if err != nil {
 		return ts, fmt.Errorf("error fetching WHOIS data: %v", err)
 	}
@@ -90,6 +208,7 @@ func (t *MontimeDomain) FetchWhoisData() (*domainStats, error) {
 		ts.DomainName = result.Domain.Domain
 		ts.CreationDate = result.Domain.CreatedDate
 		ts.ExpirationDate = result.Domain.ExpirationDate
+		ts.ExpiresAt = result.Domain.ExpirationDateInTime
 		ts.UpdatedDate = result.Domain.UpdatedDate
 		// Convert Status and NameServers slices to strings
 		ts.Status = strings.Join(result.Domain.Status, ", ")
@@ -132,19 +251,76 @@ func ExtractEmails(rawWhois string) []string {
 	return emails
 }
 
+// lookup returns the cached data while it is fresh and queries the registry
+// otherwise. A failed lookup is not repeated before min_query_interval, the
+// stale data is returned with the error in the meantime.
+func (t *MontimeDomain) lookup() (stats *domainStats, source string, cached bool, err error) {
+	if t.cache.Stats != nil && time.Since(t.cache.Queried) < time.Duration(t.MinQueryInterval) {
+		return t.cache.Stats, t.cache.Source, true, nil
+	}
+	if !t.cache.Failed.IsZero() && time.Since(t.cache.Failed) < time.Duration(t.MinQueryInterval) {
+		return t.cache.Stats, t.cache.Source, t.cache.Stats != nil, errors.New(t.cache.Error)
+	}
+
+	switch t.Lookup {
+	case LOOKUP_RDAP:
+		source = LOOKUP_RDAP
+		stats, err = t.FetchRDAPData()
+	case LOOKUP_WHOIS:
+		source = LOOKUP_WHOIS
+		stats, err = t.FetchWhoisData()
+	default:
+		source = LOOKUP_RDAP
+		stats, err = t.FetchRDAPData()
+		if err != nil {
+			t.Log.Debugf("RDAP lookup of %q failed, falling back to WHOIS: %v", t.Domain, err)
+			source = LOOKUP_WHOIS
+			var whoisErr error
+			stats, whoisErr = t.FetchWhoisData()
+			if whoisErr != nil {
+				err = fmt.Errorf("%w; %w", err, whoisErr)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.cache.Domain = t.Domain
+		t.cache.Failed = time.Now()
+		t.cache.Error = err.Error()
+		return t.cache.Stats, source, t.cache.Stats != nil, err
+	}
+
+	t.cache = domainCache{
+		Domain:  t.Domain,
+		Source:  source,
+		Queried: time.Now(),
+		Stats:   stats,
+	}
+	return stats, source, false, nil
+}
+
 func (t *MontimeDomain) sendData(acc telegraf.Accumulator) {
 	fields := &monitors.DomainData{}
 	tags := monitors.MonitorData[*monitors.DomainData]{
-		Domain: t.domain,
+		Domain: t.Domain,
 		Data:   fields,
 	}
-	stats, err := t.FetchWhoisData()
+	stats, source, cached, err := t.lookup()
+	extra := map[string]interface{}{
+		"lookup_source": source,
+		"cached":        cached,
+	}
+	fields.Result = monitors.Success
 	if err != nil {
 		fields.Result = monitors.Failed
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
-		return
+		extra["error"] = err.Error()
+		// The stale data of the last successful lookup is still reported
+		if stats == nil {
+			addFields(acc, tags, extra)
+			return
+		}
 	}
-	fields.Result = monitors.Success
 	fields.DomainName = stats.DomainName
 	fields.DNSSEC = stats.DNSSEC
 	fields.RegistrarName = stats.Registrar.Name
@@ -164,6 +340,20 @@ func (t *MontimeDomain) sendData(acc telegraf.Accumulator) {
 	fields.RegistrantEmail = stats.Registrant.Email
 	fields.RegistrantPhone = stats.Registrant.Phone
 
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
+	// The countdown is computed on every gather, also for cached data
+	if stats.ExpiresAt != nil {
+		extra["expires_in_days"] = int(time.Until(*stats.ExpiresAt).Hours() / 24)
+	}
+	extra["last_lookup"] = t.cache.Queried.Unix()
+
+	addFields(acc, tags, extra)
+}
 
+// addFields emits the DomainData fields merged with the extra fields.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.DomainData], extra map[string]interface{}) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	acc.AddFields(pluginName, data, tags.GetTags())
 }
@@ -0,0 +1,301 @@
+package deepmon_domain
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/whois"
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+const rdapResponse = `{
+  "objectClassName": "domain",
+  "ldhName": "EXAMPLE.COM",
+  "status": ["client transfer prohibited", "client update prohibited"],
+  "events": [
+    {"eventAction": "registration", "eventDate": "1995-08-14T04:00:00Z"},
+    {"eventAction": "expiration", "eventDate": "%s"},
+    {"eventAction": "last changed", "eventDate": "2024-08-14T07:01:34Z"}
+  ],
+  "nameservers": [{"ldhName": "A.IANA-SERVERS.NET"}, {"ldhName": "B.IANA-SERVERS.NET"}],
+  "secureDNS": {"delegationSigned": true},
+  "entities": [
+    {
+      "roles": ["registrar"],
+      "vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "RESERVED-Internet Assigned Numbers Authority"]]],
+      "links": [{"rel": "about", "href": "http://res-dom.iana.org"}],
+      "entities": [
+        {
+          "roles": ["technical"],
+          "vcardArray": ["vcard", [["fn", {}, "text", "Tech Team"], ["email", {}, "text", "tech@example.com"], ["tel", {"type": "voice"}, "uri", "tel:+1.5555551234"]]]
+        }
+      ]
+    }
+  ]
+}`
+
+func startRDAP(t *testing.T, expires time.Time) (*httptest.Server, *int32) {
+	var lookups int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bootstrap", func(w http.ResponseWriter, r *http.Request) {
+		registry := rdapBootstrap{Services: [][][]string{
+			{{"net"}, {"http://invalid.example/"}},
+			{{"com", "net"}, {"http://" + r.Host + "/rdap/"}},
+		}}
+		require.NoError(t, json.NewEncoder(w).Encode(registry))
+	})
+	mux.HandleFunc("/rdap/domain/example.com", func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		w.Header().Set("Content-Type", "application/rdap+json")
+		fmt.Fprintf(w, rdapResponse, expires.Format(time.RFC3339))
+	})
+	mux.HandleFunc("/rdap/domain/", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errorCode": 404, "title": "Not Found"}`)
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts, &lookups
+}
+
+const whoisResponse = `Domain Name: MISSING.COM
+Registrar: Example Registrar, Inc.
+Creation Date: 2001-02-03T04:05:06Z
+Registry Expiry Date: 2031-02-03T04:05:06Z
+Name Server: NS1.EXAMPLE.NET
+DNSSEC: unsigned
+`
+
+// whoisDialer connects the WHOIS client to the server at the address, or
+// fails if there is none
+type whoisDialer struct {
+	address string
+	dials   int32
+}
+
+func (d *whoisDialer) Dial(network, _ string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	if d.address == "" {
+		return nil, errors.New("connection refused")
+	}
+	return net.Dial(network, d.address)
+}
+
+// startWhois serves the WHOIS server of the TLDs and the domain's record
+func startWhois(t *testing.T) *whoisDialer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			query, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.TrimSpace(query) == "com" {
+				fmt.Fprint(conn, "refer: whois.example.net\n")
+			} else {
+				fmt.Fprint(conn, whoisResponse)
+			}
+			conn.Close()
+		}
+	}()
+	return &whoisDialer{address: listener.Addr().String()}
+}
+
+func TestRDAP(t *testing.T) {
+	expires := time.Now().Add(30*24*time.Hour + time.Hour).UTC()
+	ts, lookups := startRDAP(t, expires)
+
+	plugin := &MontimeDomain{
+		Domain:           "Example.com.",
+		Lookup:           LOOKUP_RDAP,
+		RDAPBootstrapURL: ts.URL + "/bootstrap",
+		Log:              testutil.Logger{},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	m := acc.Metrics[0]
+	require.Equal(t, "example.com", m.Tags["domain"])
+	require.Equal(t, "example.com", m.Fields["domain_name"])
+	require.Equal(t, true, m.Fields["dnssec"])
+	require.Equal(t, "RESERVED-Internet Assigned Numbers Authority", m.Fields["registrar_name"])
+	require.Equal(t, "http://res-dom.iana.org", m.Fields["registrar_referral_url"])
+	require.Equal(t, "1995-08-14T04:00:00Z", m.Fields["creation_date"])
+	require.Equal(t, "a.iana-servers.net, b.iana-servers.net", m.Fields["name_servers"])
+	require.Equal(t, "tech@example.com", m.Fields["tech_email"])
+	require.Equal(t, "+1.5555551234", m.Fields["tech_phone"])
+	require.Equal(t, 30, m.Fields["expires_in_days"])
+	require.Equal(t, LOOKUP_RDAP, m.Fields["lookup_source"])
+	require.Equal(t, false, m.Fields["cached"])
+
+	// The second gather is served from the cache
+	acc.ClearMetrics()
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	require.Equal(t, true, acc.Metrics[0].Fields["cached"])
+	require.Equal(t, 30, acc.Metrics[0].Fields["expires_in_days"])
+	require.EqualValues(t, 1, atomic.LoadInt32(lookups))
+}
+
+func TestRDAPNotFound(t *testing.T) {
+	ts, _ := startRDAP(t, time.Now())
+
+	plugin := &MontimeDomain{
+		Domain:     "missing.com",
+		Lookup:     LOOKUP_RDAP,
+		RDAPServer: ts.URL + "/rdap/",
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	require.Contains(t, acc.Metrics[0].Fields["error"], "status 404: Not Found")
+	require.Equal(t, false, acc.Metrics[0].Fields["cached"])
+}
+
+func TestWhoisFallback(t *testing.T) {
+	ts, _ := startRDAP(t, time.Now())
+
+	plugin := &MontimeDomain{
+		Domain:     "missing.com",
+		RDAPServer: ts.URL + "/rdap/",
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, plugin.Init())
+	plugin.whois = whois.NewClient().SetDialer(startWhois(t))
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	m := acc.Metrics[0]
+	require.NotContains(t, m.Fields, "error")
+	require.Equal(t, LOOKUP_WHOIS, m.Fields["lookup_source"])
+	require.Equal(t, "Example Registrar, Inc.", m.Fields["registrar_name"])
+	require.Equal(t, "2001-02-03T04:05:06Z", m.Fields["creation_date"])
+}
+
+func TestFailureBackoff(t *testing.T) {
+	ts, lookups := startRDAP(t, time.Now().Add(48*time.Hour))
+
+	plugin := &MontimeDomain{
+		Domain:           "example.com",
+		RDAPServer:       ts.URL + "/rdap/",
+		MinQueryInterval: config.Duration(time.Hour),
+		Log:              testutil.Logger{},
+	}
+	require.NoError(t, plugin.Init())
+	dialer := &whoisDialer{}
+	plugin.whois = whois.NewClient().SetDialer(dialer)
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Equal(t, LOOKUP_RDAP, acc.Metrics[0].Fields["lookup_source"])
+
+	// The cache expired while both registries are down, the stale data is
+	// reported with the error
+	plugin.cache.Queried = time.Now().Add(-2 * time.Hour)
+	plugin.RDAPServer = ts.URL + "/down/"
+	acc.ClearMetrics()
+	require.NoError(t, plugin.Gather(&acc))
+	m := acc.Metrics[0]
+	require.Contains(t, m.Fields["error"], "connection refused")
+	require.Equal(t, true, m.Fields["cached"])
+	require.Equal(t, "RESERVED-Internet Assigned Numbers Authority", m.Fields["registrar_name"])
+	require.EqualValues(t, 1, atomic.LoadInt32(&dialer.dials))
+
+	// The failed lookup is not repeated before min_query_interval
+	acc.ClearMetrics()
+	require.NoError(t, plugin.Gather(&acc))
+	require.Contains(t, acc.Metrics[0].Fields["error"], "connection refused")
+	require.Equal(t, "RESERVED-Internet Assigned Numbers Authority", acc.Metrics[0].Fields["registrar_name"])
+	require.EqualValues(t, 1, atomic.LoadInt32(&dialer.dials))
+
+	// The registries are queried again afterwards
+	plugin.cache.Failed = time.Now().Add(-2 * time.Hour)
+	plugin.RDAPServer = ts.URL + "/rdap/"
+	acc.ClearMetrics()
+	require.NoError(t, plugin.Gather(&acc))
+	require.NotContains(t, acc.Metrics[0].Fields, "error")
+	require.Equal(t, false, acc.Metrics[0].Fields["cached"])
+	require.EqualValues(t, 2, atomic.LoadInt32(lookups))
+	require.True(t, plugin.cache.Failed.IsZero())
+}
+
+func TestState(t *testing.T) {
+	ts, lookups := startRDAP(t, time.Now().Add(48*time.Hour))
+
+	plugin := &MontimeDomain{
+		Domain:     "example.com",
+		Lookup:     LOOKUP_RDAP,
+		RDAPServer: ts.URL + "/rdap/",
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, plugin.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	// Round-trip the state through JSON like the persister does
+	serialized, err := json.Marshal(plugin.GetState())
+	require.NoError(t, err)
+	var state domainCache
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	restarted := &MontimeDomain{
+		Domain:     "example.com",
+		Lookup:     LOOKUP_RDAP,
+		RDAPServer: ts.URL + "/rdap/",
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, restarted.Init())
+	require.NoError(t, restarted.SetState(state))
+	acc.ClearMetrics()
+	require.NoError(t, restarted.Gather(&acc))
+	require.Equal(t, true, acc.Metrics[0].Fields["cached"])
+	require.EqualValues(t, 1, atomic.LoadInt32(lookups))
+
+	// A cache of another domain is dropped
+	other := &MontimeDomain{
+		Domain:           "example.com",
+		Lookup:           LOOKUP_RDAP,
+		RDAPServer:       ts.URL + "/rdap/",
+		MinQueryInterval: config.Duration(time.Hour),
+		Log:              testutil.Logger{},
+	}
+	require.NoError(t, other.Init())
+	state.Domain = "example.net"
+	require.NoError(t, other.SetState(state))
+	acc.ClearMetrics()
+	require.NoError(t, other.Gather(&acc))
+	require.Equal(t, false, acc.Metrics[0].Fields["cached"])
+	require.EqualValues(t, 2, atomic.LoadInt32(lookups))
+}
+
+func TestInit(t *testing.T) {
+	require.ErrorContains(t, (&MontimeDomain{}).Init(), "domain is missing")
+	require.ErrorContains(t, (&MontimeDomain{Domain: "example.com", Lookup: "dig"}).Init(), "lookup")
+
+	plugin := &MontimeDomain{Domain: "example.com"}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, LOOKUP_Auto, plugin.Lookup)
+	require.Equal(t, defaultRDAPBootstrapURL, plugin.RDAPBootstrapURL)
+	require.Equal(t, config.Duration(12*time.Hour), plugin.MinQueryInterval)
+}
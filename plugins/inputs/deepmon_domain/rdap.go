@@ -0,0 +1,266 @@
+package deepmon_domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRDAPBootstrapURL is the IANA registry mapping TLDs to RDAP servers.
+const defaultRDAPBootstrapURL = "https://data.iana.org/rdap/dns.json"
+
+// maxRDAPResponseSize limits the size of bootstrap and domain responses.
+const maxRDAPResponseSize = 8 << 20
+
+// rdapRegistry holds the RDAP servers by TLD of the bootstrap registry,
+// which is only downloaded once.
+type rdapRegistry struct {
+	sync.Mutex
+	servers map[string][]string
+}
+
+type rdapBootstrap struct {
+	Services [][][]string `json:"services"`
+}
+
+type rdapDomain struct {
+	LDHName     string       `json:"ldhName"`
+	Status      []string     `json:"status"`
+	Events      []rdapEvent  `json:"events"`
+	Nameservers []rdapNS     `json:"nameservers"`
+	SecureDNS   rdapDNSSEC   `json:"secureDNS"`
+	Entities    []rdapEntity `json:"entities"`
+}
+
+type rdapEvent struct {
+	Action string `json:"eventAction"`
+	Date   string `json:"eventDate"`
+}
+
+type rdapNS struct {
+	LDHName string `json:"ldhName"`
+}
+
+type rdapDNSSEC struct {
+	DelegationSigned bool `json:"delegationSigned"`
+}
+
+type rdapEntity struct {
+	Roles      []string          `json:"roles"`
+	VCardArray []json.RawMessage `json:"vcardArray"`
+	Links      []rdapLink        `json:"links"`
+	Entities   []rdapEntity      `json:"entities"`
+}
+
+type rdapLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+// rdapError is the error object returned by RDAP servers.
+type rdapError struct {
+	ErrorCode   int      `json:"errorCode"`
+	Title       string   `json:"title"`
+	Description []string `json:"description"`
+}
+
+// contact holds the vCard properties of an entity.
+type contact struct {
+	Name  string
+	Email string
+	Phone string
+	URL   string
+}
+
+// FetchRDAPData looks up the domain at the RDAP server responsible for its
+// TLD.
+func (t *MontimeDomain) FetchRDAPData() (*domainStats, error) {
+	server := t.RDAPServer
+	if server == "" {
+		var err error
+		if server, err = t.rdapServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	address := strings.TrimSuffix(server, "/") + "/domain/" + t.Domain
+	var domain rdapDomain
+	if err := t.getJSON(address, &domain); err != nil {
+		return nil, fmt.Errorf("error fetching RDAP data: %w", err)
+	}
+
+	ts := &domainStats{
+		DomainName: strings.ToLower(domain.LDHName),
+		Status:     strings.Join(domain.Status, ", "),
+		DNSSEC:     domain.SecureDNS.DelegationSigned,
+	}
+	nameservers := make([]string, 0, len(domain.Nameservers))
+	for _, ns := range domain.Nameservers {
+		nameservers = append(nameservers, strings.ToLower(ns.LDHName))
+	}
+	ts.NameServers = strings.Join(nameservers, ", ")
+
+	for _, event := range domain.Events {
+		switch event.Action {
+		case "registration":
+			ts.CreationDate = event.Date
+		case "last changed":
+			ts.UpdatedDate = event.Date
+		case "expiration":
+			ts.ExpirationDate = event.Date
+			if expires, err := time.Parse(time.RFC3339, event.Date); err == nil {
+				ts.ExpiresAt = &expires
+			}
+		}
+	}
+
+	if c, found := findContact(domain.Entities, "registrar"); found {
+		ts.Registrar.Name = c.Name
+		ts.Registrar.ReferralURL = c.URL
+	}
+	if c, found := findContact(domain.Entities, "administrative"); found {
+		ts.AdminContact.Name = c.Name
+		ts.AdminContact.Email = c.Email
+		ts.AdminContact.Phone = c.Phone
+	}
+	if c, found := findContact(domain.Entities, "technical"); found {
+		ts.TechContact.Name = c.Name
+		ts.TechContact.Email = c.Email
+		ts.TechContact.Phone = c.Phone
+	}
+	if c, found := findContact(domain.Entities, "registrant"); found {
+		ts.Registrant.Name = c.Name
+		ts.Registrant.Email = c.Email
+		ts.Registrant.Phone = c.Phone
+	}
+
+	return ts, nil
+}
+
+// rdapServer returns the RDAP server of the domain's TLD.
+func (t *MontimeDomain) rdapServer() (string, error) {
+	t.registry.Lock()
+	defer t.registry.Unlock()
+
+	if t.registry.servers == nil {
+		var registry rdapBootstrap
+		if err := t.getJSON(t.RDAPBootstrapURL, &registry); err != nil {
+			return "", fmt.Errorf("error fetching RDAP bootstrap registry: %w", err)
+		}
+		t.registry.servers = make(map[string][]string)
+		for _, service := range registry.Services {
+			if len(service) != 2 {
+				continue
+			}
+			for _, tld := range service[0] {
+				t.registry.servers[strings.ToLower(tld)] = service[1]
+			}
+		}
+	}
+
+	tld := t.Domain[strings.LastIndex(t.Domain, ".")+1:]
+	servers := t.registry.servers[tld]
+	// Prefer https servers as the registry may list plain http ones as well
+	for _, server := range servers {
+		if strings.HasPrefix(server, "https://") {
+			return server, nil
+		}
+	}
+	if len(servers) > 0 {
+		return servers[0], nil
+	}
+	return "", fmt.Errorf("no RDAP server known for TLD %q", tld)
+}
+
+func (t *MontimeDomain) getJSON(address string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRDAPResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var rerr rdapError
+		if json.Unmarshal(body, &rerr) == nil && rerr.Title != "" {
+			return fmt.Errorf("status %d: %s", resp.StatusCode, rerr.Title)
+		}
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// findContact searches the entities and their nested entities for the first
+// one having the role.
+func findContact(entities []rdapEntity, role string) (contact, bool) {
+	for _, entity := range entities {
+		for _, r := range entity.Roles {
+			if r == role {
+				c := parseVCard(entity.VCardArray)
+				if c.URL == "" {
+					for _, link := range entity.Links {
+						if link.Rel == "about" {
+							c.URL = link.Href
+							break
+						}
+					}
+				}
+				return c, true
+			}
+		}
+		if c, found := findContact(entity.Entities, role); found {
+			return c, true
+		}
+	}
+	return contact{}, false
+}
+
+// parseVCard reads the properties of a jCard (RFC 7095), which has the form
+// ["vcard", [[name, params, type, value], ...]].
+func parseVCard(vcard []json.RawMessage) contact {
+	var c contact
+	if len(vcard) != 2 {
+		return c
+	}
+	var properties [][]json.RawMessage
+	if err := json.Unmarshal(vcard[1], &properties); err != nil {
+		return c
+	}
+	for _, property := range properties {
+		if len(property) < 4 {
+			continue
+		}
+		var name string
+		if err := json.Unmarshal(property[0], &name); err != nil {
+			continue
+		}
+		// Structured values are arrays, only plain text values are of interest
+		var value string
+		if err := json.Unmarshal(property[3], &value); err != nil {
+			continue
+		}
+		switch name {
+		case "fn":
+			c.Name = value
+		case "email":
+			c.Email = value
+		case "tel":
+			c.Phone = strings.TrimPrefix(value, "tel:")
+		case "url":
+			c.URL = value
+		}
+	}
+	return c
+}
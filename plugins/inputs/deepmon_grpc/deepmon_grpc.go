@@ -0,0 +1,413 @@
+//go:generate ../../../tools/readme_config_includer/generator
+package deepmon_grpc
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"golang.org/x/net/idna"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionalphapb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+// The monitors package has no type for gRPC monitoring yet
+const pluginName = "deepmon_grpc"
+
+// Statuses reported besides the ones of the health checking protocol
+const (
+	STATUS_Unimplemented = "UNIMPLEMENTED"
+	STATUS_Error         = "ERROR"
+)
+
+// watchRetry is the time to wait before a broken watch is opened again.
+const watchRetry = time.Second
+
+type MontimeGRPC struct {
+	Domain  string          `toml:"domain"`
+	Port    int             `toml:"port"`
+	Timeout config.Duration `toml:"timeout"`
+	// Services are the names checked, the empty name is the server itself
+	Services []string `toml:"services"`
+	// Watch keeps a stream open per service to catch status changes between
+	// the gathers.
+	Watch bool `toml:"watch"`
+	// Reflection lists the services of the server.
+	Reflection bool `toml:"reflection"`
+	tlsint.ClientConfig
+
+	Log telegraf.Logger `toml:"-"`
+
+	creds  credentials.TransportCredentials
+	conn   *grpc.ClientConn
+	health healthpb.HealthClient
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	watched map[string]*watchState
+}
+
+// GRPCData is the health of a service at the time of the gather.
+type GRPCData struct {
+	Result  monitors.Result
+	Port    int
+	Status  string
+	Latency float64
+}
+
+// watchState is the last status streamed for a service and the number of
+// changes since the last gather.
+type watchState struct {
+	status  string
+	changes int
+}
+
+func (*MontimeGRPC) SampleConfig() string {
+	return sampleConfig
+}
+
+func (g *MontimeGRPC) Init() error {
+	// The domain may bring its own port
+	if host, port, err := net.SplitHostPort(g.Domain); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid port in domain %q", g.Domain)
+		}
+		g.Domain, g.Port = host, p
+	}
+	if g.Domain == "" {
+		return errors.New("domain cannot be empty")
+	}
+	if net.ParseIP(g.Domain) == nil {
+		if _, err := idna.Lookup.ToASCII(g.Domain); err != nil {
+			return fmt.Errorf("invalid domain: %s", g.Domain)
+		}
+	}
+	if g.Port < 1 || g.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if g.Timeout == 0 {
+		g.Timeout = config.Duration(5 * time.Second)
+	}
+	if len(g.Services) == 0 {
+		g.Services = []string{""}
+	}
+	seen := make(map[string]bool, len(g.Services))
+	for _, s := range g.Services {
+		if seen[s] {
+			return fmt.Errorf("duplicate service %q", s)
+		}
+		seen[s] = true
+	}
+
+	tlsConf, err := g.ClientConfig.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to set TLS config: %w", err)
+	}
+	g.creds = insecure.NewCredentials()
+	if tlsConf != nil {
+		g.creds = credentials.NewTLS(tlsConf)
+	}
+	return nil
+}
+
+// Start creates the client and opens the watch streams of the services. The
+// connection is only established on the first call.
+func (g *MontimeGRPC) Start(telegraf.Accumulator) error {
+	conn, err := grpc.NewClient(net.JoinHostPort(g.Domain, strconv.Itoa(g.Port)), grpc.WithTransportCredentials(g.creds))
+	if err != nil {
+		return fmt.Errorf("creating client failed: %w", err)
+	}
+	g.conn = conn
+	g.health = healthpb.NewHealthClient(conn)
+	g.watched = make(map[string]*watchState, len(g.Services))
+
+	if !g.Watch {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	for _, service := range g.Services {
+		g.wg.Add(1)
+		go func(service string) {
+			defer g.wg.Done()
+			g.watch(ctx, service)
+		}(service)
+	}
+	return nil
+}
+
+// Stop closes the watch streams and the connection.
+func (g *MontimeGRPC) Stop() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.wg.Wait()
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+// watch follows the status of the service until the context is done. Broken
+// streams are opened again, servers without Watch support are given up on.
+func (g *MontimeGRPC) watch(ctx context.Context, service string) {
+	for {
+		stream, err := g.health.Watch(ctx, &healthpb.HealthCheckRequest{Service: service})
+		for err == nil {
+			var resp *healthpb.HealthCheckResponse
+			if resp, err = stream.Recv(); err == nil {
+				g.watchedStatus(service, resp.GetStatus().String())
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			g.Log.Warnf("Server does not support watching service %q: %v", service, err)
+			return
+		}
+		g.Log.Debugf("Watching service %q failed: %v", service, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetry):
+		}
+	}
+}
+
+func (g *MontimeGRPC) watchedStatus(service, s string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w, found := g.watched[service]
+	if !found {
+		g.watched[service] = &watchState{status: s}
+		return
+	}
+	if w.status != s {
+		w.status = s
+		w.changes++
+	}
+}
+
+func (g *MontimeGRPC) Gather(acc telegraf.Accumulator) error {
+	for _, service := range g.Services {
+		fields, extra := g.check(service)
+		if g.Watch {
+			g.mu.Lock()
+			if w, found := g.watched[service]; found {
+				extra["watch_status"] = w.status
+				extra["watch_changes"] = w.changes
+				w.changes = 0
+			}
+			g.mu.Unlock()
+		}
+		tags := monitors.MonitorData[*GRPCData]{
+			Domain: g.Domain,
+			Data:   fields,
+		}
+		addFields(acc, tags, extra, service)
+	}
+	if g.Reflection {
+		g.listServices(acc)
+	}
+	return nil
+}
+
+// check calls Health/Check for the service and fills the GRPCData with the
+// status, the latency and the details of the TLS connection.
+func (g *MontimeGRPC) check(service string) (*GRPCData, map[string]interface{}) {
+	fields := &GRPCData{
+		Result: monitors.Failed,
+		Port:   g.Port,
+	}
+	extra := make(map[string]interface{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.Timeout))
+	defer cancel()
+	var p peer.Peer
+	start := time.Now()
+	resp, err := g.health.Check(ctx, &healthpb.HealthCheckRequest{Service: service}, grpc.Peer(&p))
+	fields.Latency = time.Since(start).Seconds()
+	if p.Addr != nil {
+		extra["remote_addr"] = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		addTLSFields(info.State, extra)
+	}
+
+	if err != nil {
+		extra["error"] = err.Error()
+		switch status.Code(err) {
+		case codes.DeadlineExceeded:
+			fields.Result = monitors.Timeout
+			fields.Status = STATUS_Error
+		case codes.Unavailable:
+			fields.Result = monitors.ConnectionFailed
+			fields.Status = STATUS_Error
+		case codes.NotFound:
+			// The server does not know the service
+			fields.Status = healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String()
+		case codes.Unimplemented:
+			fields.Status = STATUS_Unimplemented
+		default:
+			fields.Status = STATUS_Error
+		}
+		return fields, extra
+	}
+
+	fields.Status = resp.GetStatus().String()
+	if resp.GetStatus() == healthpb.HealthCheckResponse_SERVING {
+		fields.Result = monitors.Success
+	}
+	return fields, extra
+}
+
+// addTLSFields adds the negotiated TLS version and cipher suite and the
+// validity of the server certificate.
+func addTLSFields(state tls.ConnectionState, extra map[string]interface{}) {
+	extra["tls_version"] = tls.VersionName(state.Version)
+	extra["tls_cipher_suite"] = tls.CipherSuiteName(state.CipherSuite)
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	extra["tls_cert_subject"] = cert.Subject.String()
+	extra["tls_cert_issuer"] = cert.Issuer.String()
+	extra["tls_cert_not_after"] = cert.NotAfter.Format(time.RFC3339)
+	extra["tls_cert_expires_in_hours"] = time.Until(cert.NotAfter).Hours()
+}
+
+// listServices emits the services the server lists through reflection. The
+// v1alpha protocol is used for servers not supporting v1.
+func (g *MontimeGRPC) listServices(acc telegraf.Accumulator) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(g.Timeout))
+	defer cancel()
+
+	fields := make(map[string]interface{})
+	services, err := g.reflect(ctx)
+	if status.Code(err) == codes.Unimplemented {
+		services, err = g.reflectAlpha(ctx)
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else {
+		sort.Strings(services)
+		fields["services"] = strings.Join(services, ",")
+		fields["service_count"] = len(services)
+	}
+	acc.AddFields(pluginName+"_reflection", fields, map[string]string{"domain": g.Domain})
+}
+
+func (g *MontimeGRPC) reflect(ctx context.Context) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(g.conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}
+	return reflectServices(stream, req, func(resp *reflectionpb.ServerReflectionResponse) (*reflectionpb.ErrorResponse, []*reflectionpb.ServiceResponse) {
+		return resp.GetErrorResponse(), resp.GetListServicesResponse().GetService()
+	})
+}
+
+func (g *MontimeGRPC) reflectAlpha(ctx context.Context) ([]string, error) {
+	stream, err := reflectionalphapb.NewServerReflectionClient(g.conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &reflectionalphapb.ServerReflectionRequest{
+		MessageRequest: &reflectionalphapb.ServerReflectionRequest_ListServices{},
+	}
+	return reflectServices(stream, req, func(resp *reflectionalphapb.ServerReflectionResponse) (*reflectionalphapb.ErrorResponse, []*reflectionalphapb.ServiceResponse) {
+		return resp.GetErrorResponse(), resp.GetListServicesResponse().GetService()
+	})
+}
+
+// reflectionStream is the reflection stream shared by the v1 and v1alpha
+// protocols, which only differ in the proto package of the messages.
+type reflectionStream[Req, Resp any] interface {
+	Send(Req) error
+	Recv() (Resp, error)
+	CloseSend() error
+}
+
+// reflectionError is the error response of either protocol.
+type reflectionError interface {
+	comparable
+	GetErrorMessage() string
+}
+
+// reflectionService is a listed service of either protocol.
+type reflectionService interface {
+	GetName() string
+}
+
+// reflectServices sends the list services request over the stream and returns
+// the names of the services, split is mapping the response of the protocol
+// to its error and services.
+func reflectServices[Req, Resp any, E reflectionError, S reflectionService](stream reflectionStream[Req, Resp], req Req, split func(Resp) (E, []S)) ([]string, error) {
+	defer stream.CloseSend() //nolint:errcheck // the stream is done anyway
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	e, list := split(resp)
+	var none E
+	if e != none {
+		return nil, errors.New(e.GetErrorMessage())
+	}
+	services := make([]string, 0, len(list))
+	for _, s := range list {
+		services = append(services, s.GetName())
+	}
+	return services, nil
+}
+
+// addFields emits the GRPCData fields merged with the extra fields, tagged
+// with the service unless the server itself was checked.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*GRPCData], extra map[string]interface{}, service string) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	if service != "" {
+		t["service"] = service
+	}
+	acc.AddFields(pluginName, data, t)
+}
+
+func init() {
+	inputs.Add(pluginName, func() telegraf.Input {
+		return &MontimeGRPC{}
+	})
+}
@@ -0,0 +1,243 @@
+package deepmon_grpc
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf/config"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
+	"github.com/influxdata/telegraf/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newServer starts a server with the health and reflection services on a
+// random local port
+func newServer(t *testing.T, opts ...grpc.ServerOption) (*health.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer(opts...)
+	hs := health.NewServer()
+	hs.SetServingStatus("orders.v1.Orders", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("billing.v1.Billing", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, hs)
+	reflection.Register(server)
+	go server.Serve(listener) //nolint:errcheck // ends with the test
+	t.Cleanup(server.Stop)
+
+	return hs, listener.Addr().String()
+}
+
+// gather returns the fields by service
+func gather(t *testing.T, g *MontimeGRPC) map[string]map[string]interface{} {
+	var acc testutil.Accumulator
+	require.NoError(t, g.Gather(&acc))
+	fields := make(map[string]map[string]interface{})
+	for _, m := range acc.Metrics {
+		if m.Measurement == pluginName {
+			fields[m.Tags["service"]] = m.Fields
+		}
+	}
+	return fields
+}
+
+func TestHealth(t *testing.T) {
+	_, addr := newServer(t)
+	g := &MontimeGRPC{
+		Domain:   addr,
+		Services: []string{"", "orders.v1.Orders", "billing.v1.Billing", "unknown.v1.Unknown"},
+		Log:      testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.Equal(t, "127.0.0.1", g.Domain)
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	fields := gather(t, g)
+	require.Len(t, fields, 4)
+	require.EqualValues(t, monitors.Success, fields[""]["result"])
+	require.Equal(t, "SERVING", fields[""]["status"])
+	require.Equal(t, addr, fields[""]["remote_addr"])
+	require.NotContains(t, fields[""], "tls_version")
+
+	require.EqualValues(t, monitors.Success, fields["orders.v1.Orders"]["result"])
+	require.EqualValues(t, monitors.Failed, fields["billing.v1.Billing"]["result"])
+	require.Equal(t, "NOT_SERVING", fields["billing.v1.Billing"]["status"])
+	require.EqualValues(t, monitors.Failed, fields["unknown.v1.Unknown"]["result"])
+	require.Equal(t, "SERVICE_UNKNOWN", fields["unknown.v1.Unknown"]["status"])
+	require.Contains(t, fields["unknown.v1.Unknown"], "error")
+}
+
+func TestUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	g := &MontimeGRPC{
+		Domain:     addr,
+		Timeout:    config.Duration(2 * time.Second),
+		Reflection: true,
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	var acc testutil.Accumulator
+	require.NoError(t, g.Gather(&acc))
+	require.Len(t, acc.Metrics, 2)
+	fields := acc.Metrics[0].Fields
+	require.EqualValues(t, monitors.ConnectionFailed, fields["result"])
+	require.Equal(t, STATUS_Error, fields["status"])
+	require.Contains(t, acc.Metrics[1].Fields, "error")
+}
+
+func TestUnimplemented(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	go server.Serve(listener) //nolint:errcheck // ends with the test
+	defer server.Stop()
+
+	g := &MontimeGRPC{
+		Domain: listener.Addr().String(),
+		Log:    testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	fields := gather(t, g)[""]
+	require.EqualValues(t, monitors.Failed, fields["result"])
+	require.Equal(t, STATUS_Unimplemented, fields["status"])
+}
+
+func TestWatch(t *testing.T) {
+	hs, addr := newServer(t)
+	g := &MontimeGRPC{
+		Domain:   addr,
+		Services: []string{"orders.v1.Orders"},
+		Watch:    true,
+		Log:      testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	// The initial status is streamed when the watch is opened
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.watched["orders.v1.Orders"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The service flaps between the gathers
+	hs.SetServingStatus("orders.v1.Orders", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("orders.v1.Orders", healthpb.HealthCheckResponse_SERVING)
+	require.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.watched["orders.v1.Orders"].changes == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	fields := gather(t, g)["orders.v1.Orders"]
+	require.EqualValues(t, monitors.Success, fields["result"])
+	require.Equal(t, "SERVING", fields["watch_status"])
+	require.Equal(t, 2, fields["watch_changes"])
+
+	// The changes are counted per gather
+	require.Equal(t, 0, gather(t, g)["orders.v1.Orders"]["watch_changes"])
+}
+
+func TestReflection(t *testing.T) {
+	_, addr := newServer(t)
+	g := &MontimeGRPC{
+		Domain:     addr,
+		Reflection: true,
+		Log:        testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	var acc testutil.Accumulator
+	require.NoError(t, g.Gather(&acc))
+	m, found := acc.Get(pluginName + "_reflection")
+	require.True(t, found)
+	require.Equal(t, map[string]string{"domain": "127.0.0.1"}, m.Tags)
+	require.Equal(t, "grpc.health.v1.Health,grpc.reflection.v1.ServerReflection,grpc.reflection.v1alpha.ServerReflection", m.Fields["services"])
+	require.Equal(t, 3, m.Fields["service_count"])
+}
+
+func TestTLS(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../../../testutil/pki/servercert.pem", "../../../testutil/pki/serverkey.pem")
+	require.NoError(t, err)
+	creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	_, addr := newServer(t, grpc.Creds(creds))
+
+	g := &MontimeGRPC{
+		Domain: addr,
+		ClientConfig: tlsint.ClientConfig{
+			TLSCA: "../../../testutil/pki/cacert.pem",
+		},
+		Log: testutil.Logger{},
+	}
+	require.NoError(t, g.Init())
+	require.NoError(t, g.Start(nil))
+	defer g.Stop()
+
+	fields := gather(t, g)[""]
+	require.EqualValues(t, monitors.Success, fields["result"])
+	require.Equal(t, "TLS 1.3", fields["tls_version"])
+	require.Equal(t, "CN=localhost", fields["tls_cert_subject"])
+	require.Contains(t, fields, "tls_cert_expires_in_hours")
+
+	// A plaintext client cannot talk to the server
+	plain := &MontimeGRPC{
+		Domain:  addr,
+		Timeout: config.Duration(2 * time.Second),
+		Log:     testutil.Logger{},
+	}
+	require.NoError(t, plain.Init())
+	require.NoError(t, plain.Start(nil))
+	defer plain.Stop()
+	require.NotEqualValues(t, monitors.Success, gather(t, plain)[""]["result"])
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   *MontimeGRPC
+		expected string
+	}{
+		{"no domain", &MontimeGRPC{Port: 443}, "domain cannot be empty"},
+		{"no port", &MontimeGRPC{Domain: "example.com"}, "port must be between"},
+		{"invalid port", &MontimeGRPC{Domain: "example.com:grpc"}, "invalid port"},
+		{"invalid domain", &MontimeGRPC{Domain: "exa mple..com", Port: 443}, "invalid domain"},
+		{
+			"duplicate service",
+			&MontimeGRPC{Domain: "example.com", Port: 443, Services: []string{"a", "a"}},
+			"duplicate service",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorContains(t, tt.plugin.Init(), tt.expected)
+		})
+	}
+
+	g := &MontimeGRPC{Domain: "example.com", Port: 443}
+	require.NoError(t, g.Init())
+	require.Equal(t, []string{""}, g.Services)
+	require.Equal(t, config.Duration(5*time.Second), g.Timeout)
+}
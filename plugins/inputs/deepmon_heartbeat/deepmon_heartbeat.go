@@ -0,0 +1,389 @@
+//go:generate ../../../tools/readme_config_includer/generator
+package deepmon_heartbeat
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
+	"github.com/influxdata/telegraf/plugins/inputs"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+// The monitors package has no type for push monitoring yet
+const pluginName = "deepmon_heartbeat"
+
+// Ping variants, appended to the token URL
+const (
+	PING_Success = ""
+	PING_Start   = "start"
+	PING_Fail    = "fail"
+)
+
+type MontimeHeartbeat struct {
+	ServiceAddress string          `toml:"service_address"`
+	PathPrefix     string          `toml:"path_prefix"`
+	ReadTimeout    config.Duration `toml:"read_timeout"`
+	WriteTimeout   config.Duration `toml:"write_timeout"`
+	Checks         []*Check        `toml:"check"`
+	tlsint.ServerConfig
+
+	Log telegraf.Logger `toml:"-"`
+
+	tlsConf  *tls.Config
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	// now returns the current time, replaced for testing
+	now func() time.Time
+
+	// heartbeats of the checks, persisted across restarts
+	mu         sync.Mutex
+	heartbeats heartbeats
+}
+
+// Check is a job pinging its token URL at least once per period.
+type Check struct {
+	Name   string            `toml:"name"`
+	Token  config.Secret     `toml:"token"`
+	Period config.Duration   `toml:"period"`
+	Grace  config.Duration   `toml:"grace"`
+	Tags   map[string]string `toml:"tags"`
+}
+
+// HeartbeatData is the state of a check at the time of the gather.
+type HeartbeatData struct {
+	Result  monitors.Result
+	Missed  bool
+	Running bool
+}
+
+// heartbeats holds the pings of every check by its name.
+type heartbeats map[string]*heartbeat
+
+// heartbeat is the last ping of a check and its running job.
+type heartbeat struct {
+	// Time the check was first gathered, the first deadline starts here
+	Added    time.Time `json:"added"`
+	LastPing time.Time `json:"last_ping,omitempty"`
+	Failed   bool      `json:"failed"`
+	// Start of the running job, zero if no job is running
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// Duration of the last job reporting its start
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+func (*MontimeHeartbeat) SampleConfig() string {
+	return sampleConfig
+}
+
+func (h *MontimeHeartbeat) Init() error {
+	if len(h.Checks) == 0 {
+		return errors.New("at least one check is required")
+	}
+	if h.ServiceAddress == "" {
+		h.ServiceAddress = ":8090"
+	}
+	h.PathPrefix = "/" + strings.Trim(h.PathPrefix, "/")
+	if h.ReadTimeout < config.Duration(time.Second) {
+		h.ReadTimeout = config.Duration(10 * time.Second)
+	}
+	if h.WriteTimeout < config.Duration(time.Second) {
+		h.WriteTimeout = config.Duration(10 * time.Second)
+	}
+
+	names := make(map[string]bool, len(h.Checks))
+	tokens := make(map[string]bool, len(h.Checks))
+	for _, c := range h.Checks {
+		if c.Name == "" {
+			return errors.New("check name is required")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate check %q", c.Name)
+		}
+		names[c.Name] = true
+		if c.Period <= 0 {
+			return fmt.Errorf("period of check %q must be positive", c.Name)
+		}
+		if c.Grace < 0 {
+			return fmt.Errorf("grace of check %q must not be negative", c.Name)
+		}
+		if c.Token.Empty() {
+			return fmt.Errorf("token of check %q is required", c.Name)
+		}
+		token, err := c.Token.Get()
+		if err != nil {
+			return fmt.Errorf("getting token of check %q failed: %w", c.Name, err)
+		}
+		t := token.String()
+		token.Destroy()
+		if strings.Contains(t, "/") {
+			return fmt.Errorf("token of check %q must not contain a slash", c.Name)
+		}
+		if tokens[t] {
+			return fmt.Errorf("token of check %q is already used", c.Name)
+		}
+		tokens[t] = true
+	}
+
+	tlsConf, err := h.ServerConfig.TLSConfig()
+	if err != nil {
+		return err
+	}
+	h.tlsConf = tlsConf
+
+	if h.now == nil {
+		h.now = time.Now
+	}
+	// States are restored before the plugin is initialized, checks no longer
+	// configured are dropped
+	if h.heartbeats == nil {
+		h.heartbeats = make(heartbeats, len(h.Checks))
+	}
+	for name := range h.heartbeats {
+		if !names[name] {
+			delete(h.heartbeats, name)
+		}
+	}
+	return nil
+}
+
+// Start starts the listener for the pings.
+func (h *MontimeHeartbeat) Start(telegraf.Accumulator) error {
+	var listener net.Listener
+	var err error
+	if h.tlsConf != nil {
+		listener, err = tls.Listen("tcp", h.ServiceAddress, h.tlsConf)
+	} else {
+		listener, err = net.Listen("tcp", h.ServiceAddress)
+	}
+	if err != nil {
+		return err
+	}
+	h.listener = listener
+
+	server := &http.Server{
+		Handler:      h,
+		ReadTimeout:  time.Duration(h.ReadTimeout),
+		WriteTimeout: time.Duration(h.WriteTimeout),
+		TLSConfig:    h.tlsConf,
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := server.Serve(h.listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			h.Log.Errorf("Serve failed: %v", err)
+		}
+	}()
+
+	h.Log.Infof("Listening on %s", h.listener.Addr().String())
+	return nil
+}
+
+// Stop closes the listener.
+func (h *MontimeHeartbeat) Stop() {
+	if h.listener != nil {
+		h.listener.Close()
+	}
+	h.wg.Wait()
+}
+
+// ServeHTTP records the pings sent to "<path_prefix>/<token>[/start|/fail]".
+func (h *MontimeHeartbeat) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodPost, http.MethodHead:
+	default:
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest, found := strings.CutPrefix(req.URL.Path, strings.TrimSuffix(h.PathPrefix, "/")+"/")
+	if !found {
+		http.NotFound(res, req)
+		return
+	}
+	token, variant, _ := strings.Cut(rest, "/")
+	switch variant {
+	case PING_Success, PING_Start, PING_Fail:
+	default:
+		http.NotFound(res, req)
+		return
+	}
+	check, err := h.lookup(token)
+	if err != nil {
+		h.Log.Errorf("Looking up check failed: %v", err)
+		http.Error(res, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if check == nil {
+		http.NotFound(res, req)
+		return
+	}
+
+	h.ping(check.Name, variant, h.now())
+	res.Header().Set("Content-Type", "text/plain")
+	_, _ = res.Write([]byte("OK"))
+}
+
+// lookup returns the check of the token, nil if there is none.
+func (h *MontimeHeartbeat) lookup(token string) (*Check, error) {
+	if token == "" {
+		return nil, nil
+	}
+	for _, c := range h.Checks {
+		secret, err := c.Token.Get()
+		if err != nil {
+			return nil, fmt.Errorf("getting token of check %q failed: %w", c.Name, err)
+		}
+		match := subtle.ConstantTimeCompare(secret.Bytes(), []byte(token)) == 1
+		secret.Destroy()
+		if match {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// ping records the ping of the check, finishing pings measure the duration of
+// the job since its start.
+func (h *MontimeHeartbeat) ping(name, variant string, t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hb := h.heartbeat(name, t)
+	if variant == PING_Start {
+		hb.StartedAt = t
+		return
+	}
+	hb.LastPing = t
+	hb.Failed = variant == PING_Fail
+	if !hb.StartedAt.IsZero() {
+		hb.Duration = t.Sub(hb.StartedAt)
+		hb.StartedAt = time.Time{}
+	}
+}
+
+// heartbeat returns the heartbeat of the check, added at the given time if it
+// is not known yet. The lock has to be held.
+func (h *MontimeHeartbeat) heartbeat(name string, t time.Time) *heartbeat {
+	hb, found := h.heartbeats[name]
+	if !found {
+		hb = &heartbeat{Added: t}
+		h.heartbeats[name] = hb
+	}
+	return hb
+}
+
+// Gather reports every check. A check misses its heartbeat if no ping arrived
+// within the period and grace time since the last one, or if a started job
+// did not finish within the grace time, or the period if no grace is set.
+func (h *MontimeHeartbeat) Gather(acc telegraf.Accumulator) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	for _, c := range h.Checks {
+		hb := h.heartbeat(c.Name, now)
+
+		fields := &HeartbeatData{
+			Result:  monitors.Success,
+			Running: !hb.StartedAt.IsZero(),
+		}
+		tags := monitors.MonitorData[*HeartbeatData]{
+			Domain: c.Name,
+			Data:   fields,
+		}
+		extra := make(map[string]interface{})
+
+		since := hb.LastPing
+		if since.IsZero() {
+			since = hb.Added
+		}
+		grace := time.Duration(c.Grace)
+		running := grace
+		if running == 0 {
+			running = time.Duration(c.Period)
+		}
+		switch {
+		case now.After(since.Add(time.Duration(c.Period) + grace)):
+			fields.Result = monitors.Timeout
+			fields.Missed = true
+		case fields.Running && now.After(hb.StartedAt.Add(running)):
+			fields.Result = monitors.Timeout
+			fields.Missed = true
+		case hb.Failed:
+			fields.Result = monitors.Failed
+		}
+
+		if !hb.LastPing.IsZero() {
+			extra["last_ping"] = hb.LastPing.Unix()
+			extra["since_last_ping"] = now.Sub(hb.LastPing).Seconds()
+		}
+		if hb.Duration > 0 {
+			extra["duration_ms"] = float64(hb.Duration) / float64(time.Millisecond)
+		}
+		addFields(acc, tags, extra, c.Tags)
+	}
+	return nil
+}
+
+func (h *MontimeHeartbeat) GetState() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.heartbeats
+}
+
+func (h *MontimeHeartbeat) SetState(state interface{}) error {
+	restored, ok := state.(heartbeats)
+	if !ok {
+		return errors.New("state has to be of type 'heartbeats'")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.heartbeats == nil {
+		h.heartbeats = make(heartbeats, len(restored))
+	}
+	for name, hb := range restored {
+		if hb != nil {
+			h.heartbeats[name] = hb
+		}
+	}
+	return nil
+}
+
+// addFields emits the HeartbeatData fields merged with the extra fields and
+// the tags of the check.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*HeartbeatData], extra map[string]interface{}, checkTags map[string]string) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	for k, v := range checkTags {
+		t[k] = v
+	}
+	acc.AddFields(pluginName, data, t)
+}
+
+func init() {
+	inputs.Add(pluginName, func() telegraf.Input {
+		return &MontimeHeartbeat{
+			ServiceAddress: ":8090",
+			PathPrefix:     "/ping",
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package deepmon_heartbeat
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// clock is a settable time source
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newHeartbeat(c *clock) *MontimeHeartbeat {
+	return &MontimeHeartbeat{
+		ServiceAddress: "127.0.0.1:0",
+		PathPrefix:     "/ping",
+		Checks: []*Check{
+			{
+				Name:   "backup",
+				Token:  config.NewSecret([]byte("backup-token")),
+				Period: config.Duration(time.Hour),
+				Grace:  config.Duration(10 * time.Minute),
+				Tags:   map[string]string{"customer": "acme"},
+			},
+		},
+		Log: testutil.Logger{},
+		now: c.now,
+	}
+}
+
+func get(t *testing.T, h *MontimeHeartbeat, path string) int {
+	resp, err := http.Get("http://" + h.listener.Addr().String() + path)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// gather returns the fields of the backup check
+func gather(t *testing.T, h *MontimeHeartbeat) map[string]interface{} {
+	var acc testutil.Accumulator
+	require.NoError(t, h.Gather(&acc))
+	require.Len(t, acc.Metrics, 1)
+	m := acc.Metrics[0]
+	require.Equal(t, pluginName, m.Measurement)
+	require.Equal(t, map[string]string{"domain": "backup", "customer": "acme"}, m.Tags)
+	return m.Fields
+}
+
+func TestPings(t *testing.T) {
+	c := &clock{t: start}
+	h := newHeartbeat(c)
+	require.NoError(t, h.Init())
+	require.NoError(t, h.Start(nil))
+	defer h.Stop()
+
+	// Within the first period without a ping
+	fields := gather(t, h)
+	require.EqualValues(t, monitors.Success, fields["result"])
+	require.NotContains(t, fields, "last_ping")
+
+	require.Equal(t, http.StatusOK, get(t, h, "/ping/backup-token"))
+	c.t = start.Add(time.Minute)
+	fields = gather(t, h)
+	require.EqualValues(t, monitors.Success, fields["result"])
+	require.Equal(t, start.Unix(), fields["last_ping"])
+	require.InDelta(t, 60.0, fields["since_last_ping"], 0)
+
+	// A job reporting its start is measured
+	require.Equal(t, http.StatusOK, get(t, h, "/ping/backup-token/start"))
+	require.Equal(t, true, gather(t, h)["running"])
+	c.t = start.Add(3 * time.Minute)
+	require.Equal(t, http.StatusOK, get(t, h, "/ping/backup-token/fail"))
+	fields = gather(t, h)
+	require.EqualValues(t, monitors.Failed, fields["result"])
+	require.Equal(t, false, fields["running"])
+	require.InDelta(t, 120000.0, fields["duration_ms"], 0)
+
+	// Unknown tokens and variants
+	require.Equal(t, http.StatusNotFound, get(t, h, "/ping/other-token"))
+	require.Equal(t, http.StatusNotFound, get(t, h, "/ping/backup-token/unknown"))
+	require.Equal(t, http.StatusNotFound, get(t, h, "/backup-token"))
+	req, err := http.NewRequest(http.MethodDelete, "http://"+h.listener.Addr().String()+"/ping/backup-token", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestMissed(t *testing.T) {
+	c := &clock{t: start}
+	h := newHeartbeat(c)
+	require.NoError(t, h.Init())
+
+	// A check never pinging misses its first deadline
+	require.EqualValues(t, monitors.Success, gather(t, h)["result"])
+	c.t = start.Add(71 * time.Minute)
+	fields := gather(t, h)
+	require.EqualValues(t, monitors.Timeout, fields["result"])
+	require.Equal(t, true, fields["missed"])
+
+	h.ping("backup", PING_Success, c.t)
+	require.EqualValues(t, monitors.Success, gather(t, h)["result"])
+
+	// The grace time has passed
+	c.t = c.t.Add(71 * time.Minute)
+	require.Equal(t, true, gather(t, h)["missed"])
+
+	// A started job not finishing within the grace time
+	h.ping("backup", PING_Success, c.t)
+	h.ping("backup", PING_Start, c.t)
+	c.t = c.t.Add(11 * time.Minute)
+	fields = gather(t, h)
+	require.EqualValues(t, monitors.Timeout, fields["result"])
+	require.Equal(t, true, fields["running"])
+}
+
+func TestRunningWithoutGrace(t *testing.T) {
+	c := &clock{t: start}
+	h := newHeartbeat(c)
+	h.Checks[0].Grace = 0
+	require.NoError(t, h.Init())
+
+	// A started job may run for the period without a grace time
+	h.ping("backup", PING_Start, c.t)
+	c.t = start.Add(30 * time.Minute)
+	fields := gather(t, h)
+	require.EqualValues(t, monitors.Success, fields["result"])
+	require.Equal(t, true, fields["running"])
+	require.Equal(t, false, fields["missed"])
+
+	c.t = start.Add(61 * time.Minute)
+	fields = gather(t, h)
+	require.EqualValues(t, monitors.Timeout, fields["result"])
+	require.Equal(t, true, fields["missed"])
+}
+
+func TestState(t *testing.T) {
+	c := &clock{t: start}
+	h := newHeartbeat(c)
+	require.NoError(t, h.Init())
+	h.ping("backup", PING_Start, start)
+	h.ping("backup", PING_Success, start.Add(time.Minute))
+
+	serialized, err := json.Marshal(h.GetState())
+	require.NoError(t, err)
+	var state heartbeats
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	// The last ping is kept across a restart, checks no longer configured are
+	// dropped
+	state["removed"] = &heartbeat{Added: start}
+	restarted := newHeartbeat(c)
+	require.NoError(t, restarted.SetState(state))
+	require.NoError(t, restarted.Init())
+	require.NotContains(t, restarted.heartbeats, "removed")
+
+	c.t = start.Add(2 * time.Hour)
+	fields := gather(t, restarted)
+	require.Equal(t, true, fields["missed"])
+	require.Equal(t, start.Add(time.Minute).Unix(), fields["last_ping"])
+	require.InDelta(t, 60000.0, fields["duration_ms"], 0)
+
+	require.ErrorContains(t, restarted.SetState(map[string]int{}), "state has to be of type")
+}
+
+func TestInit(t *testing.T) {
+	c := &clock{t: start}
+	h := newHeartbeat(c)
+	h.Checks = nil
+	require.ErrorContains(t, h.Init(), "at least one check")
+
+	h = newHeartbeat(c)
+	h.Checks = append(h.Checks, &Check{
+		Name:   "other",
+		Token:  config.NewSecret([]byte("backup-token")),
+		Period: config.Duration(time.Hour),
+	})
+	require.ErrorContains(t, h.Init(), "already used")
+
+	h = newHeartbeat(c)
+	h.Checks[0].Period = 0
+	require.ErrorContains(t, h.Init(), "period")
+
+	h = newHeartbeat(c)
+	h.Checks[0].Token = config.NewSecret([]byte("a/b"))
+	require.ErrorContains(t, h.Init(), "slash")
+}
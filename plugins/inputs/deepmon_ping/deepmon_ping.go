@@ -2,16 +2,22 @@
 package deepmon_ping
 
 import (
+	"context"
 	_ "embed"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/plugins/common/targets"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	ping "github.com/prometheus-community/pro-bing"
 	"golang.org/x/net/idna"
@@ -26,26 +32,83 @@ type MontimePinger struct {
 	Domain string `toml:"domain"`
 	Count  int    `toml:"count"`
 	// Timeout is the maximum amount of time a ping will wait for a response.
-	Timeout int `toml:"timeout"`
+	Timeout config.Duration `toml:"timeout"`
+	// PingInterval is the time between sending the pings.
+	PingInterval config.Duration `toml:"ping_interval"`
 	// Size is the number of bytes to send in the ICMP packet.
 	Size int `toml:"packet_size"`
+	// Privileged sends raw ICMP packets instead of unprivileged datagrams.
+	Privileged bool `toml:"privileged"`
+	// Interface name or source address to send the pings from.
+	Interface string `toml:"interface"`
+	// PerProbe emits the round-trip time of every single ping.
+	PerProbe bool `toml:"per_probe"`
+	targets.Batch
+	dualstack.Stack
+
+	sourceAddress string
 }
 
 const defaultCount = 3
 const defaultSize = 24
 
+// minInterval is the shortest interval accepted by the kernel for
+// unprivileged users.
+const minInterval = 200 * time.Millisecond
+
 func (p *MontimePinger) Init() error {
+	if p.HasTargets() {
+		return p.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *p
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			return &child, child.Init()
+		})
+	}
 	if _, err := idna.Lookup.ToASCII(p.Domain); err != nil || p.Domain == "" {
 		return errors.New("domain is missing or invalid")
 	}
 	if p.Count == 0 {
 		p.Count = defaultCount
 	}
+	if p.Count < 0 {
+		return errors.New("count must be positive")
+	}
 	if p.Size == 0 {
 		p.Size = defaultSize
 	}
 	if p.Timeout == 0 {
-		p.Timeout = 1
+		p.Timeout = config.Duration(time.Second)
+	}
+	if p.PingInterval == 0 {
+		p.PingInterval = config.Duration(time.Second)
+	}
+	if time.Duration(p.PingInterval) < minInterval {
+		return fmt.Errorf("ping_interval has to be at least %s", minInterval)
+	}
+	if err := p.InitStack(); err != nil {
+		return err
+	}
+
+	// Support either an IP address or interface name
+	p.sourceAddress = ""
+	if p.Interface != "" {
+		if addr := net.ParseIP(p.Interface); addr != nil {
+			p.sourceAddress = p.Interface
+		} else {
+			i, err := net.InterfaceByName(p.Interface)
+			if err != nil {
+				return fmt.Errorf("failed to get interface: %w", err)
+			}
+			addrs, err := i.Addrs()
+			if err != nil {
+				return fmt.Errorf("failed to get the address of interface: %w", err)
+			}
+			if len(addrs) == 0 {
+				return fmt.Errorf("no address found for interface %s", p.Interface)
+			}
+			p.sourceAddress = addrs[0].(*net.IPNet).IP.String()
+		}
 	}
 	return nil
 }
@@ -58,6 +121,9 @@ func (p *MontimePinger) SampleConfig() string {
 }
 
 func (p *MontimePinger) Gather(acc telegraf.Accumulator) error {
+	if p.HasTargets() {
+		return p.GatherTargets(acc)
+	}
 	p.sendData(acc)
 	return nil
 }
@@ -68,96 +134,239 @@ func init() {
 	})
 }
 
+// probe is a single ping, lost unless its reply was received.
+type probe struct {
+	seq      int
+	received bool
+	rtt      time.Duration
+}
+
 type pingStats struct {
 	ping.Statistics
-	ttl int
+	ttl    int
+	probes []*probe
+	// rtts in the order the replies were received
+	rtts []time.Duration
 }
 
-func (p *MontimePinger) goping() (*pingStats, error) {
-	ps := &pingStats{}
+// network returns the address family selected by the ip_version option.
+func (p *MontimePinger) network() string {
+	return p.Network("ip")
+}
 
-	//set NewPing
-	pinger, err := ping.NewPinger(p.Domain)
+// resolve looks up the address of the domain in the configured address
+// family, preferring IPv4 if both are allowed.
+func (p *MontimePinger) resolve() (*net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Timeout))
+	defer cancel()
+	addrs, err := p.LookupIPAddr(ctx, p.Domain)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new pinger: %w", err)
+		return nil, err
+	}
+	network := p.network()
+	var found *net.IPAddr
+	for i, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if (network == "ip4" && !isIPv4) || (network == "ip6" && isIPv4) {
+			continue
+		}
+		if found == nil || (isIPv4 && found.IP.To4() == nil) {
+			found = &addrs[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s address found for %s", network, p.Domain)
 	}
-	// pinger.SetPrivileged(true)
+	return found, nil
+}
+
+func (p *MontimePinger) goping(addr *net.IPAddr) (*pingStats, error) {
+	ps := &pingStats{}
+
+	//set NewPing
+	pinger := ping.New("")
+	pinger.SetNetwork(p.network())
+	pinger.SetIPAddr(addr)
+	pinger.SetPrivileged(p.Privileged)
 
 	//struct options
+	pinger.Count = p.Count
+	pinger.Size = p.Size
+	pinger.Interval = time.Duration(p.PingInterval)
+	pinger.Source = p.sourceAddress
+	// The last ping gets the full timeout to be answered
+	pinger.Timeout = time.Duration(p.PingInterval)*time.Duration(p.Count-1) + time.Duration(p.Timeout)
 
-	// Get Time to live (TTL) of first response, matching original implementation
-	once := &sync.Once{}
+	probes := make(map[int]*probe, p.Count)
+	pinger.OnSend = func(pkt *ping.Packet) {
+		pr := &probe{seq: pkt.Seq}
+		probes[pkt.Seq] = pr
+		ps.probes = append(ps.probes, pr)
+	}
 	pinger.OnRecv = func(pkt *ping.Packet) {
-		once.Do(func() {
+		// Get Time to live (TTL) of first response, matching original implementation
+		if len(ps.rtts) == 0 {
 			ps.ttl = pkt.TTL // Buraya bak
-		})
+		}
+		ps.rtts = append(ps.rtts, pkt.Rtt)
+		if pr, found := probes[pkt.Seq]; found {
+			pr.received = true
+			pr.rtt = pkt.Rtt
+		}
 	}
-	err = pinger.Run()
+	err := pinger.Run()
 	if err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") || strings.Contains(err.Error(), "permission denied") {
+			return nil, errors.New("permission changes required, enable CAP_NET_RAW capabilities or allow unprivileged pings")
+		}
 		return nil, fmt.Errorf("failed to run pinger: %w", err)
 	}
 	ps.Statistics = *pinger.Statistics()
 	return ps, nil
 }
 
+// jitter is the mean absolute difference between consecutive round-trip
+// times.
+func jitter(rtts []time.Duration) (time.Duration, bool) {
+	if len(rtts) < 2 {
+		return 0, false
+	}
+	var sum float64
+	for i := 1; i < len(rtts); i++ {
+		sum += math.Abs(float64(rtts[i] - rtts[i-1]))
+	}
+	return time.Duration(sum / float64(len(rtts)-1)), true
+}
+
 func (p *MontimePinger) sendData(acc telegraf.Accumulator) {
+	if p.Both() {
+		p.sendBoth(acc)
+		return
+	}
 	fields := &monitors.PingData{}
 	tags := monitors.MonitorData[*monitors.PingData]{
 		Domain: p.Domain,
 		Data:   fields,
 	}
-	stats, err := p.goping()
+	extra := make(map[string]interface{})
+
+	start := time.Now()
+	addr, err := p.resolve()
 	if err != nil {
-		if strings.Contains(err.Error(), "unknown") {
-			fields.Result = monitors.NoPacketsSent
-		} else {
-			fields.Result = monitors.NoPacketsReceived
+		fields.Result = monitors.NoPacketsSent
+		extra["error"] = err.Error()
+		addFields(acc, tags, extra, nil)
+		return
+	}
+	extra["dns_resolution_ms"] = float64(time.Since(start)) / float64(time.Millisecond)
+	p.ping(acc, addr, fields, extra)
+	addFields(acc, tags, extra, nil)
+}
+
+// sendBoth pings every IPv4 and IPv6 address of the domain on its own and
+// judges the reachability of the address families.
+func (p *MontimePinger) sendBoth(acc telegraf.Accumulator) {
+	var report dualstack.Report
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Timeout))
+	ips, err := p.Resolve(ctx, p.Domain)
+	cancel()
+	if err != nil {
+		tags := monitors.MonitorData[*monitors.PingData]{
+			Domain: p.Domain,
+			Data:   &monitors.PingData{Result: monitors.NoPacketsSent},
 		}
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
+		addFields(acc, tags, map[string]interface{}{"error": err.Error()}, nil)
+		report.AddTo(acc, pluginName, p.Domain)
 		return
 	}
 
-	// fields = map[string]interface{}{
-	// 	"result_code":         0,
-	// 	"packets_transmitted": stats.PacketsSent,
-	// 	"packets_received":    stats.PacketsRecv,
-	// }
+	for _, ip := range ips {
+		fields := &monitors.PingData{}
+		tags := monitors.MonitorData[*monitors.PingData]{
+			Domain: p.Domain,
+			Data:   fields,
+		}
+		extra := make(map[string]interface{})
+		p.ping(acc, &net.IPAddr{IP: ip}, fields, extra)
+		report.Add(ip, fields.Result == monitors.Success)
+		addFields(acc, tags, extra, ip)
+	}
+	report.AddTo(acc, pluginName, p.Domain)
+}
+
+// ping sends the pings to the address and fills the PingData.
+func (p *MontimePinger) ping(acc telegraf.Accumulator, addr *net.IPAddr, fields *monitors.PingData, extra map[string]interface{}) {
+	fields.IPAddress = addr.String()
+
+	stats, err := p.goping(addr)
+	if err != nil {
+		fields.Result = monitors.NoPacketsSent
+		extra["error"] = err.Error()
+		return
+	}
+	if p.PerProbe {
+		p.addProbes(acc, addr, stats.probes)
+	}
 
 	fields.Result = monitors.Success
 	fields.PacketsTransmitted = stats.PacketsSent
 	fields.PacketsReceived = stats.PacketsRecv
-	fields.IPAddress = stats.IPAddr.String()
 
 	if stats.PacketsSent == 0 {
 		fields.Result = monitors.NoPacketsSent
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
 		return
 	}
 
 	if stats.PacketsRecv == 0 {
 		fields.Result = monitors.NoPacketsReceived
 		fields.PercentPacketLoss = 100
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
 		return
 	}
 
 	// Set TTL only on supported platform. See golang.org/x/net/ipv4/payload_cmsg.go
 	switch runtime.GOOS {
 	case "aix", "darwin", "dragonfly", "freebsd", "linux", "netbsd", "openbsd", "solaris":
-		// fields["ttl"] = stats.ttl
 		fields.TTL = stats.ttl
 	}
 
-	// fields["percent_packet_loss"] = float64(stats.PacketLoss)
-	// fields["minimum_response_ms"] = float64(stats.MinRtt) / float64(time.Millisecond)
-	// fields["average_response_ms"] = float64(stats.AvgRtt) / float64(time.Millisecond)
-	// fields["maximum_response_ms"] = float64(stats.MaxRtt) / float64(time.Millisecond)
-	// fields["standard_deviation_ms"] = float64(stats.StdDevRtt) / float64(time.Millisecond)
-
 	fields.PercentPacketLoss = float64(stats.PacketLoss)
 	fields.MinimumResponseMs = float64(stats.MinRtt) / float64(time.Millisecond)
 	fields.AverageResponseMs = float64(stats.AvgRtt) / float64(time.Millisecond)
 	fields.MaximumResponseMs = float64(stats.MaxRtt) / float64(time.Millisecond)
 	fields.StandardDeviationMs = float64(stats.StdDevRtt) / float64(time.Millisecond)
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
+	if j, ok := jitter(stats.rtts); ok {
+		extra["jitter_ms"] = float64(j) / float64(time.Millisecond)
+	}
+}
+
+// addProbes emits a metric per ping, lost pings have no round-trip time.
+func (p *MontimePinger) addProbes(acc telegraf.Accumulator, addr *net.IPAddr, probes []*probe) {
+	for _, pr := range probes {
+		fields := map[string]interface{}{
+			"received": pr.received,
+		}
+		if pr.received {
+			fields["rtt_ms"] = float64(pr.rtt) / float64(time.Millisecond)
+		}
+		acc.AddFields(pluginName+"_probe", fields, map[string]string{
+			"domain":     p.Domain,
+			"ip_address": addr.String(),
+			"seq":        strconv.Itoa(pr.seq),
+		})
+	}
+}
+
+// addFields emits the PingData fields merged with the extra fields, tagged
+// with the pinged address if one is given.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.PingData], extra map[string]interface{}, ip net.IP) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	if ip != nil {
+		t["ip_address"] = ip.String()
+		t["ip_version"] = dualstack.Version(ip)
+	}
+	acc.AddFields(pluginName, data, t)
 }
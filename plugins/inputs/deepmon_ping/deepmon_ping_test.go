@@ -0,0 +1,150 @@
+package deepmon_ping
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestJitter(t *testing.T) {
+	_, ok := jitter(nil)
+	require.False(t, ok)
+	_, ok = jitter([]time.Duration{10 * time.Millisecond})
+	require.False(t, ok)
+
+	j, ok := jitter([]time.Duration{10 * time.Millisecond, 14 * time.Millisecond, 12 * time.Millisecond, 12 * time.Millisecond})
+	require.True(t, ok)
+	require.Equal(t, 2*time.Millisecond, j)
+}
+
+func TestInit(t *testing.T) {
+	require.ErrorContains(t, (&MontimePinger{}).Init(), "domain is missing")
+	require.ErrorContains(t, (&MontimePinger{Domain: "localhost", PingInterval: config.Duration(time.Millisecond)}).Init(), "ping_interval")
+	require.ErrorContains(t, (&MontimePinger{Domain: "localhost", Interface: "nonexistent0"}).Init(), "interface")
+
+	plugin := &MontimePinger{Domain: "localhost", Interface: "127.0.0.1"}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, defaultCount, plugin.Count)
+	require.Equal(t, defaultSize, plugin.Size)
+	require.Equal(t, config.Duration(time.Second), plugin.Timeout)
+	require.Equal(t, config.Duration(time.Second), plugin.PingInterval)
+	require.Equal(t, "127.0.0.1", plugin.sourceAddress)
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		plugin   *MontimePinger
+		expected string
+	}{
+		{&MontimePinger{}, "ip"},
+		{&MontimePinger{Stack: dualstack.Stack{IPVersion: dualstack.VERSION_4}}, "ip4"},
+		{&MontimePinger{Stack: dualstack.Stack{IPVersion: dualstack.VERSION_6}}, "ip6"},
+		{&MontimePinger{Stack: dualstack.Stack{IPVersion: dualstack.VERSION_Both}}, "ip"},
+	}
+	for _, tt := range tests {
+		tt.plugin.Domain = "localhost"
+		require.NoError(t, tt.plugin.Init())
+		require.Equal(t, tt.expected, tt.plugin.network())
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	plugin := &MontimePinger{Domain: "localhost", Stack: dualstack.Stack{IPVersion: dualstack.VERSION_6}}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, "ip6", plugin.network())
+
+	plugin = &MontimePinger{Domain: "localhost", Stack: dualstack.Stack{IPVersion: "ipv6"}}
+	require.ErrorContains(t, plugin.Init(), "ip_version")
+}
+
+func TestResolve(t *testing.T) {
+	plugin := &MontimePinger{Domain: "127.0.0.1", Stack: dualstack.Stack{IPVersion: dualstack.VERSION_6}}
+	require.NoError(t, plugin.Init())
+	_, err := plugin.resolve()
+	require.ErrorContains(t, err, "no ip6 address")
+
+	plugin = &MontimePinger{Domain: "127.0.0.1", Stack: dualstack.Stack{IPVersion: dualstack.VERSION_4}}
+	require.NoError(t, plugin.Init())
+	addr, err := plugin.resolve()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", addr.String())
+}
+
+func TestGatherLoopback(t *testing.T) {
+	plugin := &MontimePinger{
+		Domain:       "127.0.0.1",
+		Count:        3,
+		PingInterval: config.Duration(200 * time.Millisecond),
+		Privileged:   true,
+		PerProbe:     true,
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	m, found := acc.Get(pluginName)
+	require.True(t, found)
+	if e, ok := m.Fields["error"].(string); ok && strings.Contains(e, "permission") {
+		t.Skip("sending ICMP packets is not permitted")
+	}
+	require.Contains(t, m.Fields, "dns_resolution_ms")
+	require.Contains(t, m.Fields, "jitter_ms")
+	require.Equal(t, 3, m.Fields["packets_received"])
+
+	var probes int
+	for _, p := range acc.Metrics {
+		if p.Measurement == pluginName+"_probe" {
+			probes++
+			require.Equal(t, true, p.Fields["received"])
+			require.Contains(t, p.Fields, "rtt_ms")
+		}
+	}
+	require.Equal(t, 3, probes)
+}
+
+func TestGatherDualStack(t *testing.T) {
+	plugin := &MontimePinger{
+		Domain:     "dualstack.example.com",
+		Count:      1,
+		Timeout:    config.Duration(500 * time.Millisecond),
+		Privileged: true,
+		Stack: dualstack.Stack{
+			IPVersion: dualstack.VERSION_Both,
+			LookupIPAddr: func(context.Context, string) ([]net.IPAddr, error) {
+				// The IPv6 address is of the discard prefix and never answers
+				return []net.IPAddr{{IP: net.ParseIP("100::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+			},
+		},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	results := make(map[string]map[string]interface{})
+	var verdict map[string]interface{}
+	for _, m := range acc.Metrics {
+		switch m.Measurement {
+		case pluginName:
+			if e, ok := m.Fields["error"].(string); ok && strings.Contains(e, "permission") {
+				t.Skip("sending ICMP packets is not permitted")
+			}
+			results[m.Tags["ip_version"]] = m.Fields
+		case pluginName + "_dualstack":
+			verdict = m.Fields
+		}
+	}
+	require.Len(t, results, 2)
+	require.Equal(t, 1, results["4"]["packets_received"])
+	require.NotEqual(t, 1, results["6"]["packets_received"])
+	require.Equal(t, dualstack.VERDICT_IPv6Broken, verdict["verdict"])
+	require.Equal(t, 1, verdict["ipv4_addresses"])
+	require.Equal(t, 1, verdict["ipv6_failed"])
+}
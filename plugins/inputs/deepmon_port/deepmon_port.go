@@ -3,6 +3,7 @@ package deepmon_port
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
 	"errors"
 	"fmt"
@@ -17,6 +18,9 @@ import (
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/plugins/common/retry"
+	"github.com/influxdata/telegraf/plugins/common/targets"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
@@ -34,6 +38,15 @@ type NetResponse struct {
 	Send        string          `toml:"send"`
 	Expect      string          `toml:"expect"`
 	Protocol    string          `toml:"protocol"`
+	// Probe speaks the protocol of a well-known service instead of send
+	// and expect
+	Probe string `toml:"probe"`
+	targets.Batch
+	retry.Policy
+	dualstack.Stack
+
+	expect *regexp.Regexp
+	probe  probeFunc
 }
 
 func (*NetResponse) SampleConfig() string {
@@ -41,13 +54,14 @@ func (*NetResponse) SampleConfig() string {
 }
 
 // TCPGather will execute if there are TCP tests defined in the configuration.
-// It will return a map[string]interface{} for fields and a map[string]string for tags
-func (n *NetResponse) TCPGather(fields *monitors.PortData) (err error) {
+// It connects to the host over the network, fills the PortData and adds the
+// fields of the probe to extra.
+func (n *NetResponse) TCPGather(host, network string, fields *monitors.PortData, extra map[string]interface{}) (err error) {
 	// Prepare returns
 	// Start Timer
 	start := time.Now()
 	// Connecting
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(n.Domain, n.Port), time.Duration(n.Timeout))
+	conn, err := net.DialTimeout(network, net.JoinHostPort(host, n.Port), time.Duration(n.Timeout))
 	// Stop timer
 	responseTime := time.Since(start).Seconds()
 	// Handle error
@@ -61,6 +75,9 @@ func (n *NetResponse) TCPGather(fields *monitors.PortData) (err error) {
 		return nil
 	}
 	defer conn.Close()
+	if n.probe != nil {
+		return n.runProbe(conn, start, fields, extra)
+	}
 	// Send string if needed
 	if n.Send != "" {
 		msg := []byte(n.Send)
@@ -92,8 +109,7 @@ func (n *NetResponse) TCPGather(fields *monitors.PortData) (err error) {
 			fields.Result = monitors.ReadFailed
 		} else {
 			// Looking for string in answer
-			regEx := regexp.MustCompile(`.*` + n.Expect + `.*`)
-			find := regEx.FindString(data)
+			find := n.expect.FindString(data)
 			if find != "" {
 				fields.Result = monitors.Success
 			} else {
@@ -108,22 +124,51 @@ func (n *NetResponse) TCPGather(fields *monitors.PortData) (err error) {
 	return nil
 }
 
+// runProbe talks the protocol of the probe within the read timeout and
+// reports why the service is unhealthy.
+func (n *NetResponse) runProbe(conn net.Conn, start time.Time, fields *monitors.PortData, extra map[string]interface{}) error {
+	if err := conn.SetDeadline(time.Now().Add(time.Duration(n.ReadTimeout))); err != nil {
+		return err
+	}
+	probeFields, err := n.probe(conn)
+	fields.ResponseTime = time.Since(start).Seconds()
+	fields.RemoteAddr, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	for k, v := range probeFields {
+		extra[k] = v
+	}
+	if err != nil {
+		extra["probe_error"] = err.Error()
+		var e net.Error
+		switch {
+		case errors.Is(err, errUnexpectedReply):
+			fields.Result = monitors.StringMismatch
+		case errors.As(err, &e) && e.Timeout():
+			fields.Result = monitors.Timeout
+		default:
+			fields.Result = monitors.ReadFailed
+		}
+		return nil
+	}
+	fields.Result = monitors.Success
+	return nil
+}
+
 // UDPGather will execute if there are UDP tests defined in the configuration.
-// It will return a map[string]interface{} for fields and a map[string]string for tags
-func (n *NetResponse) UDPGather(fields *monitors.PortData) (err error) {
+// It sends to the host over the network and fills the PortData.
+func (n *NetResponse) UDPGather(host, network string, fields *monitors.PortData) (err error) {
 	// Prepare returns
 
 	// Start Timer
 	start := time.Now()
 	// Resolving
-	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(n.Domain, n.Port))
+	udpAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, n.Port))
 	// Handle error
 	if err != nil {
 		fields.Result = monitors.ConnectionFailed
 		return nil
 	}
 	// Connecting
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	conn, err := net.DialUDP(network, nil, udpAddr)
 	// Handle error
 	if err != nil {
 		fields.Result = monitors.ConnectionFailed
@@ -154,8 +199,7 @@ func (n *NetResponse) UDPGather(fields *monitors.PortData) (err error) {
 		return nil
 	}
 	// Looking for string in answer
-	regEx := regexp.MustCompile(`.*` + n.Expect + `.*`)
-	find := regEx.FindString(string(buf))
+	find := n.expect.FindString(string(buf))
 	if find != "" {
 		fields.Result = monitors.Success
 	} else {
@@ -170,6 +214,24 @@ func (n *NetResponse) UDPGather(fields *monitors.PortData) (err error) {
 // Init performs one time setup of the plugin and returns an error if the
 // configuration is invalid.
 func (n *NetResponse) Init() error {
+	if n.HasTargets() {
+		return n.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *n
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			// Targets may bring their own port
+			if host, port, err := net.SplitHostPort(target.Address); err == nil {
+				child.Domain, child.Port = host, port
+			}
+			return &child, child.Init()
+		})
+	}
+	if err := n.InitRetries(); err != nil {
+		return err
+	}
+	if err := n.InitStack(); err != nil {
+		return err
+	}
 	// Set default values
 	if n.Timeout == 0 {
 		n.Timeout = config.Duration(time.Second)
@@ -195,6 +257,24 @@ func (n *NetResponse) Init() error {
 	if err := choice.Check(n.Protocol, []string{"tcp", "udp"}); err != nil {
 		return fmt.Errorf("config option protocol: %w", err)
 	}
+	if n.Probe != "" {
+		probe, found := probes[n.Probe]
+		if !found {
+			return fmt.Errorf("config option probe: unknown choice %s", n.Probe)
+		}
+		if n.Protocol != "tcp" {
+			return errors.New("probes require the tcp protocol")
+		}
+		if n.Send != "" || n.Expect != "" {
+			return errors.New("send and expect cannot be used with a probe")
+		}
+		n.probe = probe
+	}
+	if n.Expect != "" {
+		if n.expect, err = regexp.Compile(`.*` + n.Expect + `.*`); err != nil {
+			return fmt.Errorf("invalid expected string: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -203,42 +283,109 @@ func (n *NetResponse) Init() error {
 // It will call either UDPGather or TCPGather based on the configuration and
 // also fill an Accumulator that is supplied.
 func (n *NetResponse) Gather(acc telegraf.Accumulator) error {
-	// Prepare host and port
-	fields := &monitors.PortData{}
+	if n.HasTargets() {
+		return n.GatherTargets(acc)
+	}
+	if n.Both() {
+		return n.gatherBoth(acc)
+	}
+	fields, extra, err := n.check(n.Domain, "", n.Network(n.Protocol))
+	if err != nil {
+		return err
+	}
 	tags := monitors.MonitorData[*monitors.PortData]{
 		Domain: n.Domain,
 		Data:   fields,
 	}
-	// Prepare data
-	// tags := map[string]string{"server": host, "port": port}
-	// var fields map[string]interface{}
-	// var returnTags map[string]string
+	// Add metrics
+	addFields(acc, tags, extra, nil)
+	return nil
+}
 
-	// Gather data
-	fields.Port = n.Port
-	switch n.Protocol {
-	case "tcp":
-		err := n.TCPGather(fields)
-		if err != nil {
-			return err
+// gatherBoth probes every IPv4 and IPv6 address of the domain on its own and
+// judges the reachability of the address families.
+func (n *NetResponse) gatherBoth(acc telegraf.Accumulator) error {
+	var report dualstack.Report
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout))
+	ips, err := n.Resolve(ctx, n.Domain)
+	cancel()
+	if err != nil {
+		fields := &monitors.PortData{
+			Result:   monitors.ConnectionFailed,
+			Port:     n.Port,
+			Protocol: n.Protocol,
+		}
+		tags := monitors.MonitorData[*monitors.PortData]{
+			Domain: n.Domain,
+			Data:   fields,
 		}
-		fields.Protocol = "tcp"
-	case "udp":
-		err := n.UDPGather(fields)
+		addFields(acc, tags, map[string]interface{}{"error": err.Error()}, nil)
+		report.AddTo(acc, pluginName, n.Domain)
+		return nil
+	}
+
+	for _, ip := range ips {
+		fields, extra, err := n.check(ip.String(), ip.String(), n.Protocol+dualstack.Version(ip))
 		if err != nil {
 			return err
 		}
-		fields.Protocol = "udp"
+		report.Add(ip, fields.Result == monitors.Success)
+		tags := monitors.MonitorData[*monitors.PortData]{
+			Domain: n.Domain,
+			Data:   fields,
+		}
+		addFields(acc, tags, extra, ip)
+	}
+	report.AddTo(acc, pluginName, n.Domain)
+	return nil
+}
+
+// check probes the host over the network and retries transient failures.
+// Failures are confirmed per key.
+func (n *NetResponse) check(host, key, network string) (*monitors.PortData, map[string]interface{}, error) {
+	fields := &monitors.PortData{}
+	// Gather data, transient failures are retried
+	var extra map[string]interface{}
+	var err error
+	attempts := n.Attempt(func() bool {
+		*fields = monitors.PortData{}
+		extra = make(map[string]interface{})
+		if n.Probe != "" {
+			extra["probe"] = n.Probe
+			extra["probe_error"] = ""
+		}
+		switch n.Protocol {
+		case "tcp":
+			err = n.TCPGather(host, network, fields, extra)
+		case "udp":
+			err = n.UDPGather(host, network, fields)
+		}
+		return err == nil && (fields.Result == monitors.Timeout || fields.Result == monitors.ConnectionFailed)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	fields.Port = n.Port
+	fields.Protocol = n.Protocol
 	fields.ExpectedString = n.Expect
 	fields.SendedString = n.Send
-	// Merge the tags
-	// for k, v := range returnTags {
-	// 	tags[k] = v
-	// }
-	// Add metrics
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
-	return nil
+	n.Confirm(key, fields.Result != monitors.Success, attempts, extra)
+	return fields, extra, nil
+}
+
+// addFields emits the PortData fields merged with the extra fields, tagged
+// with the probed address if one is given.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.PortData], extra map[string]interface{}, ip net.IP) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	if ip != nil {
+		t["ip_address"] = ip.String()
+		t["ip_version"] = dualstack.Version(ip)
+	}
+	acc.AddFields(pluginName, data, t)
 }
 
 func init() {
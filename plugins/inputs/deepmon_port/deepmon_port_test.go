@@ -1,14 +1,20 @@
 package deepmon_port
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"io"
 	"net"
-	"sync"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
 	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/plugins/common/retry"
+	"github.com/influxdata/telegraf/plugins/common/targets"
 	"github.com/influxdata/telegraf/testutil"
 
 	"github.com/stretchr/testify/require"
@@ -98,7 +104,6 @@ func TestTCPError(t *testing.T) {
 }
 
 func TestTCPOK1(t *testing.T) {
-	var wg sync.WaitGroup
 	var acc testutil.Accumulator
 	// Init plugin
 	c := NetResponse{
@@ -112,10 +117,7 @@ func TestTCPOK1(t *testing.T) {
 	}
 	require.NoError(t, c.Init())
 	// Start TCP server
-	wg.Add(1)
-	go TCPServer(t, &wg)
-	wg.Wait() // Wait for the server to spin up
-	wg.Add(1)
+	done := TCPServer(t)
 	// Connect
 	require.NoError(t, c.Gather(&acc))
 	acc.Wait(1)
@@ -143,11 +145,10 @@ func TestTCPOK1(t *testing.T) {
 		data.GetFields(), data.GetTags())
 
 	// Waiting TCPserver
-	wg.Wait()
+	require.NoError(t, <-done)
 }
 
 func TestTCPOK2(t *testing.T) {
-	var wg sync.WaitGroup
 	var acc testutil.Accumulator
 	// Init plugin
 	c := NetResponse{
@@ -161,10 +162,7 @@ func TestTCPOK2(t *testing.T) {
 	}
 	require.NoError(t, c.Init())
 	// Start TCP server
-	wg.Add(1)
-	go TCPServer(t, &wg)
-	wg.Wait()
-	wg.Add(1)
+	done := TCPServer(t)
 
 	// Connect
 	require.NoError(t, c.Gather(&acc))
@@ -192,7 +190,7 @@ func TestTCPOK2(t *testing.T) {
 		pluginName,
 		data.GetFields(), data.GetTags())
 	// Waiting TCPserver
-	wg.Wait()
+	require.NoError(t, <-done)
 }
 
 func TestUDPError(t *testing.T) {
@@ -234,7 +232,6 @@ func TestUDPError(t *testing.T) {
 }
 
 func TestUDPOK1(t *testing.T) {
-	var wg sync.WaitGroup
 	var acc testutil.Accumulator
 	// Init plugin
 	c := NetResponse{
@@ -248,10 +245,7 @@ func TestUDPOK1(t *testing.T) {
 	}
 	require.NoError(t, c.Init())
 	// Start UDP server
-	wg.Add(1)
-	go UDPServer(t, &wg)
-	wg.Wait()
-	wg.Add(1)
+	done := UDPServer(t)
 
 	// Connect
 	require.NoError(t, c.Gather(&acc))
@@ -278,41 +272,400 @@ func TestUDPOK1(t *testing.T) {
 	acc.AssertContainsTaggedFields(t,
 		pluginName,
 		data.GetFields(), data.GetTags())
-	// Waiting TCPserver
-	wg.Wait()
+	// Waiting UDPserver
+	require.NoError(t, <-done)
 }
 
-func UDPServer(t *testing.T, wg *sync.WaitGroup) {
-	defer wg.Done()
+// UDPServer listens on the test goroutine and echoes a single datagram, the
+// returned channel reports the errors of serving it.
+func UDPServer(t *testing.T) <-chan error {
 	udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2004")
 	require.NoError(t, err)
 	conn, err := net.ListenUDP("udp", udpAddr)
 	require.NoError(t, err)
-	wg.Done()
-	buf := make([]byte, 1024)
-	_, remoteaddr, err := conn.ReadFromUDP(buf)
-	require.NoError(t, err)
-	buf = bytes.Trim(buf, "\x00")
-	_, err = conn.WriteToUDP(buf, remoteaddr)
-	require.NoError(t, err)
-	require.NoError(t, conn.Close())
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		_, remoteaddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			done <- err
+			return
+		}
+		buf = bytes.Trim(buf, "\x00")
+		_, err = conn.WriteToUDP(buf, remoteaddr)
+		done <- err
+	}()
+	return done
 }
 
-func TCPServer(t *testing.T, wg *sync.WaitGroup) {
-	defer wg.Done()
+// TCPServer listens on the test goroutine and echoes a single connection,
+// the returned channel reports the errors of serving it.
+func TCPServer(t *testing.T) <-chan error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:2004")
 	require.NoError(t, err)
 	tcpServer, err := net.ListenTCP("tcp", tcpAddr)
 	require.NoError(t, err)
-	wg.Done()
-	conn, err := tcpServer.AcceptTCP()
+	done := make(chan error, 1)
+	go func() {
+		defer tcpServer.Close()
+		conn, err := tcpServer.AcceptTCP()
+		if err != nil {
+			done <- err
+			return
+		}
+		buf := make([]byte, 1024)
+		if _, err := conn.Read(buf); err != nil {
+			done <- err
+			return
+		}
+		buf = bytes.Trim(buf, "\x00")
+		if _, err := conn.Write(buf); err != nil {
+			done <- err
+			return
+		}
+		done <- conn.CloseWrite()
+	}()
+	return done
+}
+
+// scriptedServer answers a single connection with the handler.
+func scriptedServer(t *testing.T, handler func(conn net.Conn, r *bufio.Reader)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
-	buf := make([]byte, 1024)
-	_, err = conn.Read(buf)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handler(conn, bufio.NewReader(conn))
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
 	require.NoError(t, err)
-	buf = bytes.Trim(buf, "\x00")
-	_, err = conn.Write(buf)
+	return port
+}
+
+// replyTo writes the reply once the expected line was received.
+func replyTo(expect, reply string) func(net.Conn, *bufio.Reader) {
+	return func(conn net.Conn, r *bufio.Reader) {
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimRight(line, "\r\n") != expect {
+			return
+		}
+		conn.Write([]byte(reply)) //nolint:errcheck // checked by the client
+	}
+}
+
+func mysqlPacket(payload []byte) []byte {
+	return append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}, payload...)
+}
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name    string
+		probe   string
+		handler func(net.Conn, *bufio.Reader)
+		result  monitors.Result
+		fields  map[string]interface{}
+	}{
+		{
+			name:  "smtp",
+			probe: PROBE_SMTP,
+			handler: func(conn net.Conn, r *bufio.Reader) {
+				conn.Write([]byte("220-mail.example.com ESMTP\r\n220 ready\r\n")) //nolint:errcheck // checked by the client
+				replyTo("EHLO [127.0.0.1]", "250-mail.example.com\r\n250-SIZE 35882577\r\n250-STARTTLS\r\n250 8BITMIME\r\n")(conn, r)
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{
+				"smtp_greeting":   "mail.example.com ESMTP",
+				"smtp_reply_code": 250,
+				"smtp_extensions": "SIZE,STARTTLS,8BITMIME",
+				"smtp_starttls":   true,
+				"probe_error":     "",
+			},
+		},
+		{
+			name:  "smtp blank extension",
+			probe: PROBE_SMTP,
+			handler: func(conn net.Conn, r *bufio.Reader) {
+				conn.Write([]byte("220 mail.example.com ESMTP\r\n")) //nolint:errcheck // checked by the client
+				replyTo("EHLO [127.0.0.1]", "250-mail.example.com\r\n250-\r\n250- \r\n250 STARTTLS\r\n")(conn, r)
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{
+				"smtp_extensions": "STARTTLS",
+				"smtp_starttls":   true,
+			},
+		},
+		{
+			name:  "smtp refused",
+			probe: PROBE_SMTP,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				conn.Write([]byte("554 no service\r\n")) //nolint:errcheck // checked by the client
+			},
+			result: monitors.StringMismatch,
+			fields: map[string]interface{}{"probe_error": "unexpected reply: 554 no service"},
+		},
+		{
+			name:  "ftp",
+			probe: PROBE_FTP,
+			handler: func(conn net.Conn, r *bufio.Reader) {
+				conn.Write([]byte("220 FTP server ready\r\n")) //nolint:errcheck // checked by the client
+				replyTo("QUIT", "221 Goodbye\r\n")(conn, r)
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{"ftp_greeting": "FTP server ready", "ftp_reply_code": 221},
+		},
+		{
+			name:  "ssh",
+			probe: PROBE_SSH,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				conn.Write([]byte("welcome\r\nSSH-2.0-OpenSSH_9.6 Ubuntu-3\r\n")) //nolint:errcheck // checked by the client
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{
+				"ssh_banner":           "SSH-2.0-OpenSSH_9.6 Ubuntu-3",
+				"ssh_protocol_version": "2.0",
+				"ssh_software":         "OpenSSH_9.6",
+			},
+		},
+		{
+			name:  "ssh version 1",
+			probe: PROBE_SSH,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				conn.Write([]byte("SSH-1.5-legacy\r\n")) //nolint:errcheck // checked by the client
+			},
+			result: monitors.StringMismatch,
+			fields: map[string]interface{}{"probe_error": "unexpected reply: unsupported protocol version 1.5"},
+		},
+		{
+			name:    "redis",
+			probe:   PROBE_REDIS,
+			handler: replyTo("PING", "+PONG\r\n"),
+			result:  monitors.Success,
+			fields:  map[string]interface{}{"redis_reply": "+PONG", "redis_auth_required": false},
+		},
+		{
+			name:    "redis auth",
+			probe:   PROBE_REDIS,
+			handler: replyTo("PING", "-NOAUTH Authentication required.\r\n"),
+			result:  monitors.Success,
+			fields:  map[string]interface{}{"redis_auth_required": true},
+		},
+		{
+			name:    "memcached",
+			probe:   PROBE_MEMCACHED,
+			handler: replyTo("version", "VERSION 1.6.21\r\n"),
+			result:  monitors.Success,
+			fields:  map[string]interface{}{"memcached_version": "1.6.21"},
+		},
+		{
+			name:  "mysql",
+			probe: PROBE_MYSQL,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				conn.Write(mysqlPacket([]byte("\x0a8.0.36\x00\x01\x00\x00\x00abcdefgh\x00"))) //nolint:errcheck // checked by the client
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{"mysql_protocol_version": 10, "mysql_server_version": "8.0.36"},
+		},
+		{
+			name:  "mysql blocked",
+			probe: PROBE_MYSQL,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				conn.Write(mysqlPacket([]byte("\xff\x69\x04Host is blocked"))) //nolint:errcheck // checked by the client
+			},
+			result: monitors.StringMismatch,
+			fields: map[string]interface{}{"probe_error": "unexpected reply: error 1129: Host is blocked"},
+		},
+		{
+			name:  "postgresql",
+			probe: PROBE_POSTGRESQL,
+			handler: func(conn net.Conn, _ *bufio.Reader) {
+				request := make([]byte, 8)
+				if _, err := io.ReadFull(conn, request); err != nil || !bytes.Equal(request, []byte{0, 0, 0, 8, 4, 210, 22, 47}) {
+					return
+				}
+				conn.Write([]byte("N")) //nolint:errcheck // checked by the client
+			},
+			result: monitors.Success,
+			fields: map[string]interface{}{"postgresql_ssl": false},
+		},
+		{
+			name:    "silent",
+			probe:   PROBE_SMTP,
+			handler: func(net.Conn, *bufio.Reader) { time.Sleep(time.Second) },
+			result:  monitors.Timeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NetResponse{
+				Protocol:    "tcp",
+				Domain:      "127.0.0.1",
+				Port:        scriptedServer(t, tt.handler),
+				Probe:       tt.probe,
+				ReadTimeout: config.Duration(200 * time.Millisecond),
+			}
+			require.NoError(t, c.Init())
+
+			var acc testutil.Accumulator
+			require.NoError(t, c.Gather(&acc))
+			require.Len(t, acc.Metrics, 1)
+			m := acc.Metrics[0]
+			require.EqualValues(t, tt.result, m.Fields["result"], m.Fields["probe_error"])
+			require.Equal(t, tt.probe, m.Fields["probe"])
+			for k, v := range tt.fields {
+				require.Equal(t, v, m.Fields[k], k)
+			}
+		})
+	}
+}
+
+func TestProbeConfig(t *testing.T) {
+	c := NetResponse{Protocol: "tcp", Domain: "localhost", Port: "25", Probe: "gopher"}
+	require.EqualError(t, c.Init(), "config option probe: unknown choice gopher")
+
+	c = NetResponse{Protocol: "udp", Domain: "localhost", Port: "11211", Probe: PROBE_MEMCACHED, Send: "version", Expect: "VERSION"}
+	require.EqualError(t, c.Init(), "probes require the tcp protocol")
+
+	c = NetResponse{Protocol: "tcp", Domain: "localhost", Port: "25", Probe: PROBE_SMTP, Expect: "220"}
+	require.EqualError(t, c.Init(), "send and expect cannot be used with a probe")
+
+	c = NetResponse{Protocol: "tcp", Domain: "localhost", Port: "25", Expect: "("}
+	require.ErrorContains(t, c.Init(), "invalid expected string")
+}
+
+func TestTargets(t *testing.T) {
+	first := scriptedServer(t, replyTo("PING", "+PONG\r\n"))
+	second := scriptedServer(t, replyTo("PING", "-ERR unknown command\r\n"))
+
+	c := NetResponse{
+		Protocol: "tcp",
+		Probe:    PROBE_REDIS,
+		Batch: targets.Batch{
+			Targets: []string{"127.0.0.1:" + first},
+			Target:  []targets.Target{{Address: "127.0.0.1:" + second, Tags: map[string]string{"customer": "acme"}}},
+		},
+	}
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 2)
+	results := make(map[string]*testutil.Metric)
+	for _, m := range acc.Metrics {
+		require.Equal(t, "127.0.0.1", m.Tags["domain"])
+		results[m.Fields["port"].(string)] = m
+	}
+	require.EqualValues(t, monitors.Success, results[first].Fields["result"])
+	require.NotContains(t, results[first].Tags, "customer")
+	require.EqualValues(t, monitors.StringMismatch, results[second].Fields["result"])
+	require.Equal(t, "acme", results[second].Tags["customer"])
+}
+
+func TestRetries(t *testing.T) {
+	// Reserve a port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	c := NetResponse{
+		Protocol: "tcp",
+		Domain:   "127.0.0.1",
+		Port:     port,
+		Policy: retry.Policy{
+			Retries:      2,
+			RetryBackoff: config.Duration(time.Millisecond),
+			ConfirmAfter: 2,
+		},
+	}
+	require.NoError(t, c.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, c.Gather(&acc))
+	require.NoError(t, c.Gather(&acc))
+	require.Len(t, acc.Metrics, 2)
+	for i, m := range acc.Metrics {
+		require.EqualValues(t, monitors.ConnectionFailed, m.Fields["result"])
+		require.Equal(t, 3, m.Fields["attempts"])
+		require.Equal(t, i+1, m.Fields["consecutive_failures"])
+		require.Equal(t, i == 1, m.Fields["confirmed_down"])
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	l4, err := net.Listen("tcp4", "127.0.0.1:0")
 	require.NoError(t, err)
-	require.NoError(t, conn.CloseWrite())
-	require.NoError(t, tcpServer.Close())
+	defer l4.Close()
+	_, port, err := net.SplitHostPort(l4.Addr().String())
+	require.NoError(t, err)
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	for _, l := range []net.Listener{l4, l6} {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}(l)
+	}
+
+	c := NetResponse{
+		Protocol: "tcp",
+		Domain:   "dualstack.example.com",
+		Port:     port,
+		Stack: dualstack.Stack{
+			IPVersion: dualstack.VERSION_Both,
+			LookupIPAddr: func(context.Context, string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+			},
+		},
+	}
+	require.NoError(t, c.Init())
+
+	gather := func() (map[string]map[string]interface{}, map[string]interface{}) {
+		var acc testutil.Accumulator
+		require.NoError(t, c.Gather(&acc))
+		results := make(map[string]map[string]interface{})
+		var verdict map[string]interface{}
+		for _, m := range acc.Metrics {
+			switch m.Measurement {
+			case pluginName:
+				require.Equal(t, "dualstack.example.com", m.Tags["domain"])
+				results[m.Tags["ip_version"]] = m.Fields
+			case pluginName + "_dualstack":
+				verdict = m.Fields
+			}
+		}
+		return results, verdict
+	}
+
+	results, verdict := gather()
+	require.Len(t, results, 2)
+	require.EqualValues(t, monitors.Success, results["4"]["result"])
+	require.EqualValues(t, monitors.Success, results["6"]["result"])
+	require.Equal(t, "::1", results["6"]["remote_addr"])
+	require.Equal(t, dualstack.VERDICT_DualStack, verdict["verdict"])
+	require.EqualValues(t, monitors.Success, verdict["result"])
+
+	// The AAAA record points to an address nobody listens on
+	require.NoError(t, l6.Close())
+	results, verdict = gather()
+	require.EqualValues(t, monitors.Success, results["4"]["result"])
+	require.EqualValues(t, monitors.ConnectionFailed, results["6"]["result"])
+	require.Equal(t, dualstack.VERDICT_IPv6Broken, verdict["verdict"])
+	require.Equal(t, 1, verdict["ipv6_failed"])
+	require.EqualValues(t, monitors.PartialFailure, verdict["result"])
+
+	require.EqualError(t, (&NetResponse{Protocol: "tcp", Domain: "localhost", Port: port, Stack: dualstack.Stack{IPVersion: "5"}}).Init(),
+		"config option ip_version: unknown choice 5")
 }
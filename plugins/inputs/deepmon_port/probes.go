@@ -0,0 +1,270 @@
+package deepmon_port
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	PROBE_SMTP       string = "smtp"
+	PROBE_SSH        string = "ssh"
+	PROBE_REDIS      string = "redis"
+	PROBE_MYSQL      string = "mysql"
+	PROBE_POSTGRESQL string = "postgresql"
+	PROBE_MEMCACHED  string = "memcached"
+	PROBE_FTP        string = "ftp"
+)
+
+// errUnexpectedReply marks replies not matching the protocol, other errors
+// are failures to talk to the service at all.
+var errUnexpectedReply = errors.New("unexpected reply")
+
+// probeFunc speaks enough of a protocol over the connection to tell whether
+// the service is healthy and returns the protocol-specific fields.
+type probeFunc func(conn net.Conn) (map[string]interface{}, error)
+
+var probes = map[string]probeFunc{
+	PROBE_SMTP:       probeSMTP,
+	PROBE_SSH:        probeSSH,
+	PROBE_REDIS:      probeRedis,
+	PROBE_MYSQL:      probeMySQL,
+	PROBE_POSTGRESQL: probePostgreSQL,
+	PROBE_MEMCACHED:  probeMemcached,
+	PROBE_FTP:        probeFTP,
+}
+
+func unexpected(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", errUnexpectedReply, fmt.Sprintf(format, a...))
+}
+
+// readResponse reads a possibly multi-line reply of the SMTP and FTP
+// family, mismatching codes are reported as unexpected replies.
+func readResponse(tp *textproto.Conn, expectCode int) (int, string, error) {
+	code, msg, err := tp.ReadResponse(expectCode)
+	var perr *textproto.Error
+	if errors.As(err, &perr) {
+		return code, msg, unexpected("%d %s", perr.Code, perr.Msg)
+	}
+	var serr textproto.ProtocolError
+	if errors.As(err, &serr) {
+		return code, msg, unexpected("%s", serr)
+	}
+	return code, msg, err
+}
+
+// probeSMTP expects the greeting and lists the extensions announced in the
+// reply to EHLO.
+func probeSMTP(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	tp := textproto.NewConn(conn)
+	_, greeting, err := readResponse(tp, 220)
+	if err != nil {
+		return fields, err
+	}
+	fields["smtp_greeting"] = firstLine(greeting)
+
+	if err := tp.PrintfLine("EHLO %s", localName(conn)); err != nil {
+		return fields, err
+	}
+	code, msg, err := readResponse(tp, 250)
+	fields["smtp_reply_code"] = code
+	if err != nil {
+		return fields, err
+	}
+	// The first line is the greeting of the server, the others the
+	// extensions
+	lines := strings.Split(msg, "\n")
+	extensions := make([]string, 0, len(lines))
+	starttls := false
+	for _, line := range lines[1:] {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		keyword := strings.ToUpper(f[0])
+		extensions = append(extensions, keyword)
+		starttls = starttls || keyword == "STARTTLS"
+	}
+	fields["smtp_extensions"] = strings.Join(extensions, ",")
+	fields["smtp_starttls"] = starttls
+
+	// Leaving politely is not part of the health
+	_ = tp.PrintfLine("QUIT")
+	return fields, nil
+}
+
+// probeFTP expects the greeting and a reply to QUIT.
+func probeFTP(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	tp := textproto.NewConn(conn)
+	code, greeting, err := readResponse(tp, 220)
+	fields["ftp_reply_code"] = code
+	if err != nil {
+		return fields, err
+	}
+	fields["ftp_greeting"] = firstLine(greeting)
+
+	if err := tp.PrintfLine("QUIT"); err != nil {
+		return fields, err
+	}
+	code, _, err = readResponse(tp, 221)
+	fields["ftp_reply_code"] = code
+	return fields, err
+}
+
+// probeSSH reads the identification string, which servers may precede with
+// other lines (RFC 4253, section 4.2).
+func probeSSH(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	for i := 0; i < 10; i++ {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return fields, err
+		}
+		if !strings.HasPrefix(line, "SSH-") {
+			continue
+		}
+		fields["ssh_banner"] = line
+		// SSH-protoversion-softwareversion SP comments
+		parts := strings.SplitN(strings.SplitN(line, " ", 2)[0], "-", 3)
+		if len(parts) != 3 {
+			return fields, unexpected("malformed identification %q", line)
+		}
+		fields["ssh_protocol_version"] = parts[1]
+		fields["ssh_software"] = parts[2]
+		if parts[1] != "2.0" && parts[1] != "1.99" {
+			return fields, unexpected("unsupported protocol version %s", parts[1])
+		}
+		return fields, nil
+	}
+	return fields, unexpected("no identification string")
+}
+
+// probeRedis sends PING, servers requiring authentication are healthy but
+// report it.
+func probeRedis(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return fields, err
+	}
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil {
+		return fields, err
+	}
+	fields["redis_reply"] = line
+	fields["redis_auth_required"] = false
+	switch {
+	case line == "+PONG":
+	case strings.HasPrefix(line, "-NOAUTH"):
+		fields["redis_auth_required"] = true
+	default:
+		return fields, unexpected("%q", line)
+	}
+	return fields, nil
+}
+
+// probeMemcached asks for the version of the server.
+func probeMemcached(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return fields, err
+	}
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil {
+		return fields, err
+	}
+	version, found := strings.CutPrefix(line, "VERSION ")
+	if !found {
+		return fields, unexpected("%q", line)
+	}
+	fields["memcached_version"] = version
+	return fields, nil
+}
+
+// probeMySQL reads the initial handshake packet the server sends on
+// connect, which starts with the protocol and the server version.
+func probeMySQL(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fields, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 || length > 1<<16 {
+		return fields, unexpected("packet length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return fields, err
+	}
+
+	switch payload[0] {
+	case 0x0a:
+		version, _, found := bytes.Cut(payload[1:], []byte{0})
+		if !found {
+			return fields, unexpected("malformed handshake")
+		}
+		fields["mysql_protocol_version"] = int(payload[0])
+		fields["mysql_server_version"] = string(version)
+		return fields, nil
+	case 0xff:
+		// Error packets of refused hosts: code followed by the message
+		if len(payload) < 3 {
+			return fields, unexpected("malformed error packet")
+		}
+		code := binary.LittleEndian.Uint16(payload[1:3])
+		return fields, unexpected("error %d: %s", code, string(payload[3:]))
+	}
+	return fields, unexpected("protocol version %d", payload[0])
+}
+
+// probePostgreSQL sends an SSLRequest, which every server answers without
+// authentication.
+func probePostgreSQL(conn net.Conn) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], 80877103)
+	if _, err := conn.Write(request); err != nil {
+		return fields, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return fields, err
+	}
+	switch answer[0] {
+	case 'S':
+		fields["postgresql_ssl"] = true
+	case 'N':
+		fields["postgresql_ssl"] = false
+	case 'E':
+		return fields, unexpected("error response")
+	default:
+		return fields, unexpected("%q", answer[0])
+	}
+	return fields, nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// localName is the name announced to SMTP servers.
+func localName(conn net.Conn) string {
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return "[IPv6:" + host + "]"
+		}
+		return "[" + host + "]"
+	}
+	return "localhost"
+}
@@ -0,0 +1,448 @@
+//go:generate ../../../tools/readme_config_includer/generator
+package deepmon_traceroute
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/plugins/common/targets"
+	"github.com/influxdata/telegraf/plugins/inputs"
+	"golang.org/x/net/idna"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+// The monitors package has no type for path monitoring yet
+const pluginName = "deepmon_traceroute"
+
+const (
+	PROTOCOL_ICMP string = "icmp"
+	PROTOCOL_UDP  string = "udp"
+	PROTOCOL_TCP  string = "tcp"
+)
+
+var protocols = []string{
+	PROTOCOL_ICMP,
+	PROTOCOL_UDP,
+	PROTOCOL_TCP,
+}
+
+var defaultPorts = map[string]int{
+	PROTOCOL_ICMP: 0,
+	PROTOCOL_UDP:  33434,
+	PROTOCOL_TCP:  80,
+}
+
+// silentHop stands for hops not answering in the path.
+const silentHop = "*"
+
+type MontimeTraceroute struct {
+	Domain   string          `toml:"domain"`
+	Protocol string          `toml:"protocol"`
+	Port     int             `toml:"port"`
+	MaxHops  int             `toml:"max_hops"`
+	Cycles   int             `toml:"cycles"`
+	Timeout  config.Duration `toml:"timeout"`
+	// ResolveNames looks up the reverse names of the hops.
+	ResolveNames bool `toml:"resolve_names"`
+	targets.Batch
+	dualstack.Stack
+
+	// newProber creates the probing layer, replaced for testing
+	newProber func(target *net.IPAddr) (prober, error)
+
+	// reverse names of the hop addresses
+	names map[string]string
+
+	// path of the last run, persisted across restarts
+	path pathState
+}
+
+// TracerouteData is the summary of a run towards the target.
+type TracerouteData struct {
+	Result            monitors.Result
+	IPAddress         string
+	Protocol          string
+	Reached           bool
+	HopCount          int
+	Path              string
+	PathChanged       bool
+	PercentPacketLoss float64
+	AverageResponseMs float64
+}
+
+// pathState is the path seen in the last run.
+type pathState struct {
+	Domain string   `json:"domain"`
+	Path   []string `json:"path"`
+}
+
+// hop collects the answers to the probes with the same TTL across all
+// cycles.
+type hop struct {
+	ttl      int
+	sent     int
+	received int
+	reached  bool
+	rtts     []time.Duration
+	// answering addresses, several ones hint at load balancing
+	responders map[string]int
+	order      []string
+}
+
+func (*MontimeTraceroute) SampleConfig() string {
+	return sampleConfig
+}
+
+func (t *MontimeTraceroute) Init() error {
+	if t.HasTargets() {
+		return t.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *t
+			child.Batch = targets.Batch{}
+			child.Domain = target.Address
+			return &child, child.Init()
+		})
+	}
+	if _, err := idna.Lookup.ToASCII(t.Domain); err != nil || t.Domain == "" {
+		return errors.New("domain is missing or invalid")
+	}
+	if t.Protocol == "" {
+		t.Protocol = PROTOCOL_ICMP
+	}
+	if err := choice.Check(t.Protocol, protocols); err != nil {
+		return fmt.Errorf("config option protocol: %w", err)
+	}
+	if t.Port == 0 {
+		t.Port = defaultPorts[t.Protocol]
+	}
+	if t.Protocol != PROTOCOL_ICMP && (t.Port < 1 || t.Port > 65535) {
+		return errors.New("port is invalid")
+	}
+	if t.MaxHops == 0 {
+		t.MaxHops = 30
+	}
+	if t.MaxHops < 1 || t.MaxHops > 255 {
+		return errors.New("max_hops has to be between 1 and 255")
+	}
+	if t.Cycles == 0 {
+		t.Cycles = 3
+	}
+	if t.Cycles < 0 {
+		return errors.New("cycles must be positive")
+	}
+	if t.Timeout == 0 {
+		t.Timeout = config.Duration(time.Second)
+	}
+	if err := t.InitStack(); err != nil {
+		return err
+	}
+	// A run follows the path to a single address
+	if t.Both() {
+		return errors.New("ip_version \"both\" is not supported, use \"4\" or \"6\"")
+	}
+	if t.newProber == nil {
+		t.newProber = newNetProber(t.Protocol, t.Port)
+	}
+	if t.names == nil {
+		t.names = make(map[string]string)
+	}
+	return nil
+}
+
+func (t *MontimeTraceroute) Gather(acc telegraf.Accumulator) error {
+	if t.HasTargets() {
+		return t.GatherTargets(acc)
+	}
+	fields := &TracerouteData{Protocol: t.Protocol}
+	tags := monitors.MonitorData[*TracerouteData]{
+		Domain: t.Domain,
+		Data:   fields,
+	}
+	extra := make(map[string]interface{})
+
+	target, err := t.resolve()
+	if err != nil {
+		fields.Result = monitors.NoPacketsSent
+		extra["error"] = err.Error()
+		addFields(acc, tags, extra)
+		return nil
+	}
+	fields.IPAddress = target.String()
+
+	p, err := t.newProber(target)
+	if err != nil {
+		fields.Result = monitors.NoPacketsSent
+		extra["error"] = err.Error()
+		addFields(acc, tags, extra)
+		return nil
+	}
+	defer p.close()
+
+	hops := make([]*hop, t.MaxHops)
+	for i := range hops {
+		hops[i] = &hop{ttl: i + 1, responders: make(map[string]int)}
+	}
+	for cycle := 0; cycle < t.Cycles; cycle++ {
+		if err := t.runCycle(p, hops); err != nil {
+			fields.Result = monitors.NoPacketsSent
+			extra["error"] = err.Error()
+			addFields(acc, tags, extra)
+			return nil
+		}
+	}
+
+	// Probes outliving the target are answered by the target as well, so
+	// the path ends at the first hop reaching it. Unreached paths end at
+	// the last answering hop.
+	last := 0
+	for i, h := range hops {
+		if h.received > 0 {
+			last = i + 1
+		}
+		if h.reached {
+			fields.Reached = true
+			break
+		}
+	}
+	hops = hops[:last]
+
+	path := make([]string, 0, len(hops))
+	for _, h := range hops {
+		address := h.address()
+		if address == "" {
+			address = silentHop
+		}
+		path = append(path, address)
+		t.addHop(acc, h)
+	}
+	fields.HopCount = len(hops)
+	fields.Path = strings.Join(path, ",")
+
+	switch {
+	case fields.Reached:
+		fields.Result = monitors.Success
+		destination := hops[len(hops)-1]
+		fields.PercentPacketLoss = destination.loss()
+		fields.AverageResponseMs = durationMs(mean(destination.rtts))
+	case len(hops) > 0:
+		fields.Result = monitors.Failed
+		fields.PercentPacketLoss = 100
+	default:
+		fields.Result = monitors.NoPacketsReceived
+		fields.PercentPacketLoss = 100
+	}
+
+	if len(path) > 0 {
+		if t.path.Domain == t.Domain && len(t.path.Path) > 0 && !samePath(t.path.Path, path) {
+			fields.PathChanged = true
+			extra["previous_path"] = strings.Join(t.path.Path, ",")
+		}
+		t.path = pathState{Domain: t.Domain, Path: path}
+	}
+
+	addFields(acc, tags, extra)
+	return nil
+}
+
+// runCycle probes all TTLs concurrently, like mtr does, so a cycle takes at
+// most the timeout.
+func (t *MontimeTraceroute) runCycle(p prober, hops []*hop) error {
+	replies := make([]*reply, len(hops))
+	errs := make([]error, len(hops))
+	var wg sync.WaitGroup
+	for i := range hops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i], errs[i] = p.probe(i+1, time.Duration(t.Timeout))
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	for i, r := range replies {
+		h := hops[i]
+		h.sent++
+		if r == nil {
+			continue
+		}
+		h.received++
+		h.rtts = append(h.rtts, r.rtt)
+		h.reached = h.reached || r.reached
+		address := r.from.String()
+		if h.responders[address] == 0 {
+			h.order = append(h.order, address)
+		}
+		h.responders[address]++
+	}
+	return nil
+}
+
+func (t *MontimeTraceroute) GetState() interface{} {
+	if t.HasTargets() {
+		return t.TargetsState()
+	}
+	return t.path
+}
+
+func (t *MontimeTraceroute) SetState(state interface{}) error {
+	if t.HasTargets() {
+		return t.SetTargetsState(state)
+	}
+	path, ok := state.(pathState)
+	if !ok {
+		return errors.New("state has to be of type 'pathState'")
+	}
+	// The path of a former target is meaningless
+	if path.Domain == t.Domain {
+		t.path = path
+	}
+	return nil
+}
+
+// resolve looks up the address of the domain in the configured address
+// family, preferring IPv4 if both are allowed.
+func (t *MontimeTraceroute) resolve() (*net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.Timeout))
+	defer cancel()
+	ips, err := t.Resolve(ctx, t.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return &net.IPAddr{IP: ips[0]}, nil
+}
+
+// reverseName returns the cached name of the address.
+func (t *MontimeTraceroute) reverseName(address string) string {
+	if name, found := t.names[address]; found {
+		return name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.Timeout))
+	defer cancel()
+	var name string
+	if names, err := net.DefaultResolver.LookupAddr(ctx, address); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	t.names[address] = name
+	return name
+}
+
+// addHop emits the statistics of the hop.
+func (t *MontimeTraceroute) addHop(acc telegraf.Accumulator, h *hop) {
+	address := h.address()
+	fields := map[string]interface{}{
+		"address":      address,
+		"sent":         h.sent,
+		"received":     h.received,
+		"loss_percent": h.loss(),
+		"responders":   len(h.responders),
+	}
+	if t.ResolveNames && address != "" {
+		fields["name"] = t.reverseName(address)
+	}
+	if len(h.rtts) > 0 {
+		minRtt, maxRtt := h.rtts[0], h.rtts[0]
+		for _, rtt := range h.rtts {
+			minRtt = min(minRtt, rtt)
+			maxRtt = max(maxRtt, rtt)
+		}
+		fields["last_ms"] = durationMs(h.rtts[len(h.rtts)-1])
+		fields["min_ms"] = durationMs(minRtt)
+		fields["avg_ms"] = durationMs(mean(h.rtts))
+		fields["max_ms"] = durationMs(maxRtt)
+		fields["stddev_ms"] = durationMs(stddev(h.rtts))
+	}
+	acc.AddFields(pluginName+"_hop", fields, map[string]string{
+		"domain": t.Domain,
+		"hop":    strconv.Itoa(h.ttl),
+	})
+}
+
+// address returns the address answering most of the probes.
+func (h *hop) address() string {
+	var address string
+	for _, a := range h.order {
+		if h.responders[a] > h.responders[address] {
+			address = a
+		}
+	}
+	return address
+}
+
+func (h *hop) loss() float64 {
+	if h.sent == 0 {
+		return 0
+	}
+	return float64(h.sent-h.received) / float64(h.sent) * 100
+}
+
+// samePath compares the hops of two paths, silent hops match any address.
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && a[i] != silentHop && b[i] != silentHop {
+			return false
+		}
+	}
+	return true
+}
+
+func mean(rtts []time.Duration) time.Duration {
+	if len(rtts) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, rtt := range rtts {
+		sum += rtt
+	}
+	return sum / time.Duration(len(rtts))
+}
+
+func stddev(rtts []time.Duration) time.Duration {
+	if len(rtts) == 0 {
+		return 0
+	}
+	m := float64(mean(rtts))
+	var sum float64
+	for _, rtt := range rtts {
+		sum += (float64(rtt) - m) * (float64(rtt) - m)
+	}
+	return time.Duration(math.Sqrt(sum / float64(len(rtts))))
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// addFields emits the TracerouteData fields merged with the extra fields.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*TracerouteData], extra map[string]interface{}) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	acc.AddFields(pluginName, data, tags.GetTags())
+}
+
+func init() {
+	inputs.Add(pluginName, func() telegraf.Input {
+		return &MontimeTraceroute{ResolveNames: true}
+	})
+}
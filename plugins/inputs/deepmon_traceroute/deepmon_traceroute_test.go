@@ -0,0 +1,290 @@
+package deepmon_traceroute
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+// fakeProber answers probes along a fixed path, the target answers all TTLs
+// beyond its distance.
+type fakeProber struct {
+	sync.Mutex
+	path []string
+	// hops dropping the probes of the listed cycles, counted per TTL
+	drops map[int][]int
+	sent  map[int]int
+	err   error
+}
+
+func (f *fakeProber) probe(ttl int, _ time.Duration) (*reply, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.Lock()
+	cycle := f.sent[ttl]
+	f.sent[ttl]++
+	f.Unlock()
+
+	for _, c := range f.drops[ttl] {
+		if c == cycle {
+			return nil, nil
+		}
+	}
+	if ttl > len(f.path) {
+		ttl = len(f.path)
+	}
+	address := f.path[ttl-1]
+	if address == silentHop {
+		return nil, nil
+	}
+	return &reply{
+		from:    net.ParseIP(address),
+		rtt:     time.Duration(ttl*10+cycle) * time.Millisecond,
+		reached: ttl == len(f.path),
+	}, nil
+}
+
+func (*fakeProber) close() error {
+	return nil
+}
+
+func newPlugin(f *fakeProber) *MontimeTraceroute {
+	f.sent = make(map[int]int)
+	return &MontimeTraceroute{
+		Domain:  "127.0.0.1",
+		MaxHops: 8,
+		newProber: func(*net.IPAddr) (prober, error) {
+			return f, nil
+		},
+	}
+}
+
+func hopMetrics(acc *testutil.Accumulator) map[string]map[string]interface{} {
+	hops := make(map[string]map[string]interface{})
+	for _, m := range acc.Metrics {
+		if m.Measurement == pluginName+"_hop" {
+			hops[m.Tags["hop"]] = m.Fields
+		}
+	}
+	return hops
+}
+
+func TestGather(t *testing.T) {
+	f := &fakeProber{
+		path:  []string{"10.0.0.1", silentHop, "10.0.2.1", "127.0.0.1"},
+		drops: map[int][]int{3: {1}},
+	}
+	plugin := newPlugin(f)
+	plugin.ResolveNames = true
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	summary, found := acc.Get(pluginName)
+	require.True(t, found)
+	require.Equal(t, "127.0.0.1", summary.Tags["domain"])
+	require.Equal(t, true, summary.Fields["reached"])
+	require.Equal(t, 4, summary.Fields["hop_count"])
+	require.Equal(t, "10.0.0.1,*,10.0.2.1,127.0.0.1", summary.Fields["path"])
+	require.Equal(t, false, summary.Fields["path_changed"])
+	require.InDelta(t, 41.0, summary.Fields["average_response_ms"], 0.001)
+	require.Equal(t, "icmp", summary.Fields["protocol"])
+
+	// Hops beyond the target are not reported
+	hops := hopMetrics(&acc)
+	require.Len(t, hops, 4)
+	require.Equal(t, "10.0.0.1", hops["1"]["address"])
+	require.Equal(t, 3, hops["1"]["received"])
+	require.InDelta(t, 10.0, hops["1"]["min_ms"], 0.001)
+	require.InDelta(t, 12.0, hops["1"]["max_ms"], 0.001)
+	require.InDelta(t, 11.0, hops["1"]["avg_ms"], 0.001)
+	require.Equal(t, "", hops["2"]["address"])
+	require.InDelta(t, 100.0, hops["2"]["loss_percent"], 0.001)
+	require.NotContains(t, hops["2"], "avg_ms")
+	require.Equal(t, 2, hops["3"]["received"])
+	require.InDelta(t, 100.0/3, hops["3"]["loss_percent"], 0.001)
+	require.Equal(t, "localhost", hops["4"]["name"])
+}
+
+func TestPathChange(t *testing.T) {
+	f := &fakeProber{path: []string{"10.0.0.1", "10.0.1.1", "127.0.0.1"}}
+	plugin := newPlugin(f)
+	require.NoError(t, plugin.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	// Round-trip the state through JSON like the persister does
+	serialized, err := json.Marshal(plugin.GetState())
+	require.NoError(t, err)
+	var state pathState
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	// A silent hop does not count as a change
+	f = &fakeProber{path: []string{"10.0.0.1", silentHop, "127.0.0.1"}}
+	restarted := newPlugin(f)
+	require.NoError(t, restarted.Init())
+	require.NoError(t, restarted.SetState(state))
+	acc.ClearMetrics()
+	require.NoError(t, restarted.Gather(&acc))
+	summary, _ := acc.Get(pluginName)
+	require.Equal(t, false, summary.Fields["path_changed"])
+
+	f.path = []string{"10.0.0.1", "10.0.9.1", "10.0.9.2", "127.0.0.1"}
+	acc.ClearMetrics()
+	require.NoError(t, restarted.Gather(&acc))
+	summary, _ = acc.Get(pluginName)
+	require.Equal(t, true, summary.Fields["path_changed"])
+	require.Equal(t, "10.0.0.1,*,127.0.0.1", summary.Fields["previous_path"])
+
+	// The path of another target is dropped
+	other := newPlugin(&fakeProber{path: []string{"127.0.0.1"}})
+	require.NoError(t, other.Init())
+	state.Domain = "example.com"
+	require.NoError(t, other.SetState(state))
+	require.Empty(t, other.path.Path)
+}
+
+func TestGatherUnreached(t *testing.T) {
+	f := &fakeProber{path: []string{"10.0.0.1", "10.0.1.1", silentHop}}
+	plugin := newPlugin(f)
+	require.NoError(t, plugin.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	summary, _ := acc.Get(pluginName)
+	require.Equal(t, false, summary.Fields["reached"])
+	require.Equal(t, 2, summary.Fields["hop_count"])
+	require.EqualValues(t, monitors.Failed, summary.Fields["result"])
+	require.Len(t, hopMetrics(&acc), 2)
+}
+
+func TestGatherProbeError(t *testing.T) {
+	plugin := newPlugin(&fakeProber{err: errors.New("permission changes required")})
+	require.NoError(t, plugin.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	summary, _ := acc.Get(pluginName)
+	require.EqualValues(t, monitors.NoPacketsSent, summary.Fields["result"])
+	require.Contains(t, summary.Fields["error"], "permission")
+}
+
+func TestInit(t *testing.T) {
+	require.ErrorContains(t, (&MontimeTraceroute{}).Init(), "domain is missing")
+	require.ErrorContains(t, (&MontimeTraceroute{Domain: "example.com", Protocol: "sctp"}).Init(), "protocol")
+	require.ErrorContains(t, (&MontimeTraceroute{Domain: "example.com", MaxHops: 256}).Init(), "max_hops")
+	require.ErrorContains(t, (&MontimeTraceroute{Domain: "example.com", Stack: dualstack.Stack{IPVersion: "5"}}).Init(), "ip_version")
+	require.ErrorContains(t, (&MontimeTraceroute{Domain: "example.com", Stack: dualstack.Stack{IPVersion: dualstack.VERSION_Both}}).Init(), "not supported")
+
+	plugin := &MontimeTraceroute{Domain: "example.com", Protocol: PROTOCOL_TCP}
+	require.NoError(t, plugin.Init())
+	require.Equal(t, 80, plugin.Port)
+	require.Equal(t, 30, plugin.MaxHops)
+	require.Equal(t, 3, plugin.Cycles)
+	require.NotNil(t, plugin.newProber)
+}
+
+func TestResolve(t *testing.T) {
+	plugin := &MontimeTraceroute{Domain: "127.0.0.1"}
+	require.NoError(t, plugin.Init())
+	target, err := plugin.resolve()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", target.String())
+
+	plugin = &MontimeTraceroute{Domain: "127.0.0.1", Stack: dualstack.Stack{IPVersion: dualstack.VERSION_6}}
+	require.NoError(t, plugin.Init())
+	_, err = plugin.resolve()
+	require.ErrorContains(t, err, "no address found")
+}
+
+func TestParseQuote(t *testing.T) {
+	// IPv4 header with options followed by a UDP header
+	quote := make([]byte, 24+8)
+	quote[0] = 0x46
+	quote[9] = protocolUDP
+	copy(quote[16:20], net.ParseIP("192.0.2.1").To4())
+	quote[24], quote[25] = 0x9c, 0x40
+
+	p := &netProber{target: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}}
+	key, ok := p.quotedKey(quote)
+	require.True(t, ok)
+	require.Equal(t, probeKey{protocol: protocolUDP, id: 40000}, key)
+	_, ok = p.quotedKey(quote[:20])
+	require.False(t, ok)
+
+	other := &netProber{target: &net.IPAddr{IP: net.ParseIP("192.0.2.2")}}
+	_, ok = other.quotedKey(quote)
+	require.False(t, ok)
+}
+
+func TestNetProberLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	tcpPort := ln.Addr().(*net.TCPAddr).Port
+
+	target := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	for _, tt := range []struct {
+		protocol string
+		port     int
+	}{
+		{PROTOCOL_ICMP, 0},
+		{PROTOCOL_UDP, 33434},
+		{PROTOCOL_TCP, tcpPort},
+	} {
+		t.Run(tt.protocol, func(t *testing.T) {
+			p, err := newNetProber(tt.protocol, tt.port)(target)
+			if err != nil && strings.Contains(err.Error(), "permission") {
+				t.Skip("raw sockets are not permitted")
+			}
+			require.NoError(t, err)
+			defer p.close()
+
+			r, err := p.probe(1, time.Second)
+			require.NoError(t, err)
+			require.NotNil(t, r)
+			require.True(t, r.reached)
+			require.Equal(t, "127.0.0.1", r.from.String())
+		})
+	}
+}
+
+func TestNetProberShared(t *testing.T) {
+	target := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	p, err := newNetProber(PROTOCOL_ICMP, 0)(target)
+	if err != nil && strings.Contains(err.Error(), "permission") {
+		t.Skip("raw sockets are not permitted")
+	}
+	require.NoError(t, err)
+
+	// The concurrent probes share the socket and get their own answers
+	replies := make([]*reply, 8)
+	errs := make([]error, len(replies))
+	var wg sync.WaitGroup
+	for i := range replies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i], errs[i] = p.probe(i+1, time.Second)
+		}()
+	}
+	wg.Wait()
+	for i, r := range replies {
+		require.NoError(t, errs[i])
+		require.NotNil(t, r)
+		require.True(t, r.reached)
+	}
+	require.Empty(t, p.(*netProber).waiting)
+	require.NoError(t, p.close())
+}
@@ -0,0 +1,410 @@
+package deepmon_traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IANA protocol numbers
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// prober sends single probes with a limited TTL towards the target.
+type prober interface {
+	// probe returns the answer to a probe with the TTL, or nil if nothing
+	// answered within the timeout. Probes may be sent concurrently.
+	probe(ttl int, timeout time.Duration) (*reply, error)
+	close() error
+}
+
+// reply is the answer to a probe, either by a router on the path or by the
+// target itself.
+type reply struct {
+	from    net.IP
+	rtt     time.Duration
+	reached bool
+}
+
+// probeKey identifies a probe in the packets quoted by ICMP errors.
+type probeKey struct {
+	// transport protocol of the probe
+	protocol int
+	// ICMP echo identifier or source port
+	id int
+	// ICMP echo sequence number
+	seq int
+}
+
+// netProber probes over a raw ICMP socket, which requires root or the
+// CAP_NET_RAW capability. The socket receives all ICMP messages of the host,
+// so a single one is opened per prober and the messages answering a probe are
+// routed to it by its probeKey.
+type netProber struct {
+	protocol string
+	port     int
+	target   *net.IPAddr
+	ipv6     bool
+
+	id  int
+	seq atomic.Uint32
+
+	conn *icmp.PacketConn
+	// writeMu serializes setting the TTL of the socket with sending
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	waiting map[probeKey]chan answer
+	done    chan struct{}
+}
+
+// answer is an ICMP message answering a probe.
+type answer struct {
+	from     net.IP
+	received time.Time
+	reached  bool
+}
+
+func newNetProber(protocol string, port int) func(*net.IPAddr) (prober, error) {
+	return func(target *net.IPAddr) (prober, error) {
+		p := &netProber{
+			protocol: protocol,
+			port:     port,
+			target:   target,
+			ipv6:     target.IP.To4() == nil,
+			id:       rand.Intn(0xffff),
+			waiting:  make(map[probeKey]chan answer),
+			done:     make(chan struct{}),
+		}
+		conn, err := p.listen()
+		if err != nil {
+			return nil, err
+		}
+		p.conn = conn
+		go p.receive()
+		return p, nil
+	}
+}
+
+func (p *netProber) close() error {
+	err := p.conn.Close()
+	<-p.done
+	return err
+}
+
+// listen opens the raw socket receiving all ICMP messages.
+func (p *netProber) listen() (*icmp.PacketConn, error) {
+	var conn *icmp.PacketConn
+	var err error
+	if p.ipv6 {
+		conn, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	} else {
+		conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	}
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return nil, errors.New("permission changes required, enable CAP_NET_RAW capabilities")
+		}
+		return nil, fmt.Errorf("failed to listen for ICMP messages: %w", err)
+	}
+	return conn, nil
+}
+
+func (p *netProber) probe(ttl int, timeout time.Duration) (*reply, error) {
+	switch p.protocol {
+	case PROTOCOL_UDP:
+		return p.probeUDP(ttl, timeout)
+	case PROTOCOL_TCP:
+		return p.probeTCP(ttl, timeout)
+	}
+	return p.probeICMP(ttl, timeout)
+}
+
+func (p *netProber) probeICMP(ttl int, timeout time.Duration) (*reply, error) {
+	key := probeKey{protocol: protocolICMP, id: p.id, seq: int(p.seq.Add(1) & 0xffff)}
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: key.id, Seq: key.seq, Data: []byte("deepmon")},
+	}
+	if p.ipv6 {
+		key.protocol = protocolICMPv6
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := p.register(key)
+	defer p.unregister(key)
+	start := time.Now()
+	if err := p.send(b, ttl); err != nil {
+		return nil, err
+	}
+	return p.await(answers, start, timeout), nil
+}
+
+// send writes the echo request with the TTL, the socket is shared by the
+// concurrent probes.
+func (p *netProber) send(b []byte, ttl int) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if p.ipv6 {
+		if err := p.conn.IPv6PacketConn().SetHopLimit(ttl); err != nil {
+			return err
+		}
+	} else if err := p.conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+		return err
+	}
+	_, err := p.conn.WriteTo(b, p.target)
+	return err
+}
+
+func (p *netProber) probeUDP(ttl int, timeout time.Duration) (*reply, error) {
+	network := "udp4"
+	if p.ipv6 {
+		network = "udp6"
+	}
+	uc, err := net.ListenPacket(network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	if p.ipv6 {
+		err = ipv6.NewPacketConn(uc).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewPacketConn(uc).SetTTL(ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Every probe has its own socket, so the source port tells them apart
+	key := probeKey{protocol: protocolUDP, id: uc.LocalAddr().(*net.UDPAddr).Port}
+	answers := p.register(key)
+	defer p.unregister(key)
+	start := time.Now()
+	if _, err := uc.WriteTo([]byte("deepmon"), &net.UDPAddr{IP: p.target.IP, Port: p.port, Zone: p.target.Zone}); err != nil {
+		return nil, err
+	}
+	return p.await(answers, start, timeout), nil
+}
+
+func (p *netProber) probeTCP(ttl int, timeout time.Duration) (*reply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The TTL has to be set and the probe registered by its source port
+	// before the SYN is sent
+	var answers chan answer
+	registered := make(chan probeKey, 1)
+	dialer := &net.Dialer{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var port int
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				port, serr = prepareTCPSocket(fd, p.ipv6, ttl)
+			}); err != nil {
+				return err
+			}
+			if serr != nil {
+				return serr
+			}
+			key := probeKey{protocol: protocolTCP, id: port}
+			answers = p.register(key)
+			registered <- key
+			return nil
+		},
+	}
+
+	start := time.Now()
+	dialed := make(chan error, 1)
+	go func() {
+		c, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(p.target.String(), strconv.Itoa(p.port)))
+		if c != nil {
+			c.Close()
+		}
+		dialed <- err
+	}()
+
+	select {
+	case key := <-registered:
+		defer p.unregister(key)
+	case err := <-dialed:
+		select {
+		case key := <-registered:
+			p.unregister(key)
+		default:
+		}
+		return nil, err
+	}
+
+	select {
+	case err := <-dialed:
+		// Both an accepted and a refused connection prove the target was
+		// reached
+		if err == nil || isRefused(err) {
+			return &reply{from: p.target.IP, rtt: time.Since(start), reached: true}, nil
+		}
+		return p.await(answers, start, timeout), nil
+	case a := <-answers:
+		return a.reply(start), nil
+	case <-ctx.Done():
+		return nil, nil
+	}
+}
+
+// register returns the channel the answer to the probe is routed to.
+func (p *netProber) register(key probeKey) chan answer {
+	answers := make(chan answer, 1)
+	p.mu.Lock()
+	p.waiting[key] = answers
+	p.mu.Unlock()
+	return answers
+}
+
+func (p *netProber) unregister(key probeKey) {
+	p.mu.Lock()
+	delete(p.waiting, key)
+	p.mu.Unlock()
+}
+
+// await waits for the answer to the probe until the timeout expires.
+func (p *netProber) await(answers chan answer, start time.Time, timeout time.Duration) *reply {
+	timer := time.NewTimer(time.Until(start.Add(timeout)))
+	defer timer.Stop()
+	select {
+	case a := <-answers:
+		return a.reply(start)
+	case <-timer.C:
+	case <-p.done:
+	}
+	return nil
+}
+
+func (a answer) reply(start time.Time) *reply {
+	return &reply{from: a.from, rtt: a.received.Sub(start), reached: a.reached}
+}
+
+// receive reads ICMP messages until the socket is closed and routes the ones
+// answering a waiting probe to it.
+func (p *netProber) receive() {
+	defer close(p.done)
+	proto := protocolICMP
+	if p.ipv6 {
+		proto = protocolICMPv6
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		var source net.IP
+		switch addr := from.(type) {
+		case *net.IPAddr:
+			source = addr.IP
+		case *net.UDPAddr:
+			source = addr.IP
+		default:
+			continue
+		}
+
+		var key probeKey
+		a := answer{from: source, received: received}
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+				continue
+			}
+			if !source.Equal(p.target.IP) {
+				continue
+			}
+			key = probeKey{protocol: proto, id: body.ID, seq: body.Seq}
+			a.reached = true
+		case *icmp.TimeExceeded:
+			var ok bool
+			if key, ok = p.quotedKey(body.Data); !ok {
+				continue
+			}
+		case *icmp.DstUnreach:
+			// The target rejects UDP probes to closed ports, routers
+			// rejecting them end the path
+			var ok bool
+			if key, ok = p.quotedKey(body.Data); !ok {
+				continue
+			}
+			a.reached = source.Equal(p.target.IP)
+		default:
+			continue
+		}
+
+		p.mu.Lock()
+		if answers, found := p.waiting[key]; found {
+			select {
+			case answers <- a:
+			default:
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// quotedKey returns the key of the probe quoted by an ICMP error, if it was
+// sent to the target.
+func (p *netProber) quotedKey(data []byte) (probeKey, bool) {
+	protocol, dst, transport, ok := parseQuote(data, p.ipv6)
+	if !ok || !dst.Equal(p.target.IP) || len(transport) < 8 {
+		return probeKey{}, false
+	}
+	switch protocol {
+	case protocolICMP, protocolICMPv6:
+		return probeKey{
+			protocol: protocol,
+			id:       int(binary.BigEndian.Uint16(transport[4:6])),
+			seq:      int(binary.BigEndian.Uint16(transport[6:8])),
+		}, true
+	case protocolUDP, protocolTCP:
+		return probeKey{protocol: protocol, id: int(binary.BigEndian.Uint16(transport[0:2]))}, true
+	}
+	return probeKey{}, false
+}
+
+// parseQuote returns the transport protocol, the destination and the
+// transport header of the IP packet quoted by an ICMP error.
+func parseQuote(data []byte, isIPv6 bool) (int, net.IP, []byte, bool) {
+	if isIPv6 {
+		if len(data) < ipv6.HeaderLen {
+			return 0, nil, nil, false
+		}
+		return int(data[6]), net.IP(data[24:40]), data[ipv6.HeaderLen:], true
+	}
+	if len(data) < ipv4.HeaderLen {
+		return 0, nil, nil, false
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	if headerLen < ipv4.HeaderLen || len(data) < headerLen {
+		return 0, nil, nil, false
+	}
+	return int(data[9]), net.IP(data[16:20]), data[headerLen:], true
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+
+package deepmon_traceroute
+
+import (
+	"errors"
+	"syscall"
+)
+
+// prepareTCPSocket sets the TTL of the socket and binds it to a source port,
+// which is returned.
+func prepareTCPSocket(fd uintptr, isIPv6 bool, ttl int) (int, error) {
+	s := int(fd)
+	if isIPv6 {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl); err != nil {
+			return 0, err
+		}
+		if err := syscall.Bind(s, &syscall.SockaddrInet6{}); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil {
+			return 0, err
+		}
+		if err := syscall.Bind(s, &syscall.SockaddrInet4{}); err != nil {
+			return 0, err
+		}
+	}
+	sa, err := syscall.Getsockname(s)
+	if err != nil {
+		return 0, err
+	}
+	switch addr := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return addr.Port, nil
+	case *syscall.SockaddrInet6:
+		return addr.Port, nil
+	}
+	return 0, errors.New("unexpected socket address")
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,186 @@
+package deepmon_uptime
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/tidwall/gjson"
+)
+
+// ValueAssertion compares the value found by a JSON path or XPath query
+// against an expected value.
+type ValueAssertion struct {
+	Query    string `toml:"query"`
+	Expected string `toml:"expected"`
+}
+
+// statusRange is an inclusive range of accepted status codes.
+type statusRange struct {
+	min, max int
+}
+
+// initAssertions parses and compiles the configured response assertions.
+func (u *Uptime) initAssertions() error {
+	u.statusRanges = u.statusRanges[:0]
+	for _, code := range u.ExpectedStatusCodes {
+		r, err := parseStatusRange(code)
+		if err != nil {
+			return fmt.Errorf("invalid expected_status_codes entry %q: %w", code, err)
+		}
+		u.statusRanges = append(u.statusRanges, r)
+	}
+
+	u.bodyRegex = u.bodyRegex[:0]
+	for _, expr := range u.BodyRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid body_regex %q: %w", expr, err)
+		}
+		u.bodyRegex = append(u.bodyRegex, re)
+	}
+
+	u.headerRegex = make(map[string]*regexp.Regexp, len(u.RequiredHeaders))
+	for name, expr := range u.RequiredHeaders {
+		if expr == "" {
+			u.headerRegex[name] = nil
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid required_headers value for %q: %w", name, err)
+		}
+		u.headerRegex[name] = re
+	}
+
+	for _, a := range u.JSONPath {
+		if a.Query == "" {
+			return errors.New("json_path query cannot be empty")
+		}
+	}
+	for _, a := range u.XPath {
+		if _, err := xpath.Compile(a.Query); err != nil {
+			return fmt.Errorf("invalid xpath query %q: %w", a.Query, err)
+		}
+	}
+	return nil
+}
+
+// parseStatusRange accepts a single code ("200"), a class ("2xx") or an
+// inclusive range ("200-299").
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusRange{}, errors.New("unknown status class")
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	}
+	if start, end, found := strings.Cut(s, "-"); found {
+		lo, err := strconv.Atoi(strings.TrimSpace(start))
+		if err != nil {
+			return statusRange{}, err
+		}
+		hi, err := strconv.Atoi(strings.TrimSpace(end))
+		if err != nil {
+			return statusRange{}, err
+		}
+		if lo > hi {
+			return statusRange{}, errors.New("range start is greater than range end")
+		}
+		return statusRange{lo, hi}, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return statusRange{}, err
+	}
+	return statusRange{code, code}, nil
+}
+
+func (u *Uptime) hasAssertions() bool {
+	return len(u.statusRanges) > 0 || len(u.BodyContains) > 0 || len(u.bodyRegex) > 0 ||
+		len(u.JSONPath) > 0 || len(u.XPath) > 0 || len(u.headerRegex) > 0 || u.MaxLatency > 0
+}
+
+// assert runs all configured assertions against the response and returns the
+// names of the failed ones.
+func (u *Uptime) assert(us *uptimeStats) []string {
+	var failed []string
+
+	if len(u.statusRanges) > 0 {
+		accepted := false
+		for _, r := range u.statusRanges {
+			if us.StatusCode >= r.min && us.StatusCode <= r.max {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			failed = append(failed, "status_code")
+		}
+	}
+
+	for i, s := range u.BodyContains {
+		if !strings.Contains(us.ResponseBody, s) {
+			failed = append(failed, fmt.Sprintf("body_contains[%d]", i))
+		}
+	}
+
+	for i, re := range u.bodyRegex {
+		if !re.MatchString(us.ResponseBody) {
+			failed = append(failed, fmt.Sprintf("body_regex[%d]", i))
+		}
+	}
+
+	for _, a := range u.JSONPath {
+		result := gjson.Get(us.ResponseBody, a.Query)
+		if !result.Exists() || result.String() != a.Expected {
+			failed = append(failed, "json_path["+a.Query+"]")
+		}
+	}
+
+	if len(u.XPath) > 0 {
+		doc, err := xmlquery.Parse(strings.NewReader(us.ResponseBody))
+		for _, a := range u.XPath {
+			if err != nil {
+				failed = append(failed, "xpath["+a.Query+"]")
+				continue
+			}
+			node, err := xmlquery.Query(doc, a.Query)
+			if err != nil || node == nil || strings.TrimSpace(node.InnerText()) != a.Expected {
+				failed = append(failed, "xpath["+a.Query+"]")
+			}
+		}
+	}
+
+	names := make([]string, 0, len(u.headerRegex))
+	for name := range u.headerRegex {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		re := u.headerRegex[name]
+		values, found := us.Header[http.CanonicalHeaderKey(name)]
+		if !found {
+			failed = append(failed, "header["+name+"]")
+			continue
+		}
+		if re != nil && !re.MatchString(strings.Join(values, ", ")) {
+			failed = append(failed, "header["+name+"]")
+		}
+	}
+
+	if u.MaxLatency > 0 && us.Latency > time.Duration(u.MaxLatency).Seconds() {
+		failed = append(failed, "max_latency")
+	}
+
+	return failed
+}
@@ -0,0 +1,232 @@
+package deepmon_uptime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/influxdata/telegraf/config"
+)
+
+const (
+	AUTH_TYPE_None   string = ""
+	AUTH_TYPE_Basic  string = "basic"
+	AUTH_TYPE_Bearer string = "bearer"
+	AUTH_TYPE_OAuth2 string = "oauth2"
+	AUTH_TYPE_JWT    string = "jwt"
+)
+
+var authTypes = []string{
+	AUTH_TYPE_None,
+	AUTH_TYPE_Basic,
+	AUTH_TYPE_Bearer,
+	AUTH_TYPE_OAuth2,
+	AUTH_TYPE_JWT,
+}
+
+// errAuth marks failures that happened while authorizing the request, before
+// anything was sent to the monitored endpoint.
+var errAuth = errors.New("authorization failed")
+
+const defaultJWTExpiry = 5 * time.Minute
+
+// initAuth validates the authentication options and prepares the token
+// sources for the schemes that need one.
+func (u *Uptime) initAuth() error {
+	switch u.AuthType {
+	case AUTH_TYPE_None:
+	case AUTH_TYPE_Basic:
+		if u.Username.Empty() {
+			return errors.New("username is required for basic auth")
+		}
+	case AUTH_TYPE_Bearer:
+		if u.Token.Empty() {
+			return errors.New("token is required for bearer auth")
+		}
+	case AUTH_TYPE_OAuth2:
+		if u.ClientID.Empty() || u.ClientSecret.Empty() {
+			return errors.New("client_id and client_secret are required for oauth2 auth")
+		}
+		if u.TokenURL == "" {
+			return errors.New("token_url is required for oauth2 auth")
+		}
+		if _, err := url.Parse(u.TokenURL); err != nil {
+			return fmt.Errorf("invalid token_url: %w", err)
+		}
+		// ReuseTokenSource caches the token and only calls the token endpoint
+		// again once the cached one is expired.
+		u.tokenSource = oauth2.ReuseTokenSource(nil, &clientCredentialsSource{u: u})
+	case AUTH_TYPE_JWT:
+		if u.JWTKey.Empty() {
+			return errors.New("jwt_key is required for jwt auth")
+		}
+		if u.JWTSigningMethod == "" {
+			u.JWTSigningMethod = jwt.SigningMethodHS256.Alg()
+		}
+		method := jwt.GetSigningMethod(u.JWTSigningMethod)
+		if method == nil || method == jwt.SigningMethodNone {
+			return fmt.Errorf("invalid jwt_signing_method: %s", u.JWTSigningMethod)
+		}
+		if u.JWTExpiry == 0 {
+			u.JWTExpiry = config.Duration(defaultJWTExpiry)
+		}
+		u.jwtSigner = &jwtSigner{u: u, method: method}
+	}
+	return nil
+}
+
+// authorize adds the credentials of the configured scheme to the request.
+func (u *Uptime) authorize(req *http.Request) error {
+	switch u.AuthType {
+	case AUTH_TYPE_Basic:
+		username, err := u.Username.Get()
+		if err != nil {
+			return fmt.Errorf("getting username failed: %w", err)
+		}
+		defer username.Destroy()
+		password, err := u.Password.Get()
+		if err != nil {
+			return fmt.Errorf("getting password failed: %w", err)
+		}
+		defer password.Destroy()
+		req.SetBasicAuth(username.String(), password.String())
+	case AUTH_TYPE_Bearer:
+		token, err := u.Token.Get()
+		if err != nil {
+			return fmt.Errorf("getting token failed: %w", err)
+		}
+		defer token.Destroy()
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token.String()))
+	case AUTH_TYPE_OAuth2:
+		token, err := u.tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("fetching oauth2 token failed: %w", err)
+		}
+		token.SetAuthHeader(req)
+	case AUTH_TYPE_JWT:
+		token, err := u.jwtSigner.token()
+		if err != nil {
+			return fmt.Errorf("signing jwt failed: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// clientCredentialsSource fetches OAuth2 tokens with the client-credentials
+// grant. The secrets are resolved on every fetch so rotated values from a
+// secret store are picked up on the next refresh.
+type clientCredentialsSource struct {
+	u *Uptime
+}
+
+func (s *clientCredentialsSource) Token() (*oauth2.Token, error) {
+	id, err := s.u.ClientID.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting client_id failed: %w", err)
+	}
+	defer id.Destroy()
+	secret, err := s.u.ClientSecret.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting client_secret failed: %w", err)
+	}
+	defer secret.Destroy()
+
+	cfg := clientcredentials.Config{
+		ClientID:       id.String(),
+		ClientSecret:   secret.String(),
+		TokenURL:       s.u.TokenURL,
+		Scopes:         s.u.Scopes,
+		EndpointParams: make(url.Values),
+	}
+	if s.u.Audience != "" {
+		cfg.EndpointParams.Add("audience", s.u.Audience)
+	}
+
+	client := &http.Client{Timeout: time.Duration(s.u.Timeout)}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	return cfg.Token(ctx)
+}
+
+// jwtSigner signs tokens locally and reuses a token until it gets close to
+// its expiry.
+type jwtSigner struct {
+	u      *Uptime
+	method jwt.SigningMethod
+
+	sync.Mutex
+	signed  string
+	expires time.Time
+}
+
+func (s *jwtSigner) token() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	// Renew once less than a tenth of the lifetime is left
+	if s.signed != "" && now.Add(time.Duration(s.u.JWTExpiry)/10).Before(s.expires) {
+		return s.signed, nil
+	}
+
+	expires := now.Add(time.Duration(s.u.JWTExpiry))
+	claims := jwt.MapClaims{
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": expires.Unix(),
+	}
+	for k, v := range s.u.JWTClaims {
+		claims[k] = v
+	}
+	if s.u.JWTIssuer != "" {
+		claims["iss"] = s.u.JWTIssuer
+	}
+	if s.u.JWTSubject != "" {
+		claims["sub"] = s.u.JWTSubject
+	}
+	if s.u.JWTAudience != "" {
+		claims["aud"] = s.u.JWTAudience
+	}
+
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+	signed, err := jwt.NewWithClaims(s.method, claims).SignedString(key)
+	if err != nil {
+		return "", err
+	}
+	s.signed = signed
+	s.expires = expires
+	return signed, nil
+}
+
+func (s *jwtSigner) signingKey() (interface{}, error) {
+	secret, err := s.u.JWTKey.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting jwt_key failed: %w", err)
+	}
+	defer secret.Destroy()
+	raw := []byte(secret.String())
+
+	switch s.method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return raw, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPrivateKeyFromPEM(raw)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPrivateKeyFromPEM(raw)
+	case *jwt.SigningMethodEd25519:
+		return jwt.ParseEdPrivateKeyFromPEM(raw)
+	}
+	return nil, fmt.Errorf("unsupported signing method %s", s.method.Alg())
+}
@@ -0,0 +1,102 @@
+package deepmon_uptime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+
+	"github.com/influxdata/telegraf/internal/choice"
+)
+
+const (
+	REDIRECT_POLICY_Follow   string = "follow"
+	REDIRECT_POLICY_NoFollow string = "no-follow"
+)
+
+var redirectPolicies = []string{
+	REDIRECT_POLICY_Follow,
+	REDIRECT_POLICY_NoFollow,
+}
+
+const defaultMaxRedirects = 10
+
+// errTooManyRedirects is returned once a request exceeds max_redirects.
+var errTooManyRedirects = errors.New("too many redirects")
+
+// initClient prepares the transport shared by all requests of the plugin.
+func (u *Uptime) initClient() error {
+	if u.RedirectPolicy == "" {
+		u.RedirectPolicy = REDIRECT_POLICY_Follow
+	}
+	if err := choice.Check(u.RedirectPolicy, redirectPolicies); err != nil {
+		return fmt.Errorf("config option redirect_policy: %w", err)
+	}
+	if u.MaxRedirects < 0 {
+		return errors.New("max_redirects cannot be negative")
+	}
+	if u.MaxRedirects == 0 {
+		u.MaxRedirects = defaultMaxRedirects
+	}
+
+	tlsCfg, err := u.ClientConfig.TLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to set TLS config: %w", err)
+	}
+	prox, err := u.HTTPProxy.Proxy()
+	if err != nil {
+		return fmt.Errorf("failed to set proxy: %w", err)
+	}
+	parsedURL, err := url.Parse(u.URL)
+	if err != nil {
+		return err
+	}
+	u.transport = &http.Transport{
+		Proxy:             prox,
+		DialContext:       u.dialer(parsedURL.Hostname()),
+		TLSClientConfig:   tlsCfg,
+		ForceAttemptHTTP2: true,
+	}
+	return nil
+}
+
+// dialer connects in the family selected by ip_version. While an address is
+// pinned the host is connected to that address, other hosts like proxies or
+// redirect targets are resolved as usual.
+func (u *Uptime) dialer(host string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if u.pinned != nil {
+			if h, port, err := net.SplitHostPort(addr); err == nil && h == host {
+				return d.DialContext(ctx, network+dualstack.Version(u.pinned), net.JoinHostPort(u.pinned.String(), port))
+			}
+		}
+		return d.DialContext(ctx, u.Network(network), addr)
+	}
+}
+
+// newClient returns a client applying the redirect policy. Every followed
+// hop is appended to the chain if one is given.
+func (u *Uptime) newClient(chain *[]string) *http.Client {
+	return &http.Client{
+		Transport: u.transport,
+		Timeout:   time.Duration(u.Timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if u.RedirectPolicy == REDIRECT_POLICY_NoFollow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > u.MaxRedirects {
+				return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, u.MaxRedirects)
+			}
+			if chain != nil {
+				*chain = append(*chain, req.URL.String())
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,266 @@
+package deepmon_uptime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+)
+
+// contentState holds the fingerprints of the normalized pages of the last
+// check, persisted across restarts.
+type contentState struct {
+	URL string `json:"url"`
+	// Fingerprints by address when probing both families, the page of a
+	// single check is keyed by an empty address
+	Pages map[string]contentPage `json:"pages"`
+}
+
+// contentPage is the fingerprint of a normalized page.
+type contentPage struct {
+	Hash string `json:"hash"`
+	// Hashes of the normalized lines, used to compare the pages
+	Lines []uint64 `json:"lines"`
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// initContent compiles the regions stripped from the page before it is
+// fingerprinted.
+func (u *Uptime) initContent() error {
+	if !u.ContentCheck {
+		return nil
+	}
+	if u.Method == http.MethodHead {
+		return errors.New("content_check requires a method returning a body")
+	}
+	if u.ContentMinSimilarity < 0 || u.ContentMinSimilarity > 1 {
+		return errors.New("content_min_similarity must be between 0 and 1")
+	}
+
+	u.contentRegex = u.contentRegex[:0]
+	for _, expr := range u.ContentIgnoreRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid content_ignore_regex %q: %w", expr, err)
+		}
+		u.contentRegex = append(u.contentRegex, re)
+	}
+
+	u.contentSelectors = u.contentSelectors[:0]
+	for _, selector := range u.ContentIgnoreSelectors {
+		expr, err := xpath.Compile(selector)
+		if err != nil {
+			return fmt.Errorf("invalid content_ignore_selectors entry %q: %w", selector, err)
+		}
+		u.contentSelectors = append(u.contentSelectors, expr)
+	}
+	return nil
+}
+
+// checkContent fingerprints the page and compares it with the one of the
+// last check of the same address. It adds the content fields and returns the
+// similarity of the pages between 0 and 1.
+func (u *Uptime) checkContent(us *uptimeStats, extra map[string]interface{}) float64 {
+	isHTML := strings.Contains(us.Header.Get("Content-Type"), "html") ||
+		strings.HasPrefix(http.DetectContentType([]byte(us.ResponseBody)), "text/html")
+	lines := u.normalize(us.ResponseBody, isHTML)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	current := contentPage{
+		Hash:  hex.EncodeToString(sum[:]),
+		Lines: make([]uint64, 0, len(lines)),
+	}
+	for _, line := range lines {
+		h := fnv.New64a()
+		h.Write([]byte(line))
+		current.Lines = append(current.Lines, h.Sum64())
+	}
+
+	// Addresses of both families may serve different pages, e.g. from
+	// different servers, so they are compared with their own last page
+	var address string
+	if u.pinned != nil {
+		address = u.pinned.String()
+	}
+	last := u.content.Pages[address]
+
+	// The first fingerprint is the baseline
+	similarity, diff := 1.0, 0
+	changed := last.Hash != "" && last.Hash != current.Hash
+	if changed {
+		common := commonLines(last.Lines, current.Lines)
+		total := len(last.Lines) + len(current.Lines)
+		similarity = float64(2*common) / float64(total)
+		diff = total - 2*common
+	}
+	extra["content_hash"] = current.Hash
+	extra["content_changed"] = changed
+	extra["content_similarity"] = similarity
+	extra["content_diff_size"] = diff
+
+	if u.content.Pages == nil {
+		u.content = contentState{URL: u.URL, Pages: make(map[string]contentPage)}
+	}
+	u.content.Pages[address] = current
+	return similarity
+}
+
+// prunePages drops the fingerprints of addresses the host no longer resolves
+// to, so they do not pile up as the addresses rotate.
+func (u *Uptime) prunePages(ips []net.IP) {
+	resolved := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		resolved[ip.String()] = true
+	}
+	for address := range u.content.Pages {
+		if !resolved[address] {
+			delete(u.content.Pages, address)
+		}
+	}
+}
+
+// normalize strips the ignored regions of the page and returns its lines
+// with collapsed whitespace. HTML pages are reduced to their tags and texts
+// so formatting changes do not count.
+func (u *Uptime) normalize(body string, isHTML bool) []string {
+	for _, re := range u.contentRegex {
+		body = re.ReplaceAllString(body, "")
+	}
+
+	var lines []string
+	add := func(line string) {
+		if line = strings.TrimSpace(whitespace.ReplaceAllString(line, " ")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if isHTML {
+		doc, err := html.Parse(strings.NewReader(body))
+		if err == nil {
+			u.strip(doc)
+			walkHTML(doc, add)
+			return lines
+		}
+	}
+	for _, line := range strings.Split(body, "\n") {
+		add(line)
+	}
+	return lines
+}
+
+// strip removes the elements and attributes matched by the selectors.
+func (u *Uptime) strip(doc *html.Node) {
+	type match struct {
+		node *html.Node
+		attr string
+	}
+	var matches []match
+	for _, expr := range u.contentSelectors {
+		iter := expr.Select(htmlquery.CreateXPathNavigator(doc))
+		for iter.MoveNext() {
+			nav := iter.Current().(*htmlquery.NodeNavigator)
+			m := match{node: nav.Current()}
+			if nav.NodeType() == xpath.AttributeNode {
+				m.attr = nav.LocalName()
+			}
+			matches = append(matches, m)
+		}
+	}
+	// Remove after selecting to not disturb the iteration
+	for _, m := range matches {
+		if m.attr != "" {
+			attrs := m.node.Attr[:0]
+			for _, a := range m.node.Attr {
+				if a.Key != m.attr {
+					attrs = append(attrs, a)
+				}
+			}
+			m.node.Attr = attrs
+		} else if m.node.Parent != nil {
+			m.node.Parent.RemoveChild(m.node)
+		}
+	}
+}
+
+// walkHTML emits a line for every start tag with its attributes and for
+// every text of the document, comments are skipped.
+func walkHTML(n *html.Node, add func(string)) {
+	switch n.Type {
+	case html.ElementNode:
+		var sb strings.Builder
+		sb.WriteString("<" + n.Data)
+		for _, a := range n.Attr {
+			sb.WriteString(fmt.Sprintf(" %s=%q", a.Key, a.Val))
+		}
+		sb.WriteString(">")
+		add(sb.String())
+	case html.TextNode:
+		add(n.Data)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkHTML(c, add)
+	}
+}
+
+// maxDiffCells bounds the work of comparing the lines of two pages, which
+// grows with the product of their numbers of changed lines.
+const maxDiffCells = 1 << 22
+
+// commonLines returns the length of the longest common subsequence of the
+// lines. The common start and end are skipped as changes are usually local.
+// Larger changes only count the lines found in both pages, ignoring their
+// order, to keep the gather fast.
+func commonLines(a, b []uint64) int {
+	var common int
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+		common++
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+		common++
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return common
+	}
+	if len(a)*len(b) > maxDiffCells {
+		counts := make(map[uint64]int, len(a))
+		for _, line := range a {
+			counts[line]++
+		}
+		for _, line := range b {
+			if counts[line] > 0 {
+				counts[line]--
+				common++
+			}
+		}
+		return common
+	}
+
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				curr[j+1] = prev[j] + 1
+			case prev[j+1] >= curr[j]:
+				curr[j+1] = prev[j+1]
+			default:
+				curr[j+1] = curr[j]
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return common + prev[len(b)]
+}
@@ -1,10 +1,24 @@
 package deepmon_uptime
 
 import (
+	"context"
+	"io"
 	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/testutil"
 )
 
 // TC: 1
@@ -43,3 +57,647 @@ func TestInavlidURL(t *testing.T) {
 
 	}
 }
+
+// TC: 2
+// basic auth credentials are set on the request
+func TestAuthBasic(t *testing.T) {
+	uptime := Uptime{
+		URL:      "https://example.com",
+		AuthType: AUTH_TYPE_Basic,
+		Username: config.NewSecret([]byte("user")),
+		Password: config.NewSecret([]byte("pass")),
+	}
+	require.NoError(t, uptime.Init())
+
+	req := httptest.NewRequest(http.MethodGet, uptime.URL, nil)
+	require.NoError(t, uptime.authorize(req))
+	username, password, ok := req.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "user", username)
+	require.Equal(t, "pass", password)
+}
+
+// TC: 3
+// bearer token is set on the request
+func TestAuthBearer(t *testing.T) {
+	uptime := Uptime{
+		URL:      "https://example.com",
+		AuthType: AUTH_TYPE_Bearer,
+		Token:    config.NewSecret([]byte("token\n")),
+	}
+	require.NoError(t, uptime.Init())
+
+	req := httptest.NewRequest(http.MethodGet, uptime.URL, nil)
+	require.NoError(t, uptime.authorize(req))
+	require.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+}
+
+// TC: 4
+// oauth2 token is fetched once and reused while it is valid
+func TestAuthOAuth2(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"abc","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer ts.Close()
+
+	uptime := Uptime{
+		URL:          "https://example.com",
+		AuthType:     AUTH_TYPE_OAuth2,
+		ClientID:     config.NewSecret([]byte("client")),
+		ClientSecret: config.NewSecret([]byte("secret")),
+		TokenURL:     ts.URL,
+	}
+	require.NoError(t, uptime.Init())
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, uptime.URL, nil)
+		require.NoError(t, uptime.authorize(req))
+		require.Equal(t, "Bearer abc", req.Header.Get("Authorization"))
+	}
+	require.Equal(t, int32(1), calls.Load())
+}
+
+// TC: 5
+// locally signed jwt carries the configured claims
+func TestAuthJWT(t *testing.T) {
+	uptime := Uptime{
+		URL:        "https://example.com",
+		AuthType:   AUTH_TYPE_JWT,
+		JWTKey:     config.NewSecret([]byte("signing-key")),
+		JWTIssuer:  "telegraf",
+		JWTSubject: "monitor",
+		JWTClaims:  map[string]string{"scope": "read"},
+	}
+	require.NoError(t, uptime.Init())
+
+	req := httptest.NewRequest(http.MethodGet, uptime.URL, nil)
+	require.NoError(t, uptime.authorize(req))
+	raw, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	require.True(t, found)
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte("signing-key"), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	require.NoError(t, err)
+	require.Equal(t, "telegraf", claims["iss"])
+	require.Equal(t, "monitor", claims["sub"])
+	require.Equal(t, "read", claims["scope"])
+
+	// The token is reused until it gets close to expiring
+	again := httptest.NewRequest(http.MethodGet, uptime.URL, nil)
+	require.NoError(t, uptime.authorize(again))
+	require.Equal(t, req.Header.Get("Authorization"), again.Header.Get("Authorization"))
+}
+
+// TC: 6
+// missing credentials are rejected on init
+func TestAuthInvalidConfig(t *testing.T) {
+	testCase := map[string]Uptime{
+		"config option auth_type: unknown choice digest": {
+			URL: "https://example.com", AuthType: "digest",
+		},
+		"username is required for basic auth": {
+			URL: "https://example.com", AuthType: AUTH_TYPE_Basic,
+		},
+		"token is required for bearer auth": {
+			URL: "https://example.com", AuthType: AUTH_TYPE_Bearer,
+		},
+		"token_url is required for oauth2 auth": {
+			URL: "https://example.com", AuthType: AUTH_TYPE_OAuth2,
+			ClientID: config.NewSecret([]byte("client")), ClientSecret: config.NewSecret([]byte("secret")),
+		},
+		"invalid jwt_signing_method: none": {
+			URL: "https://example.com", AuthType: AUTH_TYPE_JWT,
+			JWTKey: config.NewSecret([]byte("key")), JWTSigningMethod: "none",
+		},
+	}
+	for expected, uptime := range testCase {
+		require.EqualError(t, uptime.Init(), expected)
+	}
+}
+
+// TC: 7
+// status codes, classes and ranges are parsed
+func TestParseStatusRange(t *testing.T) {
+	testCase := map[string]statusRange{
+		"200":     {200, 200},
+		"2xx":     {200, 299},
+		"4XX":     {400, 499},
+		"300-308": {300, 308},
+	}
+	for input, expected := range testCase {
+		r, err := parseStatusRange(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, r)
+	}
+	for _, input := range []string{"", "9xx", "abc", "500-400"} {
+		_, err := parseStatusRange(input)
+		require.Error(t, err, input)
+	}
+}
+
+// TC: 8
+// every failed assertion is reported by name
+func TestAssertions(t *testing.T) {
+	uptime := Uptime{
+		URL:                 "https://example.com",
+		ExpectedStatusCodes: []string{"2xx"},
+		BodyContains:        []string{"healthy", "missing"},
+		BodyRegex:           []string{`"version":\s*"1\.`},
+		JSONPath: []ValueAssertion{
+			{Query: "status", Expected: "ok"},
+			{Query: "checks.db", Expected: "up"},
+		},
+		RequiredHeaders: map[string]string{
+			"content-type": "^application/json",
+			"X-Request-Id": "",
+		},
+		MaxLatency: config.Duration(time.Second),
+	}
+	require.NoError(t, uptime.Init())
+	require.True(t, uptime.hasAssertions())
+
+	stats := &uptimeStats{
+		StatusCode:   200,
+		Latency:      0.2,
+		ResponseBody: `{"status":"ok","version":"1.2","checks":{"db":"down"},"note":"healthy"}`,
+		Header:       http.Header{"Content-Type": []string{"application/json"}},
+	}
+	require.Equal(t, []string{"body_contains[1]", "json_path[checks.db]", "header[X-Request-Id]"}, uptime.assert(stats))
+
+	stats.StatusCode = 503
+	stats.Latency = 1.5
+	failed := uptime.assert(stats)
+	require.Contains(t, failed, "status_code")
+	require.Contains(t, failed, "max_latency")
+}
+
+// TC: 9
+// xpath values are compared against the expected value
+func TestAssertionsXPath(t *testing.T) {
+	uptime := Uptime{
+		URL: "https://example.com",
+		XPath: []ValueAssertion{
+			{Query: "/health/status", Expected: "ok"},
+			{Query: "/health/db", Expected: "up"},
+		},
+	}
+	require.NoError(t, uptime.Init())
+
+	stats := &uptimeStats{ResponseBody: `<health><status>ok</status><db>down</db></health>`}
+	require.Equal(t, []string{"xpath[/health/db]"}, uptime.assert(stats))
+
+	uptime.XPath = []ValueAssertion{{Query: "///"}}
+	require.Error(t, uptime.Init())
+}
+
+// TC: 10
+// the request phases are traced and connection reuse is detected
+func TestPhaseTimings(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	client := ts.Client()
+
+	get := func() phaseTimings {
+		timer := newPhaseTimer()
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		require.NoError(t, err)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), timer.clientTrace()))
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		timer.done()
+		require.NoError(t, resp.Body.Close())
+		return timer.timings()
+	}
+
+	first := get()
+	require.False(t, first.ConnReused)
+	require.Equal(t, "127.0.0.1", first.RemoteIP)
+	require.Positive(t, first.TCPConnect)
+	require.Positive(t, first.TLSHandshake)
+	require.GreaterOrEqual(t, first.TimeToFirstByte, (10 * time.Millisecond).Seconds())
+	require.GreaterOrEqual(t, first.Total, first.TCPConnect+first.TLSHandshake+first.TimeToFirstByte)
+
+	second := get()
+	require.True(t, second.ConnReused)
+	require.Zero(t, second.TCPConnect)
+	require.Zero(t, second.TLSHandshake)
+
+	fields := make(map[string]interface{})
+	second.addFields(fields)
+	require.Equal(t, true, fields["connection_reused"])
+	require.Contains(t, fields, "dns_lookup")
+}
+
+// TC: 11
+// transaction steps pass extracted values and cookies to the next step
+func TestTransaction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+			w.Header().Set("X-Request-Id", "r1")
+			_, _ = w.Write([]byte(`{"access_token":"abc"}`))
+		case "/items":
+			cookie, err := r.Cookie("session")
+			if err != nil || cookie.Value != "s1" || r.Header.Get("Authorization") != "Bearer abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`<p>item id=42</p>`))
+		case "/items/42":
+			if r.Method != http.MethodDelete || r.Header.Get("X-Trace") != "r1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	uptime := Uptime{
+		URL: ts.URL,
+		Steps: []Step{
+			{
+				Name:   "login",
+				URL:    ts.URL + "/login",
+				Method: http.MethodPost,
+				Extract: []Extraction{
+					{Name: "token", From: EXTRACT_FROM_JSON, Query: "access_token"},
+					{Name: "request", From: EXTRACT_FROM_Header, Query: "x-request-id"},
+					{Name: "session", From: EXTRACT_FROM_Cookie, Query: "session"},
+				},
+			},
+			{
+				URL:     ts.URL + "/items",
+				Headers: map[string]string{"Authorization": "Bearer ${token}"},
+				Extract: []Extraction{{Name: "id", From: EXTRACT_FROM_Regex, Query: `id=(\d+)`}},
+			},
+			{
+				Name:                "delete",
+				URL:                 ts.URL + "/items/${id}",
+				Method:              http.MethodDelete,
+				Headers:             map[string]string{"X-Trace": "${request}"},
+				ExpectedStatusCodes: []string{"204"},
+			},
+		},
+	}
+	require.NoError(t, uptime.Init())
+	require.Equal(t, "step2", uptime.Steps[1].Name)
+
+	var acc testutil.Accumulator
+	require.NoError(t, uptime.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Len(t, acc.Metrics, 1)
+	fields := acc.Metrics[0].Fields
+	require.Equal(t, 3, fields["steps_total"])
+	require.Equal(t, 3, fields["steps_passed"])
+	require.Equal(t, "", fields["failed_step"])
+	require.Equal(t, 204, fields["step_delete_status_code"])
+	require.Equal(t, true, fields["step_step2_passed"])
+
+	// A failing step stops the transaction
+	uptime.Steps[2].ExpectedStatusCodes = []string{"200"}
+	require.NoError(t, uptime.Init())
+	acc.ClearMetrics()
+	require.NoError(t, uptime.Gather(&acc))
+	fields = acc.Metrics[0].Fields
+	require.Equal(t, 2, fields["steps_passed"])
+	require.Equal(t, "delete", fields["failed_step"])
+	require.Equal(t, "unexpected status code 204", fields["step_delete_error"])
+}
+
+// TC: 12
+// invalid steps are rejected on init
+func TestTransactionInvalidConfig(t *testing.T) {
+	testCase := map[string][]Step{
+		`duplicate step name "a"`:                                      {{Name: "a"}, {Name: "a"}},
+		`step "a": invalid protocol: ftp`:                              {{Name: "a", URL: "ftp://example.com"}},
+		`step "a": config option from: unknown choice xml`:             {{Name: "a", Extract: []Extraction{{Name: "v", From: "xml", Query: "q"}}}},
+		`step "a": extract needs a name and a query`:                   {{Name: "a", Extract: []Extraction{{From: "json"}}}},
+		`step "a": regex "(a)(b)" must have at most one capture group`: {{Name: "a", Extract: []Extraction{{Name: "v", From: "regex", Query: "(a)(b)"}}}},
+	}
+	for expected, steps := range testCase {
+		uptime := Uptime{URL: "https://example.com", Steps: steps}
+		require.EqualError(t, uptime.Init(), expected)
+	}
+}
+
+// TC: 13
+// the configured URL is used as-is and redirects follow the policy
+func TestRedirectPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		case "/c":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	gather := func(u *Uptime) map[string]interface{} {
+		var acc testutil.Accumulator
+		require.NoError(t, u.Init())
+		require.NoError(t, u.Gather(&acc))
+		require.Len(t, acc.Metrics, 1)
+		return acc.Metrics[0].Fields
+	}
+
+	fields := gather(&Uptime{URL: ts.URL + "/a", Method: http.MethodGet})
+	require.Equal(t, 401, fields["status_code"])
+	require.Equal(t, 2, fields["redirect_count"])
+	require.Equal(t, ts.URL+"/a -> "+ts.URL+"/b -> "+ts.URL+"/c", fields["redirect_chain"])
+
+	fields = gather(&Uptime{URL: ts.URL + "/a", RedirectPolicy: REDIRECT_POLICY_NoFollow})
+	require.Equal(t, 301, fields["status_code"])
+	require.Equal(t, 0, fields["redirect_count"])
+
+	fields = gather(&Uptime{URL: ts.URL + "/a", MaxRedirects: 1})
+	require.Equal(t, 0, fields["status_code"])
+	require.Equal(t, 1, fields["redirect_count"])
+}
+
+// TC: 14
+// a custom CA is used to verify the server
+func TestTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	var acc testutil.Accumulator
+	uptime := Uptime{URL: ts.URL}
+	require.NoError(t, uptime.Init())
+	require.NoError(t, uptime.Gather(&acc))
+	require.Equal(t, 0, acc.Metrics[0].Fields["status_code"])
+
+	acc.ClearMetrics()
+	uptime = Uptime{URL: ts.URL}
+	uptime.InsecureSkipVerify = true
+	require.NoError(t, uptime.Init())
+	require.NoError(t, uptime.Gather(&acc))
+	require.Equal(t, 200, acc.Metrics[0].Fields["status_code"])
+
+	require.EqualError(t, (&Uptime{URL: ts.URL, RedirectPolicy: "never"}).Init(), "config option redirect_policy: unknown choice never")
+}
+
+// TC: 15
+// dropped connections are retried and failures confirmed across gathers
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Int32
+	var hijackErr atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		if failing.Add(-1) < 0 {
+			return
+		}
+		// Errors are checked on the test goroutine
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			hijackErr.Store(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	uptime := Uptime{URL: ts.URL}
+	uptime.Retries = 2
+	uptime.RetryBackoff = config.Duration(time.Millisecond)
+	uptime.ConfirmAfter = 2
+	require.NoError(t, uptime.Init())
+
+	// Recovers on the last retry
+	var acc testutil.Accumulator
+	failing.Store(2)
+	require.NoError(t, uptime.Gather(&acc))
+	require.Equal(t, int32(3), requests.Load())
+	fields := acc.Metrics[0].Fields
+	require.Equal(t, 200, fields["status_code"])
+	require.Equal(t, 3, fields["attempts"])
+	require.Equal(t, 0, fields["consecutive_failures"])
+	require.Equal(t, false, fields["confirmed_down"])
+
+	// Failures are only confirmed on the second gather
+	for i := 1; i <= 2; i++ {
+		acc.ClearMetrics()
+		failing.Store(3)
+		require.NoError(t, uptime.Gather(&acc))
+		fields = acc.Metrics[0].Fields
+		require.Equal(t, 3, fields["attempts"])
+		require.Equal(t, i, fields["consecutive_failures"])
+		require.Equal(t, i == 2, fields["confirmed_down"])
+	}
+	require.Nil(t, hijackErr.Load())
+}
+
+// TC: 16
+// page changes are detected against the last fingerprint, ignored regions
+// and formatting do not count
+func TestContentChange(t *testing.T) {
+	var page atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(page.Load().(string)))
+	}))
+	defer ts.Close()
+
+	uptime := Uptime{
+		URL:                    ts.URL,
+		ContentCheck:           true,
+		ContentIgnoreRegex:     []string{`\d{2}:\d{2}`},
+		ContentIgnoreSelectors: []string{"//script", "//div[contains(concat(' ', @class, ' '), ' ad ')]", "//@data-nonce"},
+		ContentMinSimilarity:   0.5,
+	}
+	require.NoError(t, uptime.Init())
+	require.Equal(t, http.MethodGet, uptime.Method)
+
+	gather := func(body string) map[string]interface{} {
+		page.Store(body)
+		var acc testutil.Accumulator
+		require.NoError(t, uptime.Gather(&acc))
+		return acc.Metrics[0].Fields
+	}
+
+	original := `<html><body data-nonce="a1"><h1>Shop</h1><p>Open 10:00</p><div class="banner ad">Sale</div>
+<script>var t = 1 < 2;</script><ul><li>One</li><li>Two</li><li>Three</li></ul></body></html>`
+	fields := gather(original)
+	require.Equal(t, false, fields["content_changed"])
+	require.InDelta(t, 1.0, fields["content_similarity"], 0)
+	hash := fields["content_hash"]
+
+	// Only ignored regions and formatting differ
+	fields = gather(`<html>
+  <body data-nonce="b2"><h1>Shop</h1>  <p>Open   12:30</p><div class="ad">Other sale</div>
+  <script>var t = 3;</script><ul><li>One</li><li>Two</li><li>Three</li></ul></body></html>`)
+	require.Equal(t, false, fields["content_changed"])
+	require.Equal(t, hash, fields["content_hash"])
+	require.Equal(t, 0, fields["content_diff_size"])
+
+	// A changed item
+	fields = gather(strings.Replace(original, "Two", "2", 1))
+	require.Equal(t, true, fields["content_changed"])
+	require.NotEqual(t, hash, fields["content_hash"])
+	require.Equal(t, 2, fields["content_diff_size"])
+	require.EqualValues(t, 0, fields["result"])
+	require.Greater(t, fields["content_similarity"], 0.8)
+
+	// A swapped page
+	fields = gather(`<html><body><h1>Hacked</h1></body></html>`)
+	require.Equal(t, true, fields["content_changed"])
+	require.Less(t, fields["content_similarity"], 0.5)
+	require.NotEqualValues(t, 0, fields["result"])
+
+	// The fingerprint is kept across restarts for the same URL
+	restarted := Uptime{URL: ts.URL, ContentCheck: true}
+	require.NoError(t, restarted.SetState(uptime.GetState()))
+	require.Equal(t, uptime.content, restarted.content)
+	other := Uptime{URL: "https://example.com", ContentCheck: true}
+	require.NoError(t, other.SetState(uptime.GetState()))
+	require.Empty(t, other.content.Pages)
+	require.Error(t, other.SetState(map[string]int{}))
+}
+
+// TC: 17
+// XPath selectors strip elements and attributes, the pages are compared
+// line by line
+func TestContentSelectors(t *testing.T) {
+	uptime := Uptime{
+		URL:                    "https://example.com",
+		ContentCheck:           true,
+		ContentIgnoreSelectors: []string{"//*[@id='count']", "//meta[@name='csrf']/@content", "//ul/li[2]"},
+	}
+	require.NoError(t, uptime.Init())
+	lines := uptime.normalize(`<html><head><meta name="csrf" content="x1"></head>
+<body><p id="count">42</p><ul><li>One</li><li>Two</li></ul></body></html>`, true)
+	require.Equal(t, []string{"<html>", "<head>", `<meta name="csrf">`, "<body>", "<ul>", "<li>", "One"}, lines)
+
+	uptime = Uptime{URL: "https://example.com", ContentCheck: true, ContentIgnoreSelectors: []string{"#count"}}
+	require.ErrorContains(t, uptime.Init(), "invalid content_ignore_selectors")
+	uptime = Uptime{URL: "https://example.com", ContentCheck: true, Method: http.MethodHead}
+	require.ErrorContains(t, uptime.Init(), "content_check requires")
+	uptime = Uptime{URL: "https://example.com", ContentCheck: true, ContentMinSimilarity: 2}
+	require.ErrorContains(t, uptime.Init(), "content_min_similarity")
+
+	require.Equal(t, 3, commonLines([]uint64{1, 2, 3, 4, 5}, []uint64{1, 3, 2, 5}))
+	// Large changes only count the shared lines
+	a := make([]uint64, 4096)
+	b := make([]uint64, 4096)
+	for i := range a {
+		a[i], b[i] = uint64(i), uint64(len(b)-i)
+	}
+	require.Equal(t, 4095, commonLines(a, b))
+}
+
+// TC: 18
+// every address of the host is checked on its own and a broken IPv6 address
+// is reported while IPv4 works, the pages are fingerprinted per address
+func TestDualStack(t *testing.T) {
+	var host atomic.Value
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		w.WriteHeader(http.StatusOK)
+		// The families are served by different servers
+		local := r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+		_, _ = w.Write([]byte("served by " + local))
+	})
+	l4, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(l4.Addr().String())
+	require.NoError(t, err)
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		l4.Close()
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	ts4 := &httptest.Server{Listener: l4, Config: &http.Server{Handler: handler}}
+	ts4.Start()
+	defer ts4.Close()
+	ts6 := &httptest.Server{Listener: l6, Config: &http.Server{Handler: handler}}
+	ts6.Start()
+
+	uptime := Uptime{URL: "http://dualstack.example.com:" + port, ContentCheck: true, ContentMinSimilarity: 0.5}
+	uptime.IPVersion = dualstack.VERSION_Both
+	uptime.LookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	require.NoError(t, uptime.Init())
+
+	gather := func() (map[string]map[string]interface{}, map[string]interface{}) {
+		var acc testutil.Accumulator
+		require.NoError(t, uptime.Gather(&acc))
+		results := make(map[string]map[string]interface{})
+		var verdict map[string]interface{}
+		for _, m := range acc.Metrics {
+			switch m.Measurement {
+			case pluginName:
+				results[m.Tags["ip_address"]] = m.Fields
+			case pluginName + "_dualstack":
+				verdict = m.Fields
+			}
+		}
+		return results, verdict
+	}
+
+	results, verdict := gather()
+	require.Len(t, results, 2)
+	require.Equal(t, 200, results["127.0.0.1"]["status_code"])
+	require.Equal(t, 200, results["::1"]["status_code"])
+	require.Equal(t, "::1", results["::1"]["remote_ip"])
+	require.Equal(t, dualstack.VERDICT_DualStack, verdict["verdict"])
+	// The host of the URL is kept when connecting to an address
+	require.Equal(t, "dualstack.example.com:"+port, host.Load())
+
+	// The pages of the addresses are not compared with each other
+	results, _ = gather()
+	for _, address := range []string{"127.0.0.1", "::1"} {
+		require.Equal(t, false, results[address]["content_changed"], address)
+		require.EqualValues(t, 0, results[address]["result"], address)
+	}
+	require.Len(t, uptime.content.Pages, 2)
+
+	// The pages of addresses the host no longer resolves to are dropped
+	lookup := uptime.LookupIPAddr
+	uptime.LookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	results, _ = gather()
+	require.Len(t, results, 1)
+	require.Len(t, uptime.content.Pages, 1)
+	require.Contains(t, uptime.content.Pages, "127.0.0.1")
+	uptime.LookupIPAddr = lookup
+
+	ts6.Close()
+	results, verdict = gather()
+	require.Equal(t, 200, results["127.0.0.1"]["status_code"])
+	require.Equal(t, 0, results["::1"]["status_code"])
+	require.Equal(t, dualstack.VERDICT_IPv6Broken, verdict["verdict"])
+	require.Equal(t, 1, verdict["ipv6_failed"])
+
+	// A single family restricts the connection
+	uptime = Uptime{URL: "http://localhost:" + port}
+	uptime.IPVersion = dualstack.VERSION_4
+	require.NoError(t, uptime.Init())
+	var acc testutil.Accumulator
+	require.NoError(t, uptime.Gather(&acc))
+	require.Equal(t, 200, acc.Metrics[0].Fields["status_code"])
+}
@@ -3,24 +3,34 @@ package deepmon_uptime
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/antchfx/xpath"
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/config"
 	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/influxdata/telegraf/plugins/common/dualstack"
+	"github.com/influxdata/telegraf/plugins/common/proxy"
+	"github.com/influxdata/telegraf/plugins/common/retry"
+	"github.com/influxdata/telegraf/plugins/common/targets"
+	"github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	"golang.org/x/net/idna"
+	"golang.org/x/oauth2"
 )
 
-// TODO: Testler ve Auth metotların eklenmesi gerekiyor (Basic, Bearer, JWT, OAuth2)
 type Uptime struct {
 	URL         string              `toml:"url"`
 	Method      string              `toml:"method"`
@@ -31,6 +41,71 @@ type Uptime struct {
 	ContentType string              `toml:"content_type"`
 	Body        string              `toml:"body"`
 	Timeout     config.Duration     `toml:"timeout"`
+
+	// Redirects (follow, no-follow)
+	RedirectPolicy string `toml:"redirect_policy"`
+	MaxRedirects   int    `toml:"max_redirects"`
+
+	tls.ClientConfig
+	proxy.HTTPProxy
+	targets.Batch
+	retry.Policy
+	dualstack.Stack
+
+	// Authentication (basic, bearer, oauth2, jwt)
+	AuthType string `toml:"auth_type"`
+	// Basic authentication
+	Username config.Secret `toml:"username"`
+	Password config.Secret `toml:"password"`
+	// Bearer authentication
+	Token config.Secret `toml:"token"`
+	// OAuth2 client-credentials authentication
+	ClientID     config.Secret `toml:"client_id"`
+	ClientSecret config.Secret `toml:"client_secret"`
+	TokenURL     string        `toml:"token_url"`
+	Audience     string        `toml:"audience"`
+	Scopes       []string      `toml:"scopes"`
+	// Locally signed JWT authentication
+	JWTKey           config.Secret     `toml:"jwt_key"`
+	JWTSigningMethod string            `toml:"jwt_signing_method"`
+	JWTIssuer        string            `toml:"jwt_issuer"`
+	JWTSubject       string            `toml:"jwt_subject"`
+	JWTAudience      string            `toml:"jwt_audience"`
+	JWTClaims        map[string]string `toml:"jwt_claims"`
+	JWTExpiry        config.Duration   `toml:"jwt_expiry"`
+
+	// Response assertions
+	ExpectedStatusCodes []string          `toml:"expected_status_codes"`
+	BodyContains        []string          `toml:"body_contains"`
+	BodyRegex           []string          `toml:"body_regex"`
+	JSONPath            []ValueAssertion  `toml:"json_path"`
+	XPath               []ValueAssertion  `toml:"xpath"`
+	RequiredHeaders     map[string]string `toml:"required_headers"`
+	MaxLatency          config.Duration   `toml:"max_latency"`
+
+	// Content change detection
+	ContentCheck           bool     `toml:"content_check"`
+	ContentIgnoreRegex     []string `toml:"content_ignore_regex"`
+	ContentIgnoreSelectors []string `toml:"content_ignore_selectors"`
+	ContentMinSimilarity   float64  `toml:"content_min_similarity"`
+
+	// Multi-step transaction, replaces the single request when set
+	Steps []Step `toml:"step"`
+
+	transport    *http.Transport
+	tokenSource  oauth2.TokenSource
+	jwtSigner    *jwtSigner
+	statusRanges []statusRange
+	bodyRegex    []*regexp.Regexp
+	headerRegex  map[string]*regexp.Regexp
+
+	contentRegex     []*regexp.Regexp
+	contentSelectors []*xpath.Expr
+	// fingerprints of the last pages, persisted across restarts
+	content contentState
+	// address the host of the URL is connected to, set while probing the
+	// addresses of both families
+	pinned net.IP
 }
 
 const (
@@ -70,6 +145,16 @@ func (u *Uptime) SampleConfig() string {
 }
 
 func (u *Uptime) Init() error {
+	if u.HasTargets() {
+		return u.InitTargets(func(target targets.Target) (telegraf.Input, error) {
+			child := *u
+			child.Batch = targets.Batch{}
+			child.URL = target.Address
+			// Steps default to the URL of the target
+			child.Steps = cloneSteps(u.Steps)
+			return &child, child.Init()
+		})
+	}
 	if u.URL == "" {
 		return fmt.Errorf("url is missing")
 	}
@@ -104,6 +189,10 @@ func (u *Uptime) Init() error {
 
 	if u.Method == "" {
 		u.Method = http.MethodHead
+		// Fingerprinting needs the body
+		if u.ContentCheck {
+			u.Method = http.MethodGet
+		}
 	}
 	if err := choice.Check(u.Method, methods); err != nil {
 		return err
@@ -120,11 +209,137 @@ func (u *Uptime) Init() error {
 	if u.Timeout == 0 {
 		u.Timeout = config.Duration(5 * time.Second)
 	}
-	return nil
+	if err := u.InitRetries(); err != nil {
+		return err
+	}
+	if err := u.InitStack(); err != nil {
+		return err
+	}
+	if err := u.initClient(); err != nil {
+		return err
+	}
+	if err := choice.Check(u.AuthType, authTypes); err != nil {
+		return fmt.Errorf("config option auth_type: %w", err)
+	}
+	if err := u.initAuth(); err != nil {
+		return err
+	}
+	if err := u.initAssertions(); err != nil {
+		return err
+	}
+	if err := u.initContent(); err != nil {
+		return err
+	}
+	return u.initSteps()
 }
 
 func (u *Uptime) Gather(acc telegraf.Accumulator) error {
-	u.sendData(acc)
+	if u.HasTargets() {
+		return u.GatherTargets(acc)
+	}
+	// Start every check with a fresh connection so the dial and handshake
+	// are part of the measurement
+	defer u.transport.CloseIdleConnections()
+
+	if u.Both() {
+		return u.gatherBoth(acc)
+	}
+	fields, extra := u.check(acc, "")
+	if fields == nil {
+		return nil
+	}
+	tags := monitors.MonitorData[*monitors.UptimeData]{
+		Domain: u.URL,
+		Data:   fields,
+	}
+	addFields(acc, tags, extra, nil)
+	return nil
+}
+
+// gatherBoth checks the URL at every IPv4 and IPv6 address of its host on its
+// own and judges the reachability of the address families.
+func (u *Uptime) gatherBoth(acc telegraf.Accumulator) error {
+	defer func() { u.pinned = nil }()
+
+	var report dualstack.Report
+	parsedURL, err := url.Parse(u.URL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(u.Timeout))
+	ips, err := u.Resolve(ctx, parsedURL.Hostname())
+	cancel()
+	if err != nil {
+		tags := monitors.MonitorData[*monitors.UptimeData]{
+			Domain: u.URL,
+			Data: &monitors.UptimeData{
+				Result: monitors.ConnectionFailed,
+				Access: monitors.StatusFailed,
+			},
+		}
+		addFields(acc, tags, map[string]interface{}{"error": err.Error()}, nil)
+		report.AddTo(acc, pluginName, u.URL)
+		return nil
+	}
+
+	u.prunePages(ips)
+	for _, ip := range ips {
+		u.pinned = ip
+		fields, extra := u.check(acc, ip.String())
+		if fields == nil {
+			continue
+		}
+		report.Add(ip, fields.Result == monitors.Success)
+		tags := monitors.MonitorData[*monitors.UptimeData]{
+			Domain: u.URL,
+			Data:   fields,
+		}
+		addFields(acc, tags, extra, ip)
+	}
+	report.AddTo(acc, pluginName, u.URL)
+	return nil
+}
+
+// check runs the request or transaction and retries connection failures and
+// timeouts with fresh connections. Failures are confirmed per key.
+func (u *Uptime) check(acc telegraf.Accumulator, key string) (*monitors.UptimeData, map[string]interface{}) {
+	var fields *monitors.UptimeData
+	var extra map[string]interface{}
+	attempts := u.Attempt(func() bool {
+		u.transport.CloseIdleConnections()
+		if len(u.Steps) > 0 {
+			fields, extra = u.runTransaction(acc)
+		} else {
+			fields, extra = u.sendData(acc)
+		}
+		return fields != nil && (fields.Result == monitors.Timeout || fields.Result == monitors.ConnectionFailed)
+	})
+	if fields == nil {
+		return nil, nil
+	}
+	u.Confirm(key, fields.Result != monitors.Success, attempts, extra)
+	return fields, extra
+}
+
+func (u *Uptime) GetState() interface{} {
+	if u.HasTargets() {
+		return u.TargetsState()
+	}
+	return u.content
+}
+
+func (u *Uptime) SetState(state interface{}) error {
+	if u.HasTargets() {
+		return u.SetTargetsState(state)
+	}
+	content, ok := state.(contentState)
+	if !ok {
+		return errors.New("state has to be of type 'contentState'")
+	}
+	// The fingerprint of a former URL is meaningless
+	if content.URL == u.URL {
+		u.content = content
+	}
 	return nil
 }
 
@@ -138,11 +353,14 @@ type uptimeStats struct {
 	Latency        float64
 	StatusCode     int
 	ResponseHeader string
+	Header         http.Header
 	ResponseBody   string
 	ContentLength  int64
 	ReqMethod      string
 	ReqHost        string
 	Protocol       string
+	Timings        *phaseTimings
+	RedirectChain  []string
 }
 
 // If parameter is Get, run this function ???
@@ -150,16 +368,11 @@ func (u *Uptime) gohttp() (*uptimeStats, error) {
 	us := &uptimeStats{}
 	start := time.Now()
 
-	//url kontrolü yaparak başına http veya https ekler
-	correctedUrl, err := u.checkProtocol()
-	if err != nil {
-		return nil, err
-	}
-	client := &http.Client{
-		Timeout: time.Duration(u.Timeout),
-	}
+	// The configured URL is requested as-is, including its scheme
+	us.RedirectChain = []string{u.URL}
+	client := u.newClient(&us.RedirectChain)
 	//http.NewRequest() kullanılacak
-	req, err := http.NewRequest(u.Method, correctedUrl, bytes.NewBuffer([]byte(u.Body))) //Body de opsiyonel eğer set edilmişse eklensin
+	req, err := http.NewRequest(u.Method, u.URL, bytes.NewBuffer([]byte(u.Body))) //Body de opsiyonel eğer set edilmişse eklensin
 	if err != nil {
 		us.Latency = 0
 		return us, err
@@ -201,10 +414,23 @@ func (u *Uptime) gohttp() (*uptimeStats, error) {
 		req.Header.Add("Content-Type", u.ContentType)
 	}
 
+	// Add Authorization
+	if err := u.authorize(req); err != nil {
+		return us, fmt.Errorf("%w: %w", errAuth, err)
+	}
+
 	//Request Datas
 	us.ReqMethod = req.Method
 	us.ReqHost = req.Host
 
+	// Trace the request phases, the breakdown is also kept for failed requests
+	timer := newPhaseTimer()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timer.clientTrace()))
+	defer func() {
+		timings := timer.timings()
+		us.Timings = &timings
+	}()
+
 	// Send the request
 
 	resp, err := client.Do(req)
@@ -221,6 +447,7 @@ func (u *Uptime) gohttp() (*uptimeStats, error) {
 		}
 	}
 	us.ResponseHeader = headersString.String()
+	us.Header = resp.Header
 
 	//Response Datas
 	us.Latency = float64(time.Since(start).Seconds())
@@ -230,6 +457,7 @@ func (u *Uptime) gohttp() (*uptimeStats, error) {
 
 	// Read and return the response body
 	respBody, err := io.ReadAll(resp.Body)
+	timer.done()
 	if err != nil {
 		return us, err
 	}
@@ -239,22 +467,31 @@ func (u *Uptime) gohttp() (*uptimeStats, error) {
 	return us, nil
 }
 
-func (u *Uptime) sendData(acc telegraf.Accumulator) {
+// sendData requests the URL and returns the fields of the result.
+func (u *Uptime) sendData(acc telegraf.Accumulator) (*monitors.UptimeData, map[string]interface{}) {
 	fields := &monitors.UptimeData{}
 	fields.Access = monitors.StatusFailed
-	tags := monitors.MonitorData[*monitors.UptimeData]{
-		Domain: u.URL,
-		Data:   fields,
-	}
+	// Fields that are not part of UptimeData are emitted on top of it
+	extra := make(map[string]interface{})
 	stats, err := u.gohttp()
+	if stats.Timings != nil {
+		stats.Timings.addFields(extra)
+	}
+	extra["redirect_count"] = len(stats.RedirectChain) - 1
+	extra["redirect_chain"] = strings.Join(stats.RedirectChain, " -> ")
 	if err != nil {
-		if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
+		var netErr net.Error
+		if errors.Is(err, errAuth) {
+			fields.Result = monitors.Failed
+			acc.AddError(err)
+		} else if errors.Is(err, errTooManyRedirects) {
+			fields.Result = monitors.Failed
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
 			fields.Result = monitors.Timeout //Buraya io error da gelecek
 		} else {
 			fields.Result = monitors.ConnectionFailed
 		}
-		acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
-		return
+		return fields, extra
 	}
 
 	//resp dataları field'a buradan ekleniyor
@@ -269,37 +506,39 @@ func (u *Uptime) sendData(acc telegraf.Accumulator) {
 	fields.ReqHost = stats.ReqHost //If empty, the Request.Write method uses the value of URL.Host.
 	fields.Protocol = stats.Protocol
 
-	acc.AddFields(pluginName, tags.GetFields(), tags.GetTags())
-
-}
-
-func (u *Uptime) checkProtocol() (string, error) {
-	// Define the protocols to check in order
-	protocols := []string{"http", "https"}
-
-	// Iterate over each protocol
-	for _, protocol := range protocols {
-		// Build the full URL
-		fullURL := protocol + "://" + u.URL
-
-		// Send the request
-		client := &http.Client{
-			Timeout: 5 * time.Second, // Set a timeout to avoid hanging
-		}
-		resp, err := client.Get(fullURL)
-		if err != nil {
-			continue // If there's an error, try the next protocol
+	if u.hasAssertions() {
+		failed := u.assert(stats)
+		if len(failed) > 0 {
+			fields.Result = monitors.Failed
+			fields.Access = monitors.StatusFailed
 		}
+		extra["assertions_passed"] = len(failed) == 0
+		extra["failed_assertions"] = strings.Join(failed, ",")
+	}
 
-		// Close the response body
-		defer resp.Body.Close()
-
-		// Check the status code
-		if resp.StatusCode == http.StatusOK {
-			return fullURL, nil // Return the URL if accessible
+	// Only pages of successful checks are fingerprinted so outages do not
+	// count as changes
+	if u.ContentCheck && fields.Result == monitors.Success && stats.StatusCode < 400 {
+		if u.checkContent(stats, extra) < u.ContentMinSimilarity {
+			fields.Result = monitors.StringMismatch
+			fields.Access = monitors.StatusFailed
 		}
 	}
 
-	// If neither HTTPS nor HTTP is accessible, return an error
-	return "", fmt.Errorf("neither HTTPS nor HTTP is accessible for %s", u.URL)
+	return fields, extra
+}
+
+// addFields emits the UptimeData fields merged with the extra fields, tagged
+// with the connected address if one is given.
+func addFields(acc telegraf.Accumulator, tags monitors.MonitorData[*monitors.UptimeData], extra map[string]interface{}, ip net.IP) {
+	data := tags.GetFields()
+	for k, v := range extra {
+		data[k] = v
+	}
+	t := tags.GetTags()
+	if ip != nil {
+		t["ip_address"] = ip.String()
+		t["ip_version"] = dualstack.Version(ip)
+	}
+	acc.AddFields(pluginName, data, t)
 }
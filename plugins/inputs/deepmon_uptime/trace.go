@@ -0,0 +1,132 @@
+package deepmon_uptime
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// phaseTimer records the timestamps of the individual request phases through
+// net/http/httptrace.
+type phaseTimer struct {
+	sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+	remoteIP     string
+	reused       bool
+}
+
+// phaseTimings is the per-phase breakdown of a request in seconds. Phases that
+// did not happen, e.g. DNS on a reused connection, are zero.
+type phaseTimings struct {
+	DNSLookup       float64
+	TCPConnect      float64
+	TLSHandshake    float64
+	TimeToFirstByte float64
+	ContentTransfer float64
+	Total           float64
+	RemoteIP        string
+	ConnReused      bool
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now()}
+}
+
+func (p *phaseTimer) mark(t *time.Time) {
+	p.Lock()
+	*t = time.Now()
+	p.Unlock()
+}
+
+func (p *phaseTimer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { p.mark(&p.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { p.mark(&p.dnsDone) },
+		ConnectStart: func(_, _ string) {
+			p.Lock()
+			// Only the first dial attempt counts, happy-eyeballs may start more
+			if p.connectStart.IsZero() {
+				p.connectStart = time.Now()
+			}
+			p.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				p.mark(&p.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() { p.mark(&p.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { p.mark(&p.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.Lock()
+			p.reused = info.Reused
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				p.remoteIP = addr.IP.String()
+			} else if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				p.remoteIP = host
+			}
+			p.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.mark(&p.wroteRequest) },
+		GotFirstResponseByte: func() { p.mark(&p.firstByte) },
+	}
+}
+
+// done marks the end of the content transfer.
+func (p *phaseTimer) done() {
+	p.mark(&p.bodyDone)
+}
+
+func (p *phaseTimer) timings() phaseTimings {
+	p.Lock()
+	defer p.Unlock()
+
+	end := p.bodyDone
+	if end.IsZero() {
+		end = time.Now()
+	}
+	t := phaseTimings{
+		DNSLookup:    between(p.dnsStart, p.dnsDone),
+		TCPConnect:   between(p.connectStart, p.connectDone),
+		TLSHandshake: between(p.tlsStart, p.tlsDone),
+		Total:        end.Sub(p.start).Seconds(),
+		RemoteIP:     p.remoteIP,
+		ConnReused:   p.reused,
+	}
+	if !p.firstByte.IsZero() {
+		// Time to first byte is measured from the moment the request was
+		// written, so it reflects the server processing time
+		t.TimeToFirstByte = between(p.wroteRequest, p.firstByte)
+		t.ContentTransfer = between(p.firstByte, p.bodyDone)
+	}
+	return t
+}
+
+func between(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from).Seconds()
+}
+
+func (t phaseTimings) addFields(fields map[string]interface{}) {
+	fields["dns_lookup"] = t.DNSLookup
+	fields["tcp_connect"] = t.TCPConnect
+	fields["tls_handshake"] = t.TLSHandshake
+	fields["time_to_first_byte"] = t.TimeToFirstByte
+	fields["content_transfer"] = t.ContentTransfer
+	fields["total_time"] = t.Total
+	fields["remote_ip"] = t.RemoteIP
+	fields["connection_reused"] = t.ConnReused
+}
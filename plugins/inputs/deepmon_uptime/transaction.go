@@ -0,0 +1,333 @@
+package deepmon_uptime
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Deepreo/MonitoringTime-Backend/pkg/monitors"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal/choice"
+	"github.com/tidwall/gjson"
+)
+
+// Step is a single request of a multi-step transaction. Values extracted by
+// previous steps can be referenced as ${name} in the url, headers and body.
+type Step struct {
+	Name                string            `toml:"name"`
+	URL                 string            `toml:"url"`
+	Method              string            `toml:"method"`
+	Headers             map[string]string `toml:"headers"`
+	ContentType         string            `toml:"content_type"`
+	Body                string            `toml:"body"`
+	ExpectedStatusCodes []string          `toml:"expected_status_codes"`
+	Extract             []Extraction      `toml:"extract"`
+
+	statusRanges []statusRange
+}
+
+// Extraction stores a value of a step's response in a variable.
+type Extraction struct {
+	Name  string `toml:"name"`
+	From  string `toml:"from"`
+	Query string `toml:"query"`
+
+	re *regexp.Regexp
+}
+
+const (
+	EXTRACT_FROM_JSON   string = "json"
+	EXTRACT_FROM_Regex  string = "regex"
+	EXTRACT_FROM_Header string = "header"
+	EXTRACT_FROM_Cookie string = "cookie"
+)
+
+var extractSources = []string{
+	EXTRACT_FROM_JSON,
+	EXTRACT_FROM_Regex,
+	EXTRACT_FROM_Header,
+	EXTRACT_FROM_Cookie,
+}
+
+var variablePattern = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// cloneSteps copies the steps, which are completed when initialized.
+func cloneSteps(steps []Step) []Step {
+	if steps == nil {
+		return nil
+	}
+	cloned := make([]Step, len(steps))
+	for i, step := range steps {
+		step.Extract = append([]Extraction(nil), step.Extract...)
+		cloned[i] = step
+	}
+	return cloned
+}
+
+// initSteps validates the transaction steps.
+func (u *Uptime) initSteps() error {
+	names := make(map[string]bool, len(u.Steps))
+	for i := range u.Steps {
+		step := &u.Steps[i]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", i+1)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("duplicate step name %q", step.Name)
+		}
+		names[step.Name] = true
+
+		if step.URL == "" {
+			step.URL = u.URL
+		}
+		// Variables are only known at runtime, so skip the check for them
+		if !variablePattern.MatchString(step.URL) {
+			parsed, err := url.Parse(step.URL)
+			if err != nil {
+				return fmt.Errorf("step %q: %w", step.Name, err)
+			}
+			if parsed.Scheme != "http" && parsed.Scheme != "https" {
+				return fmt.Errorf("step %q: invalid protocol: %s", step.Name, parsed.Scheme)
+			}
+		}
+		if step.Method == "" {
+			step.Method = http.MethodGet
+		}
+		if err := choice.Check(step.Method, methods); err != nil {
+			return fmt.Errorf("step %q: %w", step.Name, err)
+		}
+
+		step.statusRanges = step.statusRanges[:0]
+		for _, code := range step.ExpectedStatusCodes {
+			r, err := parseStatusRange(code)
+			if err != nil {
+				return fmt.Errorf("step %q: invalid expected_status_codes entry %q: %w", step.Name, code, err)
+			}
+			step.statusRanges = append(step.statusRanges, r)
+		}
+
+		for j := range step.Extract {
+			ex := &step.Extract[j]
+			if ex.Name == "" || ex.Query == "" {
+				return fmt.Errorf("step %q: extract needs a name and a query", step.Name)
+			}
+			if err := choice.Check(ex.From, extractSources); err != nil {
+				return fmt.Errorf("step %q: config option from: %w", step.Name, err)
+			}
+			if ex.From == EXTRACT_FROM_Regex {
+				re, err := regexp.Compile(ex.Query)
+				if err != nil {
+					return fmt.Errorf("step %q: invalid regex %q: %w", step.Name, ex.Query, err)
+				}
+				if re.NumSubexp() > 1 {
+					return fmt.Errorf("step %q: regex %q must have at most one capture group", step.Name, ex.Query)
+				}
+				ex.re = re
+			}
+		}
+	}
+	return nil
+}
+
+type stepStats struct {
+	Name       string
+	Latency    float64
+	StatusCode int
+	Passed     bool
+	Err        error
+	ReqMethod  string
+	ReqHost    string
+	Protocol   string
+}
+
+// expand replaces ${name} references with the extracted variables. Unknown
+// references are kept as they are.
+func expand(s string, vars map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if v, found := vars[ref[2:len(ref)-1]]; found {
+			return v
+		}
+		return ref
+	})
+}
+
+func (u *Uptime) runStep(client *http.Client, step *Step, vars map[string]string) *stepStats {
+	ss := &stepStats{Name: step.Name}
+
+	var body io.Reader
+	if step.Body != "" {
+		body = strings.NewReader(expand(step.Body, vars))
+	}
+	req, err := http.NewRequest(step.Method, expand(step.URL, vars), body)
+	if err != nil {
+		ss.Err = err
+		return ss
+	}
+	for key, value := range step.Headers {
+		req.Header.Add(key, expand(value, vars))
+	}
+	if u.UserAgent != "" {
+		req.Header.Set("User-Agent", u.UserAgent)
+	}
+	if step.ContentType != "" {
+		req.Header.Set("Content-Type", step.ContentType)
+	}
+	// Only set the configured auth if the step did not bring its own
+	if req.Header.Get("Authorization") == "" {
+		if err := u.authorize(req); err != nil {
+			ss.Err = fmt.Errorf("%w: %w", errAuth, err)
+			return ss
+		}
+	}
+	ss.ReqMethod = req.Method
+	ss.ReqHost = req.URL.Host
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		ss.Latency = time.Since(start).Seconds()
+		ss.Err = err
+		return ss
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	ss.Latency = time.Since(start).Seconds()
+	ss.StatusCode = resp.StatusCode
+	ss.Protocol = resp.Proto
+	if err != nil {
+		ss.Err = err
+		return ss
+	}
+
+	if len(step.statusRanges) > 0 {
+		accepted := false
+		for _, r := range step.statusRanges {
+			if resp.StatusCode >= r.min && resp.StatusCode <= r.max {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			ss.Err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			return ss
+		}
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		ss.Err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return ss
+	}
+
+	for _, ex := range step.Extract {
+		value, found := extractValue(client, req.URL, resp, string(respBody), &ex)
+		if !found {
+			ss.Err = fmt.Errorf("could not extract %q from %s", ex.Name, ex.From)
+			return ss
+		}
+		vars[ex.Name] = value
+	}
+
+	ss.Passed = true
+	return ss
+}
+
+func extractValue(client *http.Client, u *url.URL, resp *http.Response, body string, ex *Extraction) (string, bool) {
+	switch ex.From {
+	case EXTRACT_FROM_JSON:
+		result := gjson.Get(body, ex.Query)
+		return result.String(), result.Exists()
+	case EXTRACT_FROM_Regex:
+		match := ex.re.FindStringSubmatch(body)
+		if match == nil {
+			return "", false
+		}
+		return match[len(match)-1], true
+	case EXTRACT_FROM_Header:
+		values, found := resp.Header[http.CanonicalHeaderKey(ex.Query)]
+		if !found || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case EXTRACT_FROM_Cookie:
+		if client.Jar == nil {
+			return "", false
+		}
+		for _, cookie := range client.Jar.Cookies(u) {
+			if cookie.Name == ex.Query {
+				return cookie.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// runTransaction executes the steps in order and stops at the first failing
+// one, as the following steps usually depend on its result. The fields are
+// nil if the transaction could not be run.
+func (u *Uptime) runTransaction(acc telegraf.Accumulator) (*monitors.UptimeData, map[string]interface{}) {
+	fields := &monitors.UptimeData{}
+	fields.Access = monitors.StatusFailed
+	extra := map[string]interface{}{
+		"steps_total":  len(u.Steps),
+		"steps_passed": 0,
+		"failed_step":  "",
+	}
+
+	// The jar carries session cookies from one step to the next
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		acc.AddError(err)
+		return nil, nil
+	}
+	client := u.newClient(nil)
+	client.Jar = jar
+
+	vars := make(map[string]string)
+	var passed int
+	var failure error
+	for i := range u.Steps {
+		ss := u.runStep(client, &u.Steps[i], vars)
+
+		prefix := "step_" + ss.Name + "_"
+		extra[prefix+"latency"] = ss.Latency
+		extra[prefix+"status_code"] = ss.StatusCode
+		extra[prefix+"passed"] = ss.Passed
+
+		fields.Latency += ss.Latency
+		fields.StatusCode = ss.StatusCode
+		fields.ReqMethod = ss.ReqMethod
+		fields.ReqHost = ss.ReqHost
+		fields.Protocol = ss.Protocol
+		if !ss.Passed {
+			extra[prefix+"error"] = ss.Err.Error()
+			extra["failed_step"] = ss.Name
+			failure = ss.Err
+			break
+		}
+		passed++
+	}
+	extra["steps_passed"] = passed
+
+	var netErr net.Error
+	switch {
+	case failure == nil:
+		fields.Result = monitors.Success
+		fields.Access = monitors.StatusSuccess
+	case errors.Is(failure, errAuth):
+		fields.Result = monitors.Failed
+		acc.AddError(failure)
+	case errors.As(failure, &netErr) && netErr.Timeout():
+		fields.Result = monitors.Timeout
+	case fields.StatusCode == 0:
+		fields.Result = monitors.ConnectionFailed
+	default:
+		fields.Result = monitors.Failed
+	}
+
+	return fields, extra
+}
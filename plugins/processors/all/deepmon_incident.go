@@ -0,0 +1,5 @@
+//go:build !custom || processors || processors.deepmon_incident
+
+package all
+
+import _ "github.com/influxdata/telegraf/plugins/processors/deepmon_incident" // register plugin
@@ -0,0 +1,220 @@
+//go:generate ../../../tools/readme_config_includer/generator
+package deepmon_incident
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/processors"
+)
+
+//go:embed sample.conf
+var sampleConfig string
+
+const measurement = "deepmon_incident"
+
+// Events emitted on transitions
+const (
+	EVENT_Opened          = "incident_opened"
+	EVENT_Resolved        = "incident_resolved"
+	EVENT_FlappingStarted = "flapping_started"
+	EVENT_FlappingStopped = "flapping_stopped"
+)
+
+type Incident struct {
+	KeyTags       []string        `toml:"key_tags"`
+	DownField     string          `toml:"down_field"`
+	ResultField   string          `toml:"result_field"`
+	UpResults     []string        `toml:"up_results"`
+	FlapWindow    config.Duration `toml:"flap_window"`
+	FlapThreshold int             `toml:"flap_threshold"`
+
+	up       map[string]bool
+	monitors monitorStates
+}
+
+// monitorStates holds the state of every monitor by its key, persisted
+// across restarts.
+type monitorStates map[string]*monitorState
+
+// monitorState is the last observed state of a monitor and its open
+// incident.
+type monitorState struct {
+	Down bool `json:"down"`
+	// Start of the open incident, zero if the monitor is up
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	// Times of the state changes within the flap window
+	Changes  []time.Time `json:"changes,omitempty"`
+	Flapping bool        `json:"flapping"`
+}
+
+func (*Incident) SampleConfig() string {
+	return sampleConfig
+}
+
+func (p *Incident) Init() error {
+	if p.ResultField == "" && p.DownField == "" {
+		return errors.New("either result_field or down_field is required")
+	}
+	if p.FlapWindow < 0 {
+		return errors.New("flap_window must not be negative")
+	}
+	if p.FlapWindow > 0 && p.FlapThreshold < 2 {
+		return errors.New("flap_threshold must be at least 2")
+	}
+	p.up = make(map[string]bool, len(p.UpResults))
+	for _, v := range p.UpResults {
+		p.up[v] = true
+	}
+	// States are restored before the plugin is initialized
+	if p.monitors == nil {
+		p.monitors = make(monitorStates)
+	}
+	return nil
+}
+
+func (p *Incident) Apply(in ...telegraf.Metric) []telegraf.Metric {
+	var events []telegraf.Metric
+	for _, m := range in {
+		down, found := p.isDown(m)
+		if !found {
+			continue
+		}
+		key, tags := p.key(m)
+		events = append(events, p.update(key, tags, down, m.Time())...)
+	}
+	return append(in, events...)
+}
+
+// isDown returns whether the result of the metric is a failure. The down
+// field takes precedence as it is only set by inputs confirming failures.
+func (p *Incident) isDown(m telegraf.Metric) (down, found bool) {
+	if p.DownField != "" {
+		if v, ok := m.GetField(p.DownField); ok {
+			if b, ok := v.(bool); ok {
+				return b, true
+			}
+		}
+	}
+	if p.ResultField == "" {
+		return false, false
+	}
+	v, ok := m.GetField(p.ResultField)
+	if !ok {
+		return false, false
+	}
+	return !p.up[fmt.Sprint(v)], true
+}
+
+// key identifies the monitor by the metric name and the key tags, which are
+// also the tags of the events.
+func (p *Incident) key(m telegraf.Metric) (string, map[string]string) {
+	tags := map[string]string{"source": m.Name()}
+	parts := []string{m.Name()}
+	for _, k := range p.KeyTags {
+		v, _ := m.GetTag(k)
+		if v != "" {
+			tags[k] = v
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ","), tags
+}
+
+// update tracks the state of the monitor and returns the events of its
+// transitions. While the monitor is flapping its incident is neither opened
+// nor resolved, the state is reconciled once the flapping stopped.
+func (p *Incident) update(key string, tags map[string]string, down bool, t time.Time) []telegraf.Metric {
+	s, found := p.monitors[key]
+	if !found {
+		s = &monitorState{Down: down}
+		p.monitors[key] = s
+	} else if s.Down != down {
+		s.Down = down
+		if p.FlapWindow > 0 {
+			s.Changes = append(s.Changes, t)
+		}
+	}
+
+	var events []telegraf.Metric
+	if p.FlapWindow > 0 {
+		cutoff := t.Add(-time.Duration(p.FlapWindow))
+		i := sort.Search(len(s.Changes), func(i int) bool { return s.Changes[i].After(cutoff) })
+		s.Changes = s.Changes[i:]
+
+		flapping := len(s.Changes) >= p.FlapThreshold
+		if flapping != s.Flapping {
+			s.Flapping = flapping
+			event := EVENT_FlappingStopped
+			if flapping {
+				event = EVENT_FlappingStarted
+			}
+			events = append(events, newEvent(tags, t, event, map[string]interface{}{"state_changes": len(s.Changes)}))
+		}
+	}
+	if s.Flapping {
+		return events
+	}
+
+	open := !s.OpenedAt.IsZero()
+	switch {
+	case down && !open:
+		s.OpenedAt = t
+		events = append(events, newEvent(tags, t, EVENT_Opened, nil))
+	case !down && open:
+		fields := map[string]interface{}{
+			"opened_at": s.OpenedAt.Unix(),
+			"duration":  t.Sub(s.OpenedAt).Seconds(),
+		}
+		s.OpenedAt = time.Time{}
+		events = append(events, newEvent(tags, t, EVENT_Resolved, fields))
+	}
+	return events
+}
+
+func newEvent(tags map[string]string, t time.Time, event string, fields map[string]interface{}) telegraf.Metric {
+	if fields == nil {
+		fields = make(map[string]interface{}, 1)
+	}
+	fields["event"] = event
+	return metric.New(measurement, tags, fields, t)
+}
+
+func (p *Incident) GetState() interface{} {
+	return p.monitors
+}
+
+func (p *Incident) SetState(state interface{}) error {
+	monitors, ok := state.(monitorStates)
+	if !ok {
+		return errors.New("state has to be of type 'monitorStates'")
+	}
+	if p.monitors == nil {
+		p.monitors = make(monitorStates, len(monitors))
+	}
+	for k, v := range monitors {
+		if v != nil {
+			p.monitors[k] = v
+		}
+	}
+	return nil
+}
+
+func init() {
+	processors.Add("deepmon_incident", func() telegraf.Processor {
+		return &Incident{
+			KeyTags:       []string{"monitor", "domain"},
+			DownField:     "confirmed_down",
+			ResultField:   "result",
+			UpResults:     []string{"0"},
+			FlapThreshold: 5,
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package deepmon_incident
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func newIncident() *Incident {
+	return &Incident{
+		KeyTags:       []string{"monitor", "domain"},
+		DownField:     "confirmed_down",
+		ResultField:   "result",
+		UpResults:     []string{"0"},
+		FlapThreshold: 5,
+	}
+}
+
+// check returns a result of the monitor at the given minute
+func check(domain string, minute, result int) telegraf.Metric {
+	return metric.New("deepmon_port",
+		map[string]string{"domain": domain},
+		map[string]interface{}{"result": result},
+		start.Add(time.Duration(minute)*time.Minute),
+	)
+}
+
+// events returns the incident events of the results
+func events(p *Incident, results ...telegraf.Metric) []telegraf.Metric {
+	var out []telegraf.Metric
+	for _, m := range p.Apply(results...) {
+		if m.Name() == measurement {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func TestTransitions(t *testing.T) {
+	p := newIncident()
+	require.NoError(t, p.Init())
+
+	require.Empty(t, events(p, check("example.com", 0, 0)))
+
+	// Results pass through next to the events
+	out := p.Apply(check("example.com", 1, 2))
+	require.Len(t, out, 2)
+	expected := []telegraf.Metric{
+		check("example.com", 1, 2),
+		metric.New(measurement,
+			map[string]string{"domain": "example.com", "source": "deepmon_port"},
+			map[string]interface{}{"event": EVENT_Opened},
+			start.Add(time.Minute),
+		),
+	}
+	testutil.RequireMetricsEqual(t, expected, out)
+
+	// Other monitors are tracked separately
+	require.Len(t, events(p, check("example.org", 2, 2)), 1)
+	require.Empty(t, events(p, check("example.com", 2, 3)))
+
+	expected = []telegraf.Metric{
+		metric.New(measurement,
+			map[string]string{"domain": "example.com", "source": "deepmon_port"},
+			map[string]interface{}{
+				"event":     EVENT_Resolved,
+				"opened_at": start.Add(time.Minute).Unix(),
+				"duration":  float64(240),
+			},
+			start.Add(5*time.Minute),
+		),
+	}
+	testutil.RequireMetricsEqual(t, expected, events(p, check("example.com", 5, 0)))
+}
+
+func TestDownFieldPrecedence(t *testing.T) {
+	p := newIncident()
+	require.NoError(t, p.Init())
+
+	// The failure is not confirmed yet
+	m := check("example.com", 0, 2)
+	m.AddField("confirmed_down", false)
+	require.Empty(t, events(p, m))
+
+	m = check("example.com", 1, 2)
+	m.AddField("confirmed_down", true)
+	require.Len(t, events(p, m), 1)
+
+	// Metrics without result are ignored
+	other := metric.New("deepmon_port", map[string]string{"domain": "example.com"}, map[string]interface{}{"value": 1}, start)
+	require.Empty(t, events(p, other))
+}
+
+func TestFlapping(t *testing.T) {
+	p := newIncident()
+	p.FlapWindow = config.Duration(10 * time.Minute)
+	p.FlapThreshold = 3
+	require.NoError(t, p.Init())
+
+	// Opened and resolved before the threshold is reached
+	require.Empty(t, events(p, check("example.com", 0, 0)))
+	require.Len(t, events(p, check("example.com", 1, 2)), 1)
+	require.Len(t, events(p, check("example.com", 2, 0)), 1)
+
+	// The third change within the window starts the flapping and the incident
+	// is not opened
+	out := events(p, check("example.com", 3, 2))
+	require.Len(t, out, 1)
+	require.Equal(t, EVENT_FlappingStarted, out[0].Fields()["event"])
+	require.Equal(t, int64(3), out[0].Fields()["state_changes"])
+	require.Empty(t, events(p, check("example.com", 4, 0)))
+	require.Empty(t, events(p, check("example.com", 5, 2)))
+
+	// Once the changes left the window the monitor is down for good
+	out = events(p, check("example.com", 16, 2))
+	require.Len(t, out, 2)
+	require.Equal(t, EVENT_FlappingStopped, out[0].Fields()["event"])
+	require.Equal(t, EVENT_Opened, out[1].Fields()["event"])
+}
+
+func TestState(t *testing.T) {
+	p := newIncident()
+	require.NoError(t, p.Init())
+	require.Len(t, events(p, check("example.com", 0, 2)), 1)
+
+	serialized, err := json.Marshal(p.GetState())
+	require.NoError(t, err)
+	var state monitorStates
+	require.NoError(t, json.Unmarshal(serialized, &state))
+
+	// The open incident is neither opened again nor lost after a restart
+	restarted := newIncident()
+	require.NoError(t, restarted.SetState(state))
+	require.NoError(t, restarted.Init())
+	require.Empty(t, events(restarted, check("example.com", 1, 2)))
+	out := events(restarted, check("example.com", 3, 0))
+	require.Len(t, out, 1)
+	require.Equal(t, EVENT_Resolved, out[0].Fields()["event"])
+	require.InDelta(t, 180.0, out[0].Fields()["duration"], 0)
+
+	require.ErrorContains(t, restarted.SetState(map[string]int{}), "state has to be of type")
+}
+
+func TestInit(t *testing.T) {
+	p := newIncident()
+	p.DownField = ""
+	p.ResultField = ""
+	require.ErrorContains(t, p.Init(), "result_field or down_field")
+
+	p = newIncident()
+	p.FlapWindow = config.Duration(time.Minute)
+	p.FlapThreshold = 1
+	require.ErrorContains(t, p.Init(), "flap_threshold")
+}